@@ -0,0 +1,267 @@
+package alias
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/dnsserver"
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+const (
+	DefaultTimeout     = 2 * time.Second
+	DefaultNegativeTTL = 60
+	MaxDepth           = 8     // ALIAS and CNAME records followed for one target
+	MaxCacheEntries    = 10000 // upstream answers cached at once
+)
+
+// Resolver flattens ALIAS records, which may also live at a zone apex, into
+// the A and AAAA records of their target. Targets in local zones are looked
+// up with Local, others at Upstream. Upstream answers are cached for the
+// lowest TTL of their records. Expired answers are dropped when they are
+// looked up again or when the cache is full.
+type Resolver struct {
+	Local       func(query *store.Query) (*schema.Result, error)
+	Upstream    string // recursive resolver, i.e. 192.0.2.53 or 192.0.2.53:5353; empty disables upstream lookups
+	Timeout     time.Duration
+	NegativeTTL uint32 // how long to cache targets without records
+
+	mutex sync.Mutex
+	cache map[string]*cacheEntry
+	now   func() time.Time
+}
+
+type cacheEntry struct {
+	entries []*store.Entry
+	expires time.Time
+}
+
+func NewResolver(local func(*store.Query) (*schema.Result, error), upstream string) *Resolver {
+	return &Resolver{
+		Local:       local,
+		Upstream:    upstream,
+		Timeout:     DefaultTimeout,
+		NegativeTTL: DefaultNegativeTTL,
+		cache:       make(map[string]*cacheEntry),
+		now:         time.Now,
+	}
+}
+
+// Flatten replaces the ALIAS records in the answer to query with the A and
+// AAAA records of their targets. The TTL of a flattened record is the lower
+// one of the ALIAS record and the target's record. Targets that cannot be
+// resolved are logged and left out, so the other records are still answered.
+func (r *Resolver) Flatten(query *store.Query, result *schema.Result) (*schema.Result, error) {
+	var qtypes []string
+
+	switch query.Type {
+	case "A", "AAAA":
+		if len(result.Entries) > 0 || !result.NameExists || result.Delegation != "" {
+			return result, nil
+		}
+
+		aliasResult, err := r.Local(&store.Query{Name: query.Name, Type: "ALIAS"})
+
+		if err != nil {
+			return nil, err
+		}
+
+		result.Entries = aliasResult.Entries
+		qtypes = []string{query.Type}
+	case "ANY":
+		qtypes = []string{"A", "AAAA"}
+	default:
+		return result, nil
+	}
+
+	var entries []*store.Entry
+	flattened := false
+
+	for _, entry := range result.Entries {
+		if entry.Type != "ALIAS" {
+			entries = append(entries, entry)
+			continue
+		}
+
+		flattened = true
+
+		for _, qtype := range qtypes {
+			targetEntries, err := r.resolve(entry.Payload, qtype, 0)
+
+			if err != nil {
+				logging.Warn("Unable to resolve ALIAS target, leaving it out", "qname", query.Name, "qtype", qtype, "target", entry.Payload, "error", err)
+				continue
+			}
+
+			for _, targetEntry := range targetEntries {
+				ttl := targetEntry.Ttl
+				if entry.Ttl < ttl {
+					ttl = entry.Ttl
+				}
+
+				entries = append(entries, &store.Entry{Type: targetEntry.Type, Ttl: ttl, Payload: targetEntry.Payload})
+			}
+		}
+	}
+
+	if !flattened {
+		return result, nil
+	}
+
+	flattenedResult := *result
+	flattenedResult.Entries = entries
+
+	if len(entries) > 0 {
+		flattenedResult.Authority = nil
+	}
+
+	return &flattenedResult, nil
+}
+
+// resolve returns the records of type qtype for target
+func (r *Resolver) resolve(target string, qtype string, depth int) ([]*store.Entry, error) {
+	if depth >= MaxDepth {
+		return nil, fmt.Errorf("More than %d ALIAS or CNAME records to follow", MaxDepth)
+	}
+
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	result, err := r.Local(&store.Query{Name: target, Type: qtype})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Zone == "" || result.Delegation != "" {
+		return r.resolveUpstream(target, qtype)
+	}
+
+	if len(result.Entries) > 0 || !result.NameExists {
+		return result.Entries, nil
+	}
+
+	for _, chainType := range []string{"CNAME", "ALIAS"} {
+		chainResult, err := r.Local(&store.Query{Name: target, Type: chainType})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(chainResult.Entries) > 0 {
+			return r.resolve(chainResult.Entries[0].Payload, qtype, depth+1)
+		}
+	}
+
+	return nil, nil
+}
+
+func (r *Resolver) resolveUpstream(target string, qtype string) ([]*store.Entry, error) {
+	if r.Upstream == "" {
+		return nil, fmt.Errorf("%s is not in a local zone and no upstream resolver is configured", target)
+	}
+
+	key := qtype + " " + target
+	now := r.now()
+
+	r.mutex.Lock()
+	cached, ok := r.cache[key]
+	if ok && !now.Before(cached.expires) {
+		delete(r.cache, key)
+	}
+	r.mutex.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return withRemainingTTL(cached.entries, cached.expires.Sub(now)), nil
+	}
+
+	entries, err := r.query(target, qtype)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := r.NegativeTTL
+	for i, entry := range entries {
+		if i == 0 || entry.Ttl < ttl {
+			ttl = entry.Ttl
+		}
+	}
+
+	r.mutex.Lock()
+	if len(r.cache) >= MaxCacheEntries {
+		r.evict(now)
+	}
+	r.cache[key] = &cacheEntry{entries, now.Add(time.Duration(ttl) * time.Second)}
+	r.mutex.Unlock()
+
+	return entries, nil
+}
+
+// evict drops the expired answers, or the one expiring first if none has
+// expired. The caller holds the mutex.
+func (r *Resolver) evict(now time.Time) {
+	var first string
+
+	for key, cached := range r.cache {
+		if !now.Before(cached.expires) {
+			delete(r.cache, key)
+		} else if first == "" || cached.expires.Before(r.cache[first].expires) {
+			first = key
+		}
+	}
+
+	if len(r.cache) >= MaxCacheEntries {
+		delete(r.cache, first)
+	}
+}
+
+func (r *Resolver) query(target string, qtype string) (entries []*store.Entry, err error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(target), dns.StringToType[qtype])
+
+	client := &dns.Client{Timeout: r.Timeout}
+	resp, _, err := client.Exchange(msg, dnsserver.WithDefaultPort(r.Upstream))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s answered %s query for %s with rcode %s", r.Upstream, qtype, target, dns.RcodeToString[resp.Rcode])
+	}
+
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if qtype == "A" {
+				entries = append(entries, &store.Entry{Type: "A", Ttl: rr.Hdr.Ttl, Payload: rr.A.String()})
+			}
+		case *dns.AAAA:
+			if qtype == "AAAA" {
+				entries = append(entries, &store.Entry{Type: "AAAA", Ttl: rr.Hdr.Ttl, Payload: rr.AAAA.String()})
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+func withRemainingTTL(entries []*store.Entry, remaining time.Duration) []*store.Entry {
+	result := make([]*store.Entry, len(entries))
+
+	for i, entry := range entries {
+		ttl := uint32(remaining / time.Second)
+		if entry.Ttl < ttl {
+			ttl = entry.Ttl
+		}
+
+		result[i] = &store.Entry{Type: entry.Type, Ttl: ttl, Payload: entry.Payload}
+	}
+
+	return result
+}
@@ -0,0 +1,207 @@
+package alias
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+var localRecords = map[string][]*store.Entry{
+	"example.com": {
+		{Type: "ALIAS", Ttl: 300, Payload: "cdn.example.net."},
+		{Type: "MX", Ttl: 60, Payload: "10 mx.example.com."},
+	},
+	"www.example.com":   {{Type: "ALIAS", Ttl: 30, Payload: "lb.example.com"}},
+	"lb.example.com":    {{Type: "A", Ttl: 60, Payload: "192.0.2.10"}},
+	"loop.example.com":  {{Type: "ALIAS", Ttl: 60, Payload: "loop.example.com"}},
+	"other.example.com": {{Type: "ALIAS", Ttl: 60, Payload: "missing.example.com"}},
+}
+
+func localResolve(query *store.Query) (*schema.Result, error) {
+	name := strings.ToLower(query.Name)
+
+	if name != "example.com" && !strings.HasSuffix(name, ".example.com") {
+		return &schema.Result{}, nil
+	}
+
+	result := &schema.Result{Zone: "example.com"}
+
+	for _, entry := range localRecords[name] {
+		result.NameExists = true
+
+		if query.Type == "ANY" || query.Type == entry.Type {
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+
+	return result, nil
+}
+
+// stubResolver answers A queries for cdn.example.net and counts them
+func stubResolver(t *testing.T) (address string, queries *int32, shutdown func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+
+	queries = new(int32)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+
+		if req.Question[0].Name == "cdn.example.net." && req.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR("cdn.example.net. 120 IN A 198.51.100.1")
+			resp.Answer = append(resp.Answer, rr)
+		}
+
+		w.WriteMsg(resp)
+	})
+
+	server := &dns.Server{PacketConn: conn, Handler: handler}
+	go server.ActivateAndServe()
+
+	return conn.LocalAddr().String(), queries, func() { server.Shutdown() }
+}
+
+var flattenTests = []struct {
+	name            string
+	qtype           string
+	expectedEntries []*store.Entry
+	expectedErr     bool
+}{
+	{"example.com", "A", []*store.Entry{{Type: "A", Ttl: 120, Payload: "198.51.100.1"}}, false},
+	{"example.com", "AAAA", nil, false},
+	{"example.com", "ANY", []*store.Entry{{Type: "A", Ttl: 120, Payload: "198.51.100.1"}, {Type: "MX", Ttl: 60, Payload: "10 mx.example.com."}}, false},
+	{"example.com", "MX", []*store.Entry{{Type: "MX", Ttl: 60, Payload: "10 mx.example.com."}}, false},
+	{"www.example.com", "A", []*store.Entry{{Type: "A", Ttl: 30, Payload: "192.0.2.10"}}, false},
+	{"lb.example.com", "A", []*store.Entry{{Type: "A", Ttl: 60, Payload: "192.0.2.10"}}, false},
+	{"other.example.com", "A", nil, false},
+	{"loop.example.com", "A", nil, false},
+}
+
+func TestFlatten(t *testing.T) {
+	address, _, shutdown := stubResolver(t)
+	defer shutdown()
+
+	now := time.Now()
+	resolver := NewResolver(localResolve, address)
+	resolver.now = func() time.Time { return now }
+
+	for _, tt := range flattenTests {
+		query := &store.Query{Name: tt.name, Type: tt.qtype}
+		result, _ := localResolve(query)
+		actual, err := resolver.Flatten(query, result)
+
+		if (err != nil) != tt.expectedErr {
+			t.Errorf("TestFlatten(%s %s): actual error %v, expected error %v", tt.name, tt.qtype, err, tt.expectedErr)
+			continue
+		}
+
+		if err == nil && !reflect.DeepEqual(actual.Entries, tt.expectedEntries) {
+			t.Errorf("TestFlatten(%s %s): actual %s, expected %s", tt.name, tt.qtype, entriesString(actual.Entries), entriesString(tt.expectedEntries))
+		}
+	}
+}
+
+func TestFlattenWithoutUpstream(t *testing.T) {
+	query := &store.Query{Name: "example.com", Type: "ANY"}
+	result, _ := localResolve(query)
+	actual, err := NewResolver(localResolve, "").Flatten(query, result)
+	expected := []*store.Entry{{Type: "MX", Ttl: 60, Payload: "10 mx.example.com."}}
+
+	if err != nil || !reflect.DeepEqual(actual.Entries, expected) {
+		t.Errorf("TestFlattenWithoutUpstream: actual %v %v, expected %s", actual, err, entriesString(expected))
+	}
+}
+
+func TestResolveUpstreamCache(t *testing.T) {
+	address, queries, shutdown := stubResolver(t)
+	defer shutdown()
+
+	now := time.Now()
+	resolver := NewResolver(localResolve, address)
+	resolver.now = func() time.Time { return now }
+
+	resolver.resolve("cdn.example.net", "A", 0)
+	now = now.Add(100 * time.Second)
+	entries, err := resolver.resolve("cdn.example.net", "A", 0)
+
+	if err != nil || atomic.LoadInt32(queries) != 1 || len(entries) != 1 || entries[0].Ttl != 20 {
+		t.Errorf("TestResolveUpstreamCache: actual %v %v after %d queries, expected cached entry with TTL 20", entries, err, atomic.LoadInt32(queries))
+	}
+
+	now = now.Add(21 * time.Second)
+	resolver.resolve("cdn.example.net", "A", 0)
+
+	if atomic.LoadInt32(queries) != 2 {
+		t.Errorf("TestResolveUpstreamCache: actual %d queries, expected 2 after expiry", atomic.LoadInt32(queries))
+	}
+
+	resolver.resolve("nothing.example.net", "A", 0)
+	resolver.resolve("nothing.example.net", "A", 0)
+
+	if atomic.LoadInt32(queries) != 3 {
+		t.Errorf("TestResolveUpstreamCache: actual %d queries, expected 3 with negative caching", atomic.LoadInt32(queries))
+	}
+}
+
+func TestResolveUpstreamCacheEviction(t *testing.T) {
+	address, _, shutdown := stubResolver(t)
+
+	now := time.Now()
+	resolver := NewResolver(localResolve, address)
+	resolver.now = func() time.Time { return now }
+
+	for i := 0; i < MaxCacheEntries; i++ {
+		resolver.cache[fmt.Sprintf("A host%d.example.net", i)] = &cacheEntry{expires: now.Add(time.Duration(i+1) * time.Second)}
+	}
+	resolver.resolve("cdn.example.net", "A", 0)
+
+	_, first := resolver.cache["A host0.example.net"]
+	if len(resolver.cache) != MaxCacheEntries || first {
+		t.Errorf("TestResolveUpstreamCacheEviction: actual %d entries, first kept %v, expected %d without the entry expiring first", len(resolver.cache), first, MaxCacheEntries)
+	}
+
+	now = now.Add(time.Duration(MaxCacheEntries) * time.Second)
+	shutdown()
+	resolver.Timeout = 100 * time.Millisecond
+
+	if _, err := resolver.resolve("cdn.example.net", "A", 0); err == nil {
+		t.Fatalf("TestResolveUpstreamCacheEviction: expected an error with the upstream resolver down")
+	}
+
+	if _, ok := resolver.cache["A cdn.example.net"]; ok {
+		t.Errorf("TestResolveUpstreamCacheEviction: actual expired entry kept, expected it dropped on lookup")
+	}
+
+	resolver.evict(now)
+
+	if len(resolver.cache) != 0 {
+		t.Errorf("TestResolveUpstreamCacheEviction: actual %d entries, expected all of them expired and dropped", len(resolver.cache))
+	}
+}
+
+func TestResolveWithoutUpstream(t *testing.T) {
+	if _, err := NewResolver(localResolve, "").resolve("cdn.example.net", "A", 0); err == nil {
+		t.Errorf("TestResolveWithoutUpstream: expected an error")
+	}
+}
+
+func entriesString(entries []*store.Entry) string {
+	var formatted []string
+	for _, entry := range entries {
+		formatted = append(formatted, fmt.Sprintf("%s %d %s", entry.Type, entry.Ttl, entry.Payload))
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,496 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+// Prefix is where the API is served, the same as the PowerDNS HTTP API's
+const Prefix = "/api/v1/servers/localhost"
+
+// Server implements the parts of the PowerDNS HTTP API needed to manage
+// zones and records (https://doc.powerdns.com/authoritative/http-api/), so
+// tools written for PowerDNS can manage zones in the store.
+type Server struct {
+	Schemas    []schema.Schema
+	APIKey     string // expected in the X-API-Key header
+	DefaultTTL uint32 // TTL of the NS records of new zones
+
+	// SOA returns the SOA record of zone without writing to the store
+	SOA func(zone string, kv store.Store) (*store.Entry, error)
+	// UpdateSOA updates the serial of zone after the API changed it, the
+	// serial is left to the zone watcher if it is nil
+	UpdateSOA func(zone string, kv store.Store) error
+}
+
+type apiZone struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Kind        string      `json:"kind"`
+	Serial      uint32      `json:"serial"`
+	URL         string      `json:"url"`
+	Nameservers []string    `json:"nameservers,omitempty"`
+	RRsets      []*apiRRset `json:"rrsets,omitempty"`
+}
+
+type apiRRset struct {
+	Name       string       `json:"name"`
+	Type       string       `json:"type"`
+	TTL        uint32       `json:"ttl"`
+	ChangeType string       `json:"changetype,omitempty"`
+	Records    []*apiRecord `json:"records"`
+}
+
+type apiRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+// apiError is answered with its status code and message
+type apiError struct {
+	status  int
+	message string
+}
+
+func (err *apiError) Error() string {
+	return err.message
+}
+
+func errorf(status int, format string, a ...interface{}) error {
+	return &apiError{status, fmt.Sprintf(format, a...)}
+}
+
+func (s *Server) ListenAndServe(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle(Prefix, s)
+	mux.Handle(Prefix+"/", s)
+
+	return http.ListenAndServe(address, mux)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.APIKey == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(s.APIKey)) != 1 {
+		s.writeError(w, errorf(http.StatusUnauthorized, "Unauthorized"))
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, Prefix)
+	var (
+		result interface{}
+		status = http.StatusOK
+		err    error
+	)
+
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		result = map[string]string{"id": "localhost", "type": "Server", "daemon_type": "authoritative", "url": Prefix, "zones_url": Prefix + "/zones{/zone}"}
+	case path == "/zones" && r.Method == http.MethodGet:
+		result, err = s.listZones()
+	case path == "/zones" && r.Method == http.MethodPost:
+		result, err = s.createZone(r)
+		status = http.StatusCreated
+	case strings.HasPrefix(path, "/zones/") && strings.HasSuffix(path, "/rrsets"):
+		zone := normalizeZone(strings.TrimSuffix(strings.TrimPrefix(path, "/zones/"), "/rrsets"))
+
+		switch r.Method {
+		case http.MethodGet:
+			result, err = s.getRRsets(zone)
+		case http.MethodPut:
+			err = s.putRRsets(zone, r)
+			status = http.StatusNoContent
+		default:
+			err = errorf(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		}
+	case strings.HasPrefix(path, "/zones/") && !strings.Contains(strings.TrimPrefix(path, "/zones/"), "/"):
+		zone := normalizeZone(strings.TrimPrefix(path, "/zones/"))
+
+		switch r.Method {
+		case http.MethodGet:
+			result, err = s.getZone(zone)
+		case http.MethodPut:
+			err = s.putZone(zone, r)
+			status = http.StatusNoContent
+		case http.MethodPatch:
+			err = s.patchZone(zone, r)
+			status = http.StatusNoContent
+		case http.MethodDelete:
+			err = s.deleteZone(zone)
+			status = http.StatusNoContent
+		default:
+			err = errorf(http.StatusMethodNotAllowed, "Method %s not allowed", r.Method)
+		}
+	default:
+		err = errorf(http.StatusNotFound, "Not found")
+	}
+
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	if apiErr, ok := err.(*apiError); ok {
+		status = apiErr.status
+	} else if err == schema.ErrConflict {
+		status = http.StatusConflict
+	} else if err == store.ErrTxnTooLarge {
+		status = http.StatusUnprocessableEntity
+	} else {
+		logging.Error("API request failed", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func (s *Server) listZones() ([]*apiZone, error) {
+	zones := make([]*apiZone, 0)
+	seen := make(map[string]bool)
+
+	for _, curSchema := range s.Schemas {
+		schemaZones, err := curSchema.Zones()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, zone := range schemaZones {
+			if seen[zone] {
+				continue
+			}
+
+			seen[zone] = true
+			zones = append(zones, s.zoneInfo(zone, curSchema))
+		}
+	}
+
+	return zones, nil
+}
+
+func (s *Server) getZone(zone string) (*apiZone, error) {
+	_, zoneSchema, err := s.editor(zone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := s.zoneInfo(zone, zoneSchema)
+	result.RRsets, err = s.getRRsets(zone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// getRRsets returns the generated SOA record and the stored rrsets of zone
+func (s *Server) getRRsets(zone string) ([]*apiRRset, error) {
+	editor, zoneSchema, err := s.editor(zone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rrsets, err := editor.RRsets(zone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*apiRRset, 0, len(rrsets)+1)
+
+	if soa, err := s.SOA(zone, zoneSchema.Store()); err == nil && soa != nil {
+		result = append(result, &apiRRset{Name: zone + ".", Type: "SOA", TTL: soa.Ttl, Records: []*apiRecord{{Content: soa.Payload}}})
+	}
+
+	for _, rrset := range rrsets {
+		result = append(result, toAPIRRset(rrset))
+	}
+
+	return result, nil
+}
+
+func (s *Server) createZone(r *http.Request) (*apiZone, error) {
+	var request apiZone
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return nil, errorf(http.StatusBadRequest, "Invalid request: %v", err)
+	}
+
+	zone := normalizeZone(request.Name)
+
+	if _, ok := dns.IsDomainName(zone); zone == "" || !ok {
+		return nil, errorf(http.StatusUnprocessableEntity, "Invalid zone name %q", request.Name)
+	}
+
+	if _, _, err := s.editor(zone); err == nil {
+		return nil, errorf(http.StatusConflict, "Zone %s already exists", zone)
+	}
+
+	var (
+		editor     schema.Editor
+		zoneSchema schema.Schema
+	)
+	for _, curSchema := range s.Schemas {
+		if curEditor, ok := curSchema.(schema.Editor); ok {
+			editor, zoneSchema = curEditor, curSchema
+			break
+		}
+	}
+
+	if editor == nil {
+		return nil, errorf(http.StatusNotImplemented, "No schema supports creating zones")
+	}
+
+	rrsets := request.RRsets
+	if len(request.Nameservers) > 0 {
+		ns := &apiRRset{Name: zone + ".", Type: "NS", TTL: s.DefaultTTL}
+		for _, nameserver := range request.Nameservers {
+			ns.Records = append(ns.Records, &apiRecord{Content: dns.Fqdn(nameserver)})
+		}
+		rrsets = append(rrsets, ns)
+	}
+
+	if len(rrsets) == 0 {
+		return nil, errorf(http.StatusUnprocessableEntity, "Zone %s needs at least one name server or record", zone)
+	}
+
+	if err := s.applyRRsets(zone, editor, rrsets); err != nil {
+		return nil, err
+	}
+
+	s.updateSOA(zone, zoneSchema)
+	return s.getZone(zone)
+}
+
+// putZone accepts the zone settings of the PowerDNS API. Zones are always
+// native and have no settings to store, so rrsets and other kinds are
+// rejected.
+func (s *Server) putZone(zone string, r *http.Request) error {
+	if _, _, err := s.editor(zone); err != nil {
+		return err
+	}
+
+	var request apiZone
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return errorf(http.StatusBadRequest, "Invalid request: %v", err)
+	}
+
+	if request.Kind != "" && !strings.EqualFold(request.Kind, "Native") {
+		return errorf(http.StatusUnprocessableEntity, "Unsupported zone kind %s, only Native zones are supported", request.Kind)
+	}
+
+	if len(request.RRsets) > 0 || len(request.Nameservers) > 0 {
+		return errorf(http.StatusUnprocessableEntity, "Records cannot be changed with PUT, use PATCH or PUT rrsets")
+	}
+
+	return nil
+}
+
+func (s *Server) patchZone(zone string, r *http.Request) error {
+	editor, zoneSchema, err := s.editor(zone)
+
+	if err != nil {
+		return err
+	}
+
+	var request apiZone
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return errorf(http.StatusBadRequest, "Invalid request: %v", err)
+	}
+
+	if err := s.applyRRsets(zone, editor, request.RRsets); err != nil {
+		return err
+	}
+
+	s.updateSOA(zone, zoneSchema)
+	return nil
+}
+
+// putRRsets replaces all records of zone with rrsets, rrsets of the zone
+// that are not given are deleted
+func (s *Server) putRRsets(zone string, r *http.Request) error {
+	editor, zoneSchema, err := s.editor(zone)
+
+	if err != nil {
+		return err
+	}
+
+	var rrsets []*apiRRset
+
+	if err := json.NewDecoder(r.Body).Decode(&rrsets); err != nil {
+		return errorf(http.StatusBadRequest, "Invalid request: %v", err)
+	}
+
+	given := make(map[string]bool)
+
+	for _, rrset := range rrsets {
+		if rrset.ChangeType != "" && !strings.EqualFold(rrset.ChangeType, "REPLACE") {
+			return errorf(http.StatusUnprocessableEntity, "Unsupported changetype %s, PUT replaces all rrsets", rrset.ChangeType)
+		}
+
+		given[rrsetKey(rrset.Name, rrset.Type)] = true
+	}
+
+	current, err := editor.RRsets(zone)
+
+	if err != nil {
+		return err
+	}
+
+	for _, rrset := range current {
+		if !given[rrsetKey(rrset.Name, rrset.Type)] {
+			rrsets = append(rrsets, &apiRRset{Name: rrset.Name, Type: rrset.Type, ChangeType: "DELETE"})
+		}
+	}
+
+	if err := s.applyRRsets(zone, editor, rrsets); err != nil {
+		return err
+	}
+
+	s.updateSOA(zone, zoneSchema)
+	return nil
+}
+
+func (s *Server) deleteZone(zone string) error {
+	editor, _, err := s.editor(zone)
+
+	if err != nil {
+		return err
+	}
+
+	return editor.DeleteZone(zone)
+}
+
+// applyRRsets validates all rrsets and writes them in one transaction
+func (s *Server) applyRRsets(zone string, editor schema.Editor, rrsets []*apiRRset) error {
+	changes := make([]*schema.RRset, len(rrsets))
+
+	for i, rrset := range rrsets {
+		change, err := toRRset(zone, rrset)
+
+		if err != nil {
+			return err
+		}
+
+		changes[i] = change
+	}
+
+	return editor.ReplaceRRsets(zone, changes)
+}
+
+// updateSOA updates the serial of zone after a change, a failure is logged
+// since the change has been written
+func (s *Server) updateSOA(zone string, zoneSchema schema.Schema) {
+	if s.UpdateSOA == nil {
+		return
+	}
+
+	if err := s.UpdateSOA(zone, zoneSchema.Store()); err != nil {
+		logging.Error("Unable to update SOA entry of changed zone", "zone", zone, "error", err)
+	}
+}
+
+// editor returns the schema serving exactly zone
+func (s *Server) editor(zone string) (schema.Editor, schema.Schema, error) {
+	found, zoneSchema, err := schema.NewZoneIndex(s.Schemas).Lookup(zone)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if zoneSchema == nil || found != zone {
+		return nil, nil, errorf(http.StatusNotFound, "Zone %s does not exist", zone)
+	}
+
+	editor, ok := zoneSchema.(schema.Editor)
+
+	if !ok {
+		return nil, nil, errorf(http.StatusNotImplemented, "The schema of zone %s does not support editing", zone)
+	}
+
+	return editor, zoneSchema, nil
+}
+
+func (s *Server) zoneInfo(zone string, zoneSchema schema.Schema) *apiZone {
+	info := &apiZone{ID: zone + ".", Name: zone + ".", Kind: "Native", URL: Prefix + "/zones/" + zone + "."}
+
+	if soa, err := s.SOA(zone, zoneSchema.Store()); err == nil && soa != nil {
+		if fields := strings.Fields(soa.Payload); len(fields) > 2 {
+			serial, _ := strconv.ParseUint(fields[2], 10, 32)
+			info.Serial = uint32(serial)
+		}
+	}
+
+	return info
+}
+
+func toAPIRRset(rrset *schema.RRset) *apiRRset {
+	result := &apiRRset{Name: rrset.Name, Type: rrset.Type, TTL: rrset.TTL, Records: make([]*apiRecord, 0)}
+
+	for _, payload := range rrset.Payloads {
+		result.Records = append(result.Records, &apiRecord{Content: payload})
+	}
+
+	return result
+}
+
+// toRRset validates rrset and turns it into a change, DELETE changes and
+// rrsets without records remove all records of the name and type
+func toRRset(zone string, rrset *apiRRset) (*schema.RRset, error) {
+	change := &schema.RRset{Name: strings.ToLower(dns.Fqdn(rrset.Name)), Type: strings.ToUpper(rrset.Type), TTL: rrset.TTL}
+
+	switch strings.ToUpper(rrset.ChangeType) {
+	case "DELETE":
+	case "", "REPLACE":
+		for _, record := range rrset.Records {
+			if record.Disabled {
+				return nil, errorf(http.StatusUnprocessableEntity, "Disabled records are not supported")
+			}
+
+			change.Payloads = append(change.Payloads, record.Content)
+		}
+	default:
+		return nil, errorf(http.StatusUnprocessableEntity, "Unknown changetype %s", rrset.ChangeType)
+	}
+
+	if err := change.Validate(zone); err != nil {
+		return nil, errorf(http.StatusUnprocessableEntity, "%v", err)
+	}
+
+	return change, nil
+}
+
+func rrsetKey(name string, rrtype string) string {
+	return strings.ToLower(dns.Fqdn(name)) + " " + strings.ToUpper(rrtype)
+}
+
+func normalizeZone(zone string) string {
+	return strings.ToLower(strings.TrimSuffix(zone, "."))
+}
@@ -0,0 +1,354 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+func testServer(pairs map[string]string) *Server {
+	return &Server{
+		Schemas:    []schema.Schema{schema.NewFlatSchema(store.NewMemoryStore(pairs), 60)},
+		APIKey:     "secret",
+		DefaultTTL: 60,
+		SOA: func(zone string, kv store.Store) (*store.Entry, error) {
+			return &store.Entry{Type: "SOA", Ttl: 3600, Payload: "ns.example.com. hostmaster.example.com. 2021010101 1200 180 1209600 60"}, nil
+		},
+	}
+}
+
+func request(server *Server, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, Prefix+path, strings.NewReader(body))
+	req.Header.Set("X-API-Key", "secret")
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func keys(pairs map[string]string) []string {
+	var result []string
+	for key := range pairs {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestServeHTTPUnauthorized(t *testing.T) {
+	server := testServer(map[string]string{})
+
+	for _, apiKey := range []string{"", "wrong"} {
+		req := httptest.NewRequest(http.MethodGet, Prefix+"/zones", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("TestServeHTTPUnauthorized(%q): actual %d, expected %d", apiKey, recorder.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestListZones(t *testing.T) {
+	server := testServer(map[string]string{
+		"zones/example.com/A":     `[{"Payload":"192.0.2.1"}]`,
+		"zones/example.org/www/A": `[{"Payload":"192.0.2.2"}]`,
+	})
+
+	recorder := request(server, http.MethodGet, "/zones", "")
+
+	var zones []*apiZone
+	if err := json.NewDecoder(recorder.Body).Decode(&zones); err != nil {
+		t.Fatalf("TestListZones: unexpected error %v", err)
+	}
+
+	var names []string
+	for _, zone := range zones {
+		names = append(names, zone.Name)
+
+		if zone.Serial != 2021010101 {
+			t.Errorf("TestListZones: actual serial %d, expected %d", zone.Serial, 2021010101)
+		}
+	}
+	sort.Strings(names)
+
+	if expected := []string{"example.com.", "example.org."}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("TestListZones: actual %v, expected %v", names, expected)
+	}
+}
+
+func TestGetZone(t *testing.T) {
+	server := testServer(map[string]string{
+		"zones/example.com/NS":    `[{"Payload":"ns.example.com."}]`,
+		"zones/example.com/www/A": `[{"TTL":300,"Payload":"192.0.2.1"},{"Payload":"192.0.2.2"}]`,
+	})
+
+	recorder := request(server, http.MethodGet, "/zones/example.com.", "")
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("TestGetZone: actual status %d, expected %d", recorder.Code, http.StatusOK)
+	}
+
+	var zone apiZone
+	if err := json.NewDecoder(recorder.Body).Decode(&zone); err != nil {
+		t.Fatalf("TestGetZone: unexpected error %v", err)
+	}
+
+	expected := []*apiRRset{
+		{Name: "example.com.", Type: "SOA", TTL: 3600, Records: []*apiRecord{{Content: "ns.example.com. hostmaster.example.com. 2021010101 1200 180 1209600 60"}}},
+		{Name: "example.com.", Type: "NS", TTL: 60, Records: []*apiRecord{{Content: "ns.example.com."}}},
+		{Name: "www.example.com.", Type: "A", TTL: 300, Records: []*apiRecord{{Content: "192.0.2.1"}, {Content: "192.0.2.2"}}},
+	}
+
+	if !reflect.DeepEqual(zone.RRsets, expected) {
+		actual, _ := json.Marshal(zone.RRsets)
+		t.Errorf("TestGetZone: actual %s", actual)
+	}
+
+	if recorder := request(server, http.MethodGet, "/zones/example.org.", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("TestGetZone: actual status %d, expected %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestCreateZone(t *testing.T) {
+	pairs := map[string]string{
+		"zones/example.org/A": `[{"Payload":"192.0.2.1"}]`,
+	}
+	server := testServer(pairs)
+
+	testCases := []struct {
+		body     string
+		expected int
+	}{
+		{`{"name":"example.org.","kind":"Native","nameservers":["ns.example.org."]}`, http.StatusConflict},
+		{`{"name":"example.com.","kind":"Native"}`, http.StatusUnprocessableEntity},
+		{`{"name":"example.com.","rrsets":[{"name":"www.example.net.","type":"A","ttl":60,"records":[{"content":"192.0.2.1"}]}]}`, http.StatusUnprocessableEntity},
+		{`{"name":"example.com.","kind":"Native","nameservers":["ns1.example.com"],"rrsets":[{"name":"www.example.com.","type":"A","ttl":300,"records":[{"content":"192.0.2.1"}]}]}`, http.StatusCreated},
+	}
+
+	for _, tc := range testCases {
+		if recorder := request(server, http.MethodPost, "/zones", tc.body); recorder.Code != tc.expected {
+			t.Errorf("TestCreateZone(%s): actual %d, expected %d", tc.body, recorder.Code, tc.expected)
+		}
+	}
+
+	expected := map[string]string{
+		"zones/example.org/A":     `[{"Payload":"192.0.2.1"}]`,
+		"zones/example.com/NS":    `[{"TTL":60,"Payload":"ns1.example.com."}]`,
+		"zones/example.com/www/A": `[{"TTL":300,"Payload":"192.0.2.1"}]`,
+	}
+
+	if !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("TestCreateZone: actual %v, expected %v", pairs, expected)
+	}
+}
+
+func TestPatchZone(t *testing.T) {
+	testCases := []struct {
+		body     string
+		status   int
+		expected []string
+	}{
+		{`{"rrsets":[{"name":"www.example.com.","type":"AAAA","ttl":60,"changetype":"REPLACE","records":[{"content":"2001:db8::1"}]}]}`, http.StatusNoContent,
+			[]string{"zones/example.com/NS", "zones/example.com/www/A", "zones/example.com/www/AAAA"}},
+		{`{"rrsets":[{"name":"www.example.com.","type":"A","changetype":"DELETE"}]}`, http.StatusNoContent,
+			[]string{"zones/example.com/NS"}},
+		{`{"rrsets":[{"name":"_acme-challenge.example.com.","type":"TXT","ttl":60,"changetype":"REPLACE","records":[{"content":"\"token\""}]}]}`, http.StatusNoContent,
+			[]string{"zones/example.com/NS", "zones/example.com/_acme-challenge/TXT", "zones/example.com/www/A"}},
+		{`{"rrsets":[{"name":"www.example.com.","type":"A","ttl":60,"changetype":"REPLACE","records":[{"content":"not-an-address"}]}]}`, http.StatusUnprocessableEntity,
+			[]string{"zones/example.com/NS", "zones/example.com/www/A"}},
+		{`{"rrsets":[{"name":"www.example.com.","type":"A","ttl":60,"changetype":"REPLACE","records":[{"content":"192.0.2.9","disabled":true}]}]}`, http.StatusUnprocessableEntity,
+			[]string{"zones/example.com/NS", "zones/example.com/www/A"}},
+		{`{"rrsets":[{"name":"example.com.","type":"SOA","ttl":60,"changetype":"REPLACE","records":[{"content":"ns. host. 1 2 3 4 5"}]}]}`, http.StatusUnprocessableEntity,
+			[]string{"zones/example.com/NS", "zones/example.com/www/A"}},
+		{`{"rrsets":[{"name":"mail.example.com.","type":"CNAME","ttl":60,"changetype":"REPLACE","records":[{"content":"a.example.net."},{"content":"b.example.net."}]}]}`, http.StatusUnprocessableEntity,
+			[]string{"zones/example.com/NS", "zones/example.com/www/A"}},
+		{`{"rrsets":[{"name":"example.com.","type":"ALIAS","ttl":60,"changetype":"REPLACE","records":[{"content":"lb.example.net."}]}]}`, http.StatusNoContent,
+			[]string{"zones/example.com/ALIAS", "zones/example.com/NS", "zones/example.com/www/A"}},
+	}
+
+	for _, tc := range testCases {
+		pairs := map[string]string{
+			"zones/example.com/NS":    `[{"Payload":"ns.example.com."}]`,
+			"zones/example.com/www/A": `[{"Payload":"192.0.2.1"}]`,
+		}
+		server := testServer(pairs)
+
+		if recorder := request(server, http.MethodPatch, "/zones/example.com.", tc.body); recorder.Code != tc.status {
+			t.Errorf("TestPatchZone(%s): actual status %d, expected %d", tc.body, recorder.Code, tc.status)
+		}
+
+		if actual := keys(pairs); !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("TestPatchZone(%s): actual %v, expected %v", tc.body, actual, tc.expected)
+		}
+	}
+}
+
+func TestDeleteZone(t *testing.T) {
+	pairs := map[string]string{
+		"zones/example.com/NS":    `[{"Payload":"ns.example.com."}]`,
+		"zones/example.com/www/A": `[{"Payload":"192.0.2.1"}]`,
+		"zones/example.org/A":     `[{"Payload":"192.0.2.1"}]`,
+	}
+	server := testServer(pairs)
+
+	if recorder := request(server, http.MethodDelete, "/zones/example.com.", ""); recorder.Code != http.StatusNoContent {
+		t.Errorf("TestDeleteZone: actual status %d, expected %d", recorder.Code, http.StatusNoContent)
+	}
+
+	if actual, expected := keys(pairs), []string{"zones/example.org/A"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TestDeleteZone: actual %v, expected %v", actual, expected)
+	}
+}
+
+func TestDeleteZoneTooLarge(t *testing.T) {
+	pairs := map[string]string{"zones/example.com/NS": `[{"Payload":"ns.example.com."}]`}
+	for i := 0; i < store.ConsulMaxTxnOps; i++ {
+		pairs[fmt.Sprintf("zones/example.com/host%d/A", i)] = `[{"Payload":"192.0.2.1"}]`
+	}
+	kv := store.NewMemoryStore(pairs)
+	kv.MaxTxnOps = store.ConsulMaxTxnOps
+	server := testServer(pairs)
+	server.Schemas = []schema.Schema{schema.NewFlatSchema(kv, 60)}
+
+	recorder := request(server, http.MethodDelete, "/zones/example.com.", "")
+
+	if recorder.Code != http.StatusUnprocessableEntity || !strings.Contains(recorder.Body.String(), "64") {
+		t.Errorf("TestDeleteZoneTooLarge: actual status %d %s, expected %d naming the limit", recorder.Code, recorder.Body.String(), http.StatusUnprocessableEntity)
+	}
+
+	if actual := len(pairs); actual != store.ConsulMaxTxnOps+1 {
+		t.Errorf("TestDeleteZoneTooLarge: actual %d keys, expected %d", actual, store.ConsulMaxTxnOps+1)
+	}
+}
+
+func TestGetRRsets(t *testing.T) {
+	server := testServer(map[string]string{
+		"zones/example.com/NS":    `[{"Payload":"ns.example.com."}]`,
+		"zones/example.com/www/A": `[{"Payload":"192.0.2.1"}]`,
+	})
+
+	recorder := request(server, http.MethodGet, "/zones/example.com./rrsets", "")
+
+	var rrsets []*apiRRset
+	if err := json.NewDecoder(recorder.Body).Decode(&rrsets); recorder.Code != http.StatusOK || err != nil {
+		t.Fatalf("TestGetRRsets: actual status %d, error %v", recorder.Code, err)
+	}
+
+	var actual []string
+	for _, rrset := range rrsets {
+		actual = append(actual, rrset.Name+" "+rrset.Type)
+	}
+
+	if expected := []string{"example.com. SOA", "example.com. NS", "www.example.com. A"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TestGetRRsets: actual %v, expected %v", actual, expected)
+	}
+
+	if recorder := request(server, http.MethodGet, "/zones/example.org./rrsets", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("TestGetRRsets: actual status %d, expected %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestPutRRsets(t *testing.T) {
+	testCases := []struct {
+		body     string
+		status   int
+		expected []string
+	}{
+		{`[{"name":"example.com.","type":"NS","ttl":60,"records":[{"content":"ns.example.com."}]},{"name":"mail.example.com.","type":"A","ttl":60,"records":[{"content":"192.0.2.2"}]}]`, http.StatusNoContent,
+			[]string{"zones/example.com/NS", "zones/example.com/mail/A"}},
+		{`[{"name":"www.example.com.","type":"A","ttl":60,"changetype":"DELETE"}]`, http.StatusUnprocessableEntity,
+			[]string{"zones/example.com/NS", "zones/example.com/www/A"}},
+		{`[{"name":"www.example.com.","type":"A","ttl":60,"records":[{"content":"not-an-address"}]}]`, http.StatusUnprocessableEntity,
+			[]string{"zones/example.com/NS", "zones/example.com/www/A"}},
+		{`{"rrsets":[]}`, http.StatusBadRequest,
+			[]string{"zones/example.com/NS", "zones/example.com/www/A"}},
+	}
+
+	for _, tc := range testCases {
+		pairs := map[string]string{
+			"zones/example.com/NS":    `[{"Payload":"ns.example.com."}]`,
+			"zones/example.com/www/A": `[{"Payload":"192.0.2.1"}]`,
+		}
+		server := testServer(pairs)
+
+		if recorder := request(server, http.MethodPut, "/zones/example.com./rrsets", tc.body); recorder.Code != tc.status {
+			t.Errorf("TestPutRRsets(%s): actual status %d, expected %d", tc.body, recorder.Code, tc.status)
+		}
+
+		if actual := keys(pairs); !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("TestPutRRsets(%s): actual %v, expected %v", tc.body, actual, tc.expected)
+		}
+	}
+}
+
+func TestPutRRsetsTooLarge(t *testing.T) {
+	pairs := map[string]string{"zones/example.com/NS": `[{"Payload":"ns.example.com."}]`}
+	kv := store.NewMemoryStore(pairs)
+	kv.AtomicTxnFunc = func(ops []*store.TxnOp) (bool, error) {
+		return false, store.ErrTxnTooLarge
+	}
+	server := testServer(pairs)
+	server.Schemas = []schema.Schema{schema.NewFlatSchema(kv, 60)}
+
+	body := `[{"name":"example.com.","type":"NS","ttl":60,"records":[{"content":"ns2.example.com."}]}]`
+
+	if recorder := request(server, http.MethodPut, "/zones/example.com./rrsets", body); recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("TestPutRRsetsTooLarge: actual status %d, expected %d", recorder.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestPutZone(t *testing.T) {
+	server := testServer(map[string]string{"zones/example.com/NS": `[{"Payload":"ns.example.com."}]`})
+
+	testCases := []struct {
+		path     string
+		body     string
+		expected int
+	}{
+		{"/zones/example.com.", `{"kind":"Native"}`, http.StatusNoContent},
+		{"/zones/example.com.", `{"kind":"Master"}`, http.StatusUnprocessableEntity},
+		{"/zones/example.com.", `{"rrsets":[{"name":"www.example.com.","type":"A","ttl":60,"records":[{"content":"192.0.2.1"}]}]}`, http.StatusUnprocessableEntity},
+		{"/zones/example.org.", `{"kind":"Native"}`, http.StatusNotFound},
+		{"/zones/example.com./other", `{}`, http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		if recorder := request(server, http.MethodPut, tc.path, tc.body); recorder.Code != tc.expected {
+			t.Errorf("TestPutZone(%s %s): actual %d, expected %d", tc.path, tc.body, recorder.Code, tc.expected)
+		}
+	}
+}
+
+func TestUpdateSOA(t *testing.T) {
+	server := testServer(map[string]string{"zones/example.com/NS": `[{"Payload":"ns.example.com."}]`})
+	var updated []string
+	server.UpdateSOA = func(zone string, kv store.Store) error {
+		updated = append(updated, zone)
+		return nil
+	}
+
+	request(server, http.MethodGet, "/zones", "")
+	request(server, http.MethodGet, "/zones/example.com.", "")
+	request(server, http.MethodGet, "/zones/example.com./rrsets", "")
+
+	if len(updated) > 0 {
+		t.Errorf("TestUpdateSOA: actual updates %v on GET, expected none", updated)
+	}
+
+	request(server, http.MethodPatch, "/zones/example.com.", `{"rrsets":[{"name":"www.example.com.","type":"A","ttl":60,"records":[{"content":"192.0.2.1"}]}]}`)
+	request(server, http.MethodPut, "/zones/example.com./rrsets", `[{"name":"example.com.","type":"NS","ttl":60,"records":[{"content":"ns.example.com."}]}]`)
+	request(server, http.MethodPost, "/zones", `{"name":"example.org.","nameservers":["ns.example.org."]}`)
+
+	if expected := []string{"example.com", "example.com", "example.org"}; !reflect.DeepEqual(updated, expected) {
+		t.Errorf("TestUpdateSOA: actual %v, expected %v", updated, expected)
+	}
+}
@@ -0,0 +1,259 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/backend/watch"
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+// BufferSize is the number of zone changes a BufferedSink keeps while its
+// sink is busy
+const BufferSize = 1024
+
+const (
+	Created = "created"
+	Updated = "updated"
+	Deleted = "deleted"
+)
+
+// Event describes the change of the records of one name and type. Old and
+// New are the stored values, empty if the records were created or deleted.
+type Event struct {
+	Time        time.Time `json:"time"`
+	Zone        string    `json:"zone"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Action      string    `json:"action"`
+	Old         string    `json:"old,omitempty"`
+	New         string    `json:"new,omitempty"`
+	ModifyIndex uint64    `json:"modify_index"`
+}
+
+// Sink receives the events of one zone change
+type Sink interface {
+	Write(events []*Event) error
+}
+
+// Events returns an event for every record key that was created, changed
+// or removed by change, ordered by key
+func Events(change *watch.ZoneChange, now time.Time) []*Event {
+	previous := make(map[string]store.Pair, len(change.Previous))
+	for _, pair := range change.Previous {
+		previous[pair.Key()] = pair
+	}
+
+	current := make(map[string]store.Pair, len(change.Current))
+	for _, pair := range change.Current {
+		current[pair.Key()] = pair
+	}
+
+	var events []*Event
+
+	for key, pair := range current {
+		oldPair, existed := previous[key]
+
+		if existed && oldPair.LastIndex() == pair.LastIndex() {
+			continue
+		}
+
+		event := newEvent(change.Zone, key, now)
+		if event == nil {
+			continue
+		}
+
+		event.Action, event.New, event.ModifyIndex = Created, string(pair.Value()), pair.LastIndex()
+		if existed {
+			event.Action, event.Old = Updated, string(oldPair.Value())
+		}
+
+		events = append(events, event)
+	}
+
+	for key, pair := range previous {
+		if _, exists := current[key]; exists {
+			continue
+		}
+
+		if event := newEvent(change.Zone, key, now); event != nil {
+			// the store does not report the index of a delete, the change's
+			// is the closest known
+			event.Action, event.Old, event.ModifyIndex = Deleted, string(pair.Value()), change.LastIndex
+			events = append(events, event)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Name != events[j].Name {
+			return events[i].Name < events[j].Name
+		}
+		return events[i].Type < events[j].Type
+	})
+
+	return events
+}
+
+// newEvent returns an event for key, or nil if key is no record key
+func newEvent(zone string, key string, now time.Time) *Event {
+	tokens := strings.Split(key, "/")
+
+	if len(tokens) < 3 || len(tokens) > 4 || tokens[1] != zone {
+		return nil
+	}
+
+	name := zone + "."
+	if len(tokens) == 4 {
+		name = tokens[2] + "." + name
+	}
+
+	return &Event{Time: now, Zone: zone, Name: name, Type: tokens[len(tokens)-1]}
+}
+
+// NewSink returns a sink for target, which is - for JSON lines on stdout, a
+// http or https URL to post events to or the path of a file to append JSON
+// lines to
+func NewSink(target string) (Sink, error) {
+	switch {
+	case target == "-":
+		return NewWriterSink(os.Stdout), nil
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		return NewWebhookSink(target), nil
+	}
+
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open audit log %s: %v", target, err)
+	}
+
+	return NewWriterSink(file), nil
+}
+
+// WriterSink writes one JSON object per event and line
+type WriterSink struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func NewWriterSink(writer io.Writer) *WriterSink {
+	return &WriterSink{writer: writer}
+}
+
+func (sink *WriterSink) Write(events []*Event) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	encoder := json.NewEncoder(sink.writer)
+
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WebhookSink posts the events of every change as JSON array to URL
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (sink *WebhookSink) Write(events []*Event) error {
+	body, err := json.Marshal(events)
+
+	if err != nil {
+		return err
+	}
+
+	response, err := sink.Client.Post(sink.URL, "application/json", bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Webhook %s answered %s", sink.URL, response.Status)
+	}
+
+	return nil
+}
+
+// BufferedSink passes events on to its sink in the background, so a slow
+// sink such as an unreachable webhook does not hold up the zone watcher.
+// Changes are dropped once the buffer is full.
+type BufferedSink struct {
+	sink    Sink
+	mutex   sync.RWMutex
+	closed  bool
+	changes chan []*Event
+	done    chan struct{}
+}
+
+func NewBufferedSink(sink Sink, size int) *BufferedSink {
+	buffered := &BufferedSink{sink: sink, changes: make(chan []*Event, size), done: make(chan struct{})}
+	go buffered.run()
+
+	return buffered
+}
+
+// Write queues events and only fails if they had to be dropped
+func (sink *BufferedSink) Write(events []*Event) error {
+	sink.mutex.RLock()
+	defer sink.mutex.RUnlock()
+
+	if sink.closed {
+		return fmt.Errorf("Audit log is closed")
+	}
+
+	select {
+	case sink.changes <- events:
+		return nil
+	default:
+		return fmt.Errorf("Audit log could not keep up, dropped %d events", len(events))
+	}
+}
+
+// Close stops accepting events and waits up to timeout for the queued ones
+// to be written
+func (sink *BufferedSink) Close(timeout time.Duration) error {
+	sink.mutex.Lock()
+	if !sink.closed {
+		sink.closed = true
+		close(sink.changes)
+	}
+	sink.mutex.Unlock()
+
+	select {
+	case <-sink.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("Audit log still had %d changes to write", len(sink.changes))
+	}
+}
+
+func (sink *BufferedSink) run() {
+	for events := range sink.changes {
+		if err := sink.sink.Write(events); err != nil && len(events) > 0 {
+			logging.Error("Unable to write audit log", "zone", events[0].Zone, "error", err)
+		}
+	}
+
+	close(sink.done)
+}
@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/backend/watch"
+)
+
+func TestEvents(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	change := &watch.ZoneChange{
+		Zone:      "example.com",
+		LastIndex: 12,
+		Previous: []store.Pair{
+			store.NewPair("zones/example.com/A", []byte(`[{"Payload":"192.0.2.1"}]`), 5),
+			store.NewPair("zones/example.com/www/A", []byte(`[{"Payload":"192.0.2.2"}]`), 6),
+			store.NewPair("zones/example.com/old/TXT", []byte(`[{"Payload":"\"bye\""}]`), 7),
+		},
+		Current: []store.Pair{
+			store.NewPair("zones/example.com/A", []byte(`[{"Payload":"192.0.2.1"}]`), 5),
+			store.NewPair("zones/example.com/www/A", []byte(`[{"Payload":"192.0.2.3"}]`), 11),
+			store.NewPair("zones/example.com/mail/MX", []byte(`[{"Payload":"10 mx.example.com."}]`), 12),
+			store.NewPair("zones/example.com", []byte{}, 1),
+		},
+	}
+
+	actual := Events(change, now)
+	expected := []*Event{
+		{Time: now, Zone: "example.com", Name: "mail.example.com.", Type: "MX", Action: Created, New: `[{"Payload":"10 mx.example.com."}]`, ModifyIndex: 12},
+		{Time: now, Zone: "example.com", Name: "old.example.com.", Type: "TXT", Action: Deleted, Old: `[{"Payload":"\"bye\""}]`, ModifyIndex: 12},
+		{Time: now, Zone: "example.com", Name: "www.example.com.", Type: "A", Action: Updated, Old: `[{"Payload":"192.0.2.2"}]`, New: `[{"Payload":"192.0.2.3"}]`, ModifyIndex: 11},
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		actualJSON, _ := json.Marshal(actual)
+		expectedJSON, _ := json.Marshal(expected)
+		t.Errorf("TestEvents: actual %s, expected %s", actualJSON, expectedJSON)
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	var buffer bytes.Buffer
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	err := NewWriterSink(&buffer).Write([]*Event{
+		{Time: now, Zone: "example.com", Name: "example.com.", Type: "A", Action: Deleted, Old: "[]", ModifyIndex: 3},
+		{Time: now, Zone: "example.com", Name: "www.example.com.", Type: "A", Action: Created, New: "[]", ModifyIndex: 4},
+	})
+
+	expected := `{"time":"2021-01-01T00:00:00Z","zone":"example.com","name":"example.com.","type":"A","action":"deleted","old":"[]","modify_index":3}
+{"time":"2021-01-01T00:00:00Z","zone":"example.com","name":"www.example.com.","type":"A","action":"created","new":"[]","modify_index":4}
+`
+
+	if err != nil || buffer.String() != expected {
+		t.Errorf("TestWriterSink: actual %s %v, expected %s", buffer.String(), err, expected)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var received []*Event
+	status := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	events := []*Event{{Time: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), Zone: "example.com", Name: "example.com.", Type: "A", Action: Created, New: "[]", ModifyIndex: 3}}
+	sink := NewWebhookSink(server.URL)
+
+	if err := sink.Write(events); err != nil || !reflect.DeepEqual(received, events) {
+		t.Errorf("TestWebhookSink: actual %v %v, expected %v", received, err, events)
+	}
+
+	status = http.StatusInternalServerError
+
+	if err := sink.Write(events); err == nil {
+		t.Errorf("TestWebhookSink: expected an error for status %d", status)
+	}
+}
+
+// blockingSink records events once release is closed
+type blockingSink struct {
+	release chan struct{}
+	mutex   sync.Mutex
+	events  []*Event
+}
+
+func (sink *blockingSink) Write(events []*Event) error {
+	<-sink.release
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.events = append(sink.events, events...)
+	return nil
+}
+
+func TestBufferedSink(t *testing.T) {
+	upstream := &blockingSink{release: make(chan struct{})}
+	sink := NewBufferedSink(upstream, 1)
+	events := []*Event{{Zone: "example.com", Name: "example.com.", Type: "A", Action: Created}}
+
+	// the first change is taken by the writer, the second one fills the buffer
+	for sink.Write(events) != nil {
+	}
+	for len(sink.changes) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sink.Write(events)
+
+	if err := sink.Write(events); err == nil {
+		t.Errorf("TestBufferedSink: expected an error once the buffer is full")
+	}
+
+	close(upstream.release)
+
+	if err := sink.Close(time.Second); err != nil {
+		t.Errorf("TestBufferedSink: unexpected error %v", err)
+	}
+
+	if len(upstream.events) != 2 {
+		t.Errorf("TestBufferedSink: actual %d events written, expected 2", len(upstream.events))
+	}
+
+	if err := sink.Write(events); err == nil {
+		t.Errorf("TestBufferedSink: expected an error after Close")
+	}
+}
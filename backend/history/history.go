@@ -0,0 +1,351 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+const Prefix = "history"
+
+// Version is the content of a zone's keys under zones/ at one SOA serial
+type Version struct {
+	Zone   string
+	Serial uint32
+	Taken  time.Time
+	Pairs  map[string]string // value by key
+}
+
+// Change is a key whose value differs between two versions. Old or New is
+// empty if the key was created or removed.
+type Change struct {
+	Key string
+	Old string
+	New string
+}
+
+// History keeps the versions of zones
+type History interface {
+	Save(version *Version) error
+	Load(zone string, serial uint32) (*Version, error)
+	Serials(zone string) ([]uint32, error) // ascending
+	Remove(zone string, serial uint32) error
+}
+
+// New returns a history keeping versions under history/ in kv if location
+// is "store", or else in the local directory location
+func New(location string, kv store.Store) History {
+	if location == "store" {
+		return &StoreHistory{kv}
+	}
+
+	return &DirHistory{location}
+}
+
+// Take reads the current version of zone from kv
+func Take(kv store.Store, zone string, serial uint32, now time.Time) (*Version, error) {
+	version := &Version{Zone: zone, Serial: serial, Taken: now, Pairs: make(map[string]string)}
+	pairs, err := zonePairs(kv, zone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pair := range pairs {
+		version.Pairs[pair.Key()] = string(pair.Value())
+	}
+
+	return version, nil
+}
+
+// Record saves version unless its serial is known already and removes the
+// oldest versions beyond keep, if keep is positive
+func Record(history History, version *Version, keep int) error {
+	serials, err := history.Serials(version.Zone)
+
+	if err != nil {
+		return err
+	}
+
+	for _, serial := range serials {
+		if serial == version.Serial {
+			return nil
+		}
+	}
+
+	if err := history.Save(version); err != nil {
+		return err
+	}
+
+	serials = append(serials, version.Serial)
+
+	for keep > 0 && len(serials) > keep {
+		if err := history.Remove(version.Zone, serials[0]); err != nil {
+			return err
+		}
+		serials = serials[1:]
+	}
+
+	return nil
+}
+
+// Diff returns the keys changed from one version to another, ordered by key
+func Diff(from *Version, to *Version) []*Change {
+	var changes []*Change
+
+	for key, value := range to.Pairs {
+		if old, ok := from.Pairs[key]; !ok || old != value {
+			changes = append(changes, &Change{Key: key, Old: old, New: value})
+		}
+	}
+
+	for key, value := range from.Pairs {
+		if _, ok := to.Pairs[key]; !ok {
+			changes = append(changes, &Change{Key: key, Old: value})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+
+	return changes
+}
+
+// Restore writes version back to kv in one transaction, removing keys
+// created since. It returns schema.ErrConflict if the zone changes in the
+// meantime.
+func Restore(kv store.Store, version *Version) error {
+	pairs, err := zonePairs(kv, version.Zone)
+
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]store.Pair, len(pairs))
+	for _, pair := range pairs {
+		current[pair.Key()] = pair
+	}
+
+	keys := make([]string, 0, len(version.Pairs))
+	for key := range version.Pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var ops []*store.TxnOp
+
+	for _, key := range keys {
+		previous := current[key]
+
+		if previous == nil || string(previous.Value()) != version.Pairs[key] {
+			ops = append(ops, &store.TxnOp{Key: key, Value: []byte(version.Pairs[key]), Previous: previous})
+		}
+	}
+
+	for _, pair := range pairs {
+		if _, ok := version.Pairs[pair.Key()]; !ok {
+			ops = append(ops, &store.TxnOp{Key: pair.Key(), Delete: true, Previous: pair})
+		}
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	ok, err := kv.AtomicTxn(ops)
+
+	if err == nil && !ok {
+		err = schema.ErrConflict
+	}
+
+	return err
+}
+
+func zonePairs(kv store.Store, zone string) ([]store.Pair, error) {
+	pairs, err := kv.List(fmt.Sprintf("zones/%s", zone))
+
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var result []store.Pair
+
+	for _, pair := range pairs {
+		tokens := strings.Split(pair.Key(), "/")
+
+		if len(tokens) < 3 || tokens[1] != zone {
+			continue
+		}
+
+		result = append(result, pair)
+	}
+
+	return result, nil
+}
+
+// StoreHistory keeps versions as JSON at history/<zone>/<serial>
+type StoreHistory struct {
+	kv store.Store
+}
+
+func (h *StoreHistory) Save(version *Version) error {
+	contents, err := json.Marshal(version)
+
+	if err != nil {
+		return err
+	}
+
+	return h.kv.Put(fmt.Sprintf("%s/%s/%d", Prefix, version.Zone, version.Serial), contents, nil)
+}
+
+func (h *StoreHistory) Load(zone string, serial uint32) (*Version, error) {
+	pair, err := h.kv.Get(fmt.Sprintf("%s/%s/%d", Prefix, zone, serial))
+
+	if err == store.ErrKeyNotFound {
+		return nil, fmt.Errorf("Zone %s has no version with serial %d", zone, serial)
+	} else if err != nil {
+		return nil, err
+	}
+
+	version := &Version{}
+	return version, json.Unmarshal(pair.Value(), version)
+}
+
+func (h *StoreHistory) Serials(zone string) ([]uint32, error) {
+	pairs, err := h.kv.List(fmt.Sprintf("%s/%s", Prefix, zone))
+
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, pair := range pairs {
+		if tokens := strings.Split(pair.Key(), "/"); len(tokens) == 3 && tokens[1] == zone {
+			names = append(names, tokens[2])
+		}
+	}
+
+	return parseSerials(names), nil
+}
+
+func (h *StoreHistory) Remove(zone string, serial uint32) error {
+	key := fmt.Sprintf("%s/%s/%d", Prefix, zone, serial)
+	pair, err := h.kv.Get(key)
+
+	if err == store.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = h.kv.AtomicDelete(key, pair)
+	return err
+}
+
+// DirHistory keeps versions as JSON files at <path>/<zone>/<serial>.json
+type DirHistory struct {
+	path string
+}
+
+func (h *DirHistory) Save(version *Version) error {
+	dir := filepath.Join(h.path, version.Zone)
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(version)
+
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(dir, "version")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(contents)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filepath.Join(dir, fmt.Sprintf("%d.json", version.Serial)))
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+
+	return err
+}
+
+func (h *DirHistory) Load(zone string, serial uint32) (*Version, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(h.path, zone, fmt.Sprintf("%d.json", serial)))
+
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Zone %s has no version with serial %d", zone, serial)
+	} else if err != nil {
+		return nil, err
+	}
+
+	version := &Version{}
+	return version, json.Unmarshal(contents, version)
+}
+
+func (h *DirHistory) Serials(zone string) ([]uint32, error) {
+	files, err := ioutil.ReadDir(filepath.Join(h.path, zone))
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+
+	return parseSerials(names), nil
+}
+
+func (h *DirHistory) Remove(zone string, serial uint32) error {
+	err := os.Remove(filepath.Join(h.path, zone, fmt.Sprintf("%d.json", serial)))
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// parseSerials returns the serials in names in ascending order, ignoring
+// other names
+func parseSerials(names []string) []uint32 {
+	var serials []uint32
+
+	for _, name := range names {
+		if serial, err := strconv.ParseUint(name, 10, 32); err == nil {
+			serials = append(serials, uint32(serial))
+		}
+	}
+
+	sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+
+	return serials
+}
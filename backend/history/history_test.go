@@ -0,0 +1,111 @@
+package history
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+func TestTake(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	kv := store.NewMemoryStore(map[string]string{
+		"zones/example.com/A":     `[{"Payload":"192.0.2.1"}]`,
+		"zones/example.com/www/A": `[{"Payload":"192.0.2.2"}]`,
+		"zones/example.com.au/A":  `[{"Payload":"192.0.2.3"}]`,
+		"soa/example.com":         `{}`,
+	})
+
+	actual, err := Take(kv, "example.com", 5, now)
+	expected := &Version{Zone: "example.com", Serial: 5, Taken: now, Pairs: map[string]string{
+		"zones/example.com/A":     `[{"Payload":"192.0.2.1"}]`,
+		"zones/example.com/www/A": `[{"Payload":"192.0.2.2"}]`,
+	}}
+
+	if err != nil || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TestTake: actual %v %v, expected %v", actual, err, expected)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	histories := map[string]History{
+		"store": New("store", store.NewMemoryStore(map[string]string{})),
+		"dir":   New(t.TempDir(), nil),
+	}
+
+	for name, history := range histories {
+		for _, serial := range []uint32{3, 1, 2, 2, 4} {
+			version := &Version{Zone: "example.com", Serial: serial, Pairs: map[string]string{"zones/example.com/A": "[]"}}
+
+			if err := Record(history, version, 3); err != nil {
+				t.Errorf("TestRecord(%s): unexpected error %v", name, err)
+			}
+		}
+
+		if err := Record(history, &Version{Zone: "example.org", Serial: 10}, 3); err != nil {
+			t.Errorf("TestRecord(%s): unexpected error %v", name, err)
+		}
+
+		serials, err := history.Serials("example.com")
+
+		if expected := []uint32{2, 3, 4}; err != nil || !reflect.DeepEqual(serials, expected) {
+			t.Errorf("TestRecord(%s): actual %v %v, expected %v", name, serials, err, expected)
+		}
+
+		version, err := history.Load("example.com", 4)
+
+		if err != nil || version.Serial != 4 || version.Pairs["zones/example.com/A"] != "[]" {
+			t.Errorf("TestRecord(%s): actual %v %v, expected version 4", name, version, err)
+		}
+
+		if _, err := history.Load("example.com", 1); err == nil {
+			t.Errorf("TestRecord(%s): expected an error loading a removed version", name)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	from := &Version{Pairs: map[string]string{"a": "1", "b": "2", "c": "3"}}
+	to := &Version{Pairs: map[string]string{"a": "1", "b": "4", "d": "5"}}
+
+	actual := Diff(from, to)
+	expected := []*Change{{Key: "b", Old: "2", New: "4"}, {Key: "c", Old: "3"}, {Key: "d", New: "5"}}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TestDiff: actual %v, expected %v", actual, expected)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	pairs := map[string]string{
+		"zones/example.com/A":     `[{"Payload":"192.0.2.9"}]`,
+		"zones/example.com/new/A": `[{"Payload":"192.0.2.10"}]`,
+		"zones/example.org/A":     `[{"Payload":"192.0.2.1"}]`,
+	}
+	version := &Version{Zone: "example.com", Serial: 1, Pairs: map[string]string{
+		"zones/example.com/A":     `[{"Payload":"192.0.2.1"}]`,
+		"zones/example.com/www/A": `[{"Payload":"192.0.2.2"}]`,
+	}}
+
+	err := Restore(store.NewMemoryStore(pairs), version)
+	expected := map[string]string{
+		"zones/example.com/A":     `[{"Payload":"192.0.2.1"}]`,
+		"zones/example.com/www/A": `[{"Payload":"192.0.2.2"}]`,
+		"zones/example.org/A":     `[{"Payload":"192.0.2.1"}]`,
+	}
+
+	if err != nil || !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("TestRestore: actual %v %v, expected %v", pairs, err, expected)
+	}
+
+	kv := store.NewMemoryStore(map[string]string{"zones/example.com/A": "[]"})
+	kv.AtomicPutFunc = func(key string, value []byte, previous store.Pair, options *store.WriteOptions) (bool, store.Pair, error) {
+		return false, nil, nil
+	}
+
+	if err := Restore(kv, version); err != schema.ErrConflict {
+		t.Errorf("TestRestore: actual %v, expected %v", err, schema.ErrConflict)
+	}
+}
@@ -0,0 +1,200 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/backend/template"
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+var ErrConflict = errors.New("Record was modified concurrently")
+
+// RRset is the set of records of one name and type. TTL applies to all of
+// its records.
+type RRset struct {
+	Name     string // fully qualified, i.e. www.example.com.
+	Type     string
+	TTL      uint32
+	Payloads []string
+}
+
+// Validate checks that rrset belongs to zone and that its payloads can be
+// answered. Payloads with variables or references are checked when resolved.
+func (rrset *RRset) Validate(zone string) error {
+	if _, ok := relativeName(zone, rrset.Name); !ok {
+		return fmt.Errorf("%s is not in zone %s", rrset.Name, zone)
+	}
+
+	if _, known := dns.StringToType[rrset.Type]; !known && rrset.Type != "ALIAS" {
+		return fmt.Errorf("Unknown record type %s", rrset.Type)
+	}
+
+	if rrset.Type == "SOA" {
+		return fmt.Errorf("SOA records are generated and cannot be changed")
+	}
+
+	if rrset.Type == "CNAME" && len(rrset.Payloads) > 1 {
+		return fmt.Errorf("%s can only have one CNAME record", rrset.Name)
+	}
+
+	for _, payload := range rrset.Payloads {
+		if template.IsTemplate(payload) {
+			continue
+		}
+
+		if rrset.Type == "ALIAS" {
+			if _, ok := dns.IsDomainName(payload); !ok {
+				return fmt.Errorf("Invalid ALIAS record for %s: %q is not a domain name", rrset.Name, payload)
+			}
+			continue
+		}
+
+		if _, err := dns.NewRR(fmt.Sprintf("%s 0 IN %s %s", rrset.Name, rrset.Type, payload)); err != nil {
+			return fmt.Errorf("Invalid %s record for %s: %v", rrset.Type, rrset.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Editor is implemented by schemas whose zones can be changed record by
+// record, i.e. by the HTTP API
+type Editor interface {
+	// RRsets returns the records of zone as stored, without expanding
+	// variables or generating the SOA
+	RRsets(zone string) ([]*RRset, error)
+	// ReplaceRRsets replaces the records of the name and type of every
+	// rrset in one transaction, RRsets without payloads are deleted. It
+	// returns ErrConflict if the records were changed in the meantime.
+	ReplaceRRsets(zone string, rrsets []*RRset) error
+	DeleteZone(zone string) error
+}
+
+func (flat *FlatSchema) RRsets(zone string) ([]*RRset, error) {
+	pairs, err := flat.store.List(fmt.Sprintf("zones/%s", zone))
+
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var rrsets []*RRset
+
+	for _, pair := range pairs {
+		tokens := strings.Split(pair.Key(), "/")
+
+		if len(tokens) < 3 || len(tokens) > 4 || tokens[1] != zone {
+			continue
+		}
+
+		name := zone + "."
+		if len(tokens) == 4 {
+			name = tokens[2] + "." + name
+		}
+
+		values := make([]value, 0)
+		if err := json.Unmarshal(pair.Value(), &values); err != nil {
+			logging.Warn("Discarding key", "key", pair.Key(), "error", err)
+			continue
+		}
+
+		rrset := &RRset{Name: name, Type: tokens[len(tokens)-1], TTL: flat.defaultTTL}
+
+		for i, value := range values {
+			if i == 0 && value.TTL != nil {
+				rrset.TTL = *value.TTL
+			}
+
+			if value.Payload != nil {
+				rrset.Payloads = append(rrset.Payloads, *value.Payload)
+			}
+		}
+
+		rrsets = append(rrsets, rrset)
+	}
+
+	sort.Slice(rrsets, func(i, j int) bool {
+		if rrsets[i].Name != rrsets[j].Name {
+			return rrsets[i].Name < rrsets[j].Name
+		}
+		return rrsets[i].Type < rrsets[j].Type
+	})
+
+	return rrsets, nil
+}
+
+func (flat *FlatSchema) ReplaceRRsets(zone string, rrsets []*RRset) error {
+	var sets []*rrset
+
+	for _, rrset := range rrsets {
+		label, ok := relativeName(zone, rrset.Name)
+
+		if !ok {
+			return fmt.Errorf("%s is not in zone %s", rrset.Name, zone)
+		}
+
+		set, err := flat.loadRRset(recordKey(zone, label, rrset.Type), rrset.Name, rrset.Type)
+
+		if err != nil {
+			return err
+		}
+
+		set.values = nil
+		for i := range rrset.Payloads {
+			ttl, payload := rrset.TTL, rrset.Payloads[i]
+			set.values = append(set.values, value{TTL: &ttl, Payload: &payload})
+		}
+
+		sets = append(sets, set)
+	}
+
+	return flat.writeRRsets(sets)
+}
+
+func (flat *FlatSchema) DeleteZone(zone string) error {
+	pairs, err := flat.store.List(fmt.Sprintf("zones/%s", zone))
+
+	if err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+
+	soaPair, err := flat.store.Get(fmt.Sprintf("soa/%s", zone))
+
+	if err == nil {
+		pairs = append(pairs, soaPair)
+	} else if err != store.ErrKeyNotFound {
+		return err
+	}
+
+	var ops []*store.TxnOp
+
+	for _, pair := range pairs {
+		tokens := strings.Split(pair.Key(), "/")
+
+		if len(tokens) < 2 || tokens[1] != zone {
+			continue
+		}
+
+		ops = append(ops, &store.TxnOp{Key: pair.Key(), Delete: true, Previous: pair})
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	ok, err := flat.store.AtomicTxn(ops)
+
+	if err == nil && !ok {
+		err = ErrConflict
+	}
+
+	return err
+}
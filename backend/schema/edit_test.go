@@ -0,0 +1,109 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+func TestRRsets(t *testing.T) {
+	pairs := initialPairs()
+	pairs["zones/example.com/broken/A"] = "invalid_json"
+	pairs["zones/example.com.au/A"] = `[{"Payload":"192.0.2.99"}]`
+
+	actual, err := (&FlatSchema{store.NewMemoryStore(pairs), 3600}).RRsets("example.com")
+	expected := []*RRset{
+		{Name: "example.com.", Type: "A", TTL: 3600, Payloads: []string{"192.0.2.1"}},
+		{Name: "example.com.", Type: "NS", TTL: 3600, Payloads: []string{"ns.example.com."}},
+		{Name: "host.example.com.", Type: "A", TTL: 60, Payloads: []string{"192.0.2.10", "192.0.2.11"}},
+		{Name: "host.example.com.", Type: "TXT", TTL: 3600, Payloads: []string{"\"hello\""}},
+	}
+
+	if err != nil || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TestRRsets: actual %v %v, expected %v", actual, err, expected)
+	}
+}
+
+func TestRRsetValidate(t *testing.T) {
+	testCases := []struct {
+		rrset *RRset
+		valid bool
+	}{
+		{&RRset{Name: "www.example.com.", Type: "A", Payloads: []string{"192.0.2.1", "192.0.2.2"}}, true},
+		{&RRset{Name: "www.example.com.", Type: "A", Payloads: []string{"192.0.2.300"}}, false},
+		{&RRset{Name: "www.example.org.", Type: "A", Payloads: []string{"192.0.2.1"}}, false},
+		{&RRset{Name: "example.com.", Type: "MX", Payloads: []string{"10 mail.example.com."}}, true},
+		{&RRset{Name: "example.com.", Type: "MX", Payloads: []string{"mail.example.com."}}, false},
+		{&RRset{Name: "example.com.", Type: "SOA", Payloads: []string{"ns. host. 1 2 3 4 5"}}, false},
+		{&RRset{Name: "example.com.", Type: "BOGUS", Payloads: []string{"x"}}, false},
+		{&RRset{Name: "www.example.com.", Type: "CNAME", Payloads: []string{"a.example.net.", "b.example.net."}}, false},
+		{&RRset{Name: "example.com.", Type: "ALIAS", Payloads: []string{"lb.example.net."}}, true},
+		{&RRset{Name: "www.example.com.", Type: "A", Payloads: []string{`{{ var "web_ip" }}`}}, true},
+		{&RRset{Name: "www.example.com.", Type: "A"}, true},
+	}
+
+	for _, tc := range testCases {
+		if err := tc.rrset.Validate("example.com"); (err == nil) != tc.valid {
+			t.Errorf("TestRRsetValidate(%v): actual %v, expected valid %v", tc.rrset, err, tc.valid)
+		}
+	}
+}
+
+func TestReplaceRRsets(t *testing.T) {
+	pairs := initialPairs()
+	flat := &FlatSchema{store.NewMemoryStore(pairs), 3600}
+
+	err := flat.ReplaceRRsets("example.com", []*RRset{{Name: "HOST.example.com.", Type: "A", TTL: 300, Payloads: []string{"192.0.2.20"}}})
+
+	if expected := `[{"TTL":300,"Payload":"192.0.2.20"}]`; err != nil || pairs["zones/example.com/host/A"] != expected {
+		t.Errorf("TestReplaceRRsets: actual %s %v, expected %s", pairs["zones/example.com/host/A"], err, expected)
+	}
+
+	err = flat.ReplaceRRsets("example.com", []*RRset{{Name: "host.example.com.", Type: "TXT"}})
+
+	if _, exists := pairs["zones/example.com/host/TXT"]; err != nil || exists {
+		t.Errorf("TestReplaceRRsets: actual %v, expected TXT record to be deleted", err)
+	}
+
+	if err = flat.ReplaceRRsets("example.com", []*RRset{{Name: "host.example.org.", Type: "A", Payloads: []string{"192.0.2.1"}}}); err == nil {
+		t.Errorf("TestReplaceRRsets: expected an error for a name outside of the zone")
+	}
+
+	kv := store.NewMemoryStore(initialPairs())
+	kv.AtomicPutFunc = func(key string, value []byte, previous store.Pair, options *store.WriteOptions) (bool, store.Pair, error) {
+		return false, nil, nil
+	}
+
+	if err = (&FlatSchema{kv, 3600}).ReplaceRRsets("example.com", []*RRset{{Name: "example.com.", Type: "A", Payloads: []string{"192.0.2.1"}}}); err != ErrConflict {
+		t.Errorf("TestReplaceRRsets: actual %v, expected %v", err, ErrConflict)
+	}
+
+	var txns [][]*store.TxnOp
+	kv = store.NewMemoryStore(initialPairs())
+	kv.AtomicTxnFunc = func(ops []*store.TxnOp) (bool, error) {
+		txns = append(txns, ops)
+		return true, nil
+	}
+
+	err = (&FlatSchema{kv, 3600}).ReplaceRRsets("example.com", []*RRset{
+		{Name: "www.example.com.", Type: "A", Payloads: []string{"192.0.2.1"}},
+		{Name: "host.example.com.", Type: "TXT"},
+	})
+
+	if err != nil || len(txns) != 1 || len(txns[0]) != 2 || txns[0][0].Previous != nil || !txns[0][1].Delete {
+		t.Errorf("TestReplaceRRsets: actual %v %v, expected one transaction creating www and deleting host", txns, err)
+	}
+}
+
+func TestDeleteZone(t *testing.T) {
+	pairs := initialPairs()
+	pairs["zones/example.com.au/A"] = `[{"Payload":"192.0.2.99"}]`
+	pairs["soa/example.com"] = `{"SnModifyIndex":1,"Sn":2016050400}`
+
+	err := (&FlatSchema{store.NewMemoryStore(pairs), 3600}).DeleteZone("example.com")
+
+	if expected := []string{`zones/example.com.au/A=[{"Payload":"192.0.2.99"}]`}; err != nil || !reflect.DeepEqual(keys(pairs), expected) {
+		t.Errorf("TestDeleteZone: actual %v %v, expected %v", keys(pairs), err, expected)
+	}
+}
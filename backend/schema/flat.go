@@ -3,10 +3,11 @@ package schema
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"strings"
 
 	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/backend/template"
+	"github.com/Shark/powerdns-consul/logging"
 )
 
 type FlatSchema struct {
@@ -18,30 +19,119 @@ func NewFlatSchema(store store.Store, defaultTTL uint32) Schema {
 	return &FlatSchema{store, defaultTTL}
 }
 
-func (flat *FlatSchema) Resolve(query *store.Query) (entries []*store.Entry, err error) {
-	zones, err := flat.allZones(flat.store)
+// Resolve only reads the keys of the queried name, of the names above it for
+// zone cuts and, for names without records, of zone
+func (flat *FlatSchema) Resolve(zone string, query *store.Query) (*Result, error) {
+	zone, remainder := flat.findZone([]string{zone}, query.Name)
+
+	if zone == "" {
+		return &Result{}, nil
+	}
+
+	cut, err := flat.findZoneCut(flat.store, zone, remainder)
 
 	if err != nil {
 		return nil, err
 	}
 
-	zone, remainder := flat.findZone(zones, query.Name)
+	// the DS records of a delegation are served by the parent zone
+	if cut != "" && !(cut == remainder && query.Type == "DS") {
+		return flat.referral(flat.store, zone, remainder, cut, query.Type)
+	}
+
+	pairs, err := flat.findKVPairsForZone(flat.store, zone, remainder)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if zone == "" {
-		return make([]*store.Entry, 0), nil
+	nameExists := len(pairs) > 0
+
+	if !nameExists {
+		nameExists, err = flat.nameExists(flat.store, zone, remainder)
+
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	entries, err = flat.findZoneEntries(flat.store, zone, remainder, query.Type, flat.defaultTTL)
+	entries := flat.entriesFromPairs(pairs, query.Type, flat.defaultTTL)
+
+	return &Result{Entries: entries, Zone: zone, NameExists: nameExists}, nil
+}
+
+// findZoneCut returns the remainder of the topmost name at or above
+// remainder that has NS records in zone, i.e. where zone delegates to
+// another zone. The apex is never a cut.
+func (flat *FlatSchema) findZoneCut(kv store.Store, zone string, remainder string) (string, error) {
+	if remainder == "" {
+		return "", nil
+	}
+
+	labels := strings.Split(remainder, ".")
+
+	for i := len(labels) - 1; i >= 0; i-- {
+		name := strings.Join(labels[i:], ".")
+		_, err := kv.Get(fmt.Sprintf("zones/%s/%s/NS", zone, name))
+
+		if err == nil {
+			return name, nil
+		} else if err != store.ErrKeyNotFound {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// referral answers a query for remainder at or below the zone cut with the
+// cut's NS records and the A and AAAA records of name servers inside zone as
+// glue. At the cut itself the records of the queried type are returned as
+// well, since PowerDNS looks the NS records up itself.
+func (flat *FlatSchema) referral(kv store.Store, zone string, remainder string, cut string, queryType string) (*Result, error) {
+	cutPairs, err := flat.findKVPairsForZone(kv, zone, cut)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return entries, nil
+	result := &Result{
+		Zone:       zone,
+		NameExists: true,
+		Authority:  flat.entriesFromPairs(cutPairs, "NS", flat.defaultTTL),
+		Delegation: fmt.Sprintf("%s.%s", cut, zone),
+		Additional: make(map[string][]*store.Entry),
+	}
+
+	if remainder == cut {
+		result.Entries = flat.entriesFromPairs(cutPairs, queryType, flat.defaultTTL)
+	}
+
+	for _, ns := range result.Authority {
+		name := strings.ToLower(strings.TrimSuffix(ns.Payload, "."))
+
+		if name != zone && !strings.HasSuffix(name, "."+zone) {
+			continue // out of zone, no glue needed
+		}
+
+		pairs, err := flat.findKVPairsForZone(kv, zone, strings.TrimSuffix(strings.TrimSuffix(name, zone), "."))
+
+		if err != nil {
+			return nil, err
+		}
+
+		glue := append(flat.entriesFromPairs(pairs, "A", flat.defaultTTL), flat.entriesFromPairs(pairs, "AAAA", flat.defaultTTL)...)
+
+		if len(glue) > 0 {
+			result.Additional[name] = glue
+		}
+	}
+
+	return result, nil
+}
+
+func (flat *FlatSchema) Zones() ([]string, error) {
+	return flat.allZones(flat.store)
 }
 
 func (flat *FlatSchema) HasZone(zone string) (bool, error) {
@@ -64,21 +154,36 @@ func (flat *FlatSchema) Store() store.Store {
 }
 
 type value struct {
-	TTL     *uint32
+	TTL     *uint32 `json:",omitempty"`
 	Payload *string
 }
 
 func (flat *FlatSchema) allZones(kv store.Store) (zones []string, err error) {
-	// backends behavior is inconsistent:
-	// say a key exists at zones/example.invalid/A
-	// - consul will return a pair with key zones/example.invalid/A
-	// - etcd will return a pair with key zones/example.invalid
-	pairs, err := kv.List("zones")
+	pairs, err := flat.listZones(kv)
 
 	if err != nil {
 		return nil, err
 	}
 
+	return flat.zonesOfPairs(pairs), nil
+}
+
+// listZones returns the pairs of all zones
+func (flat *FlatSchema) listZones(kv store.Store) ([]store.Pair, error) {
+	pairs, err := kv.List("zones")
+
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	}
+
+	return pairs, err
+}
+
+func (flat *FlatSchema) zonesOfPairs(pairs []store.Pair) (zones []string) {
+	// backends behavior is inconsistent:
+	// say a key exists at zones/example.invalid/A
+	// - consul will return a pair with key zones/example.invalid/A
+	// - etcd will return a pair with key zones/example.invalid
 	var zonesMap = make(map[string]bool)
 
 	for _, pair := range pairs {
@@ -98,7 +203,7 @@ func (flat *FlatSchema) allZones(kv store.Store) (zones []string, err error) {
 		i++
 	}
 
-	return zones, nil
+	return zones
 }
 
 func (flat *FlatSchema) findZone(zones []string, name string) (zone string, remainder string) {
@@ -114,41 +219,27 @@ func (flat *FlatSchema) findZone(zones []string, name string) (zone string, rema
 		tokens = tokens[:len(tokens)-1]
 	}
 
-	start := len(tokens) - 2
-	for start >= 0 {
-		length_of_zone := len(tokens) - start
-		current_zone_slice := make([]string, length_of_zone)
-		j := 0
-		for j < length_of_zone {
-			current_zone_slice[j] = tokens[start+j]
-			j++
-		}
-		start--
-
-		current_zone := strings.Join(current_zone_slice, ".")
+	// try the longest suffix first, so nested zones win over their parents
+	for start := 0; start <= len(tokens)-2; start++ {
+		current_zone := strings.Join(tokens[start:], ".")
 
 		for _, existing_zone := range zones {
-			if current_zone == existing_zone {
-				zone = existing_zone
-
-				length_of_remainder := len(tokens) - length_of_zone
-				if length_of_remainder > 0 {
-					remainder_slice := tokens[0:length_of_remainder]
-					var nonEmptyRemainderTokens []string
-					for _, remainderToken := range remainder_slice {
-						if remainderToken != "" {
-							nonEmptyRemainderTokens = append(nonEmptyRemainderTokens, remainderToken)
-						}
-					}
-					remainder = strings.Join(nonEmptyRemainderTokens, ".")
-				} else {
-					remainder = ""
+			if current_zone != existing_zone {
+				continue
+			}
+
+			var nonEmptyRemainderTokens []string
+			for _, remainderToken := range tokens[:start] {
+				if remainderToken != "" {
+					nonEmptyRemainderTokens = append(nonEmptyRemainderTokens, remainderToken)
 				}
 			}
+
+			return existing_zone, strings.Join(nonEmptyRemainderTokens, ".")
 		}
 	}
 
-	return zone, remainder
+	return "", ""
 }
 
 func (flat *FlatSchema) findKVPairsForZone(kv store.Store, zone string, remainder string) ([]store.Pair, error) {
@@ -167,11 +258,53 @@ func (flat *FlatSchema) findKVPairsForZone(kv store.Store, zone string, remainde
 
 	unfilteredPairs, err := kv.List(prefix)
 
-	if err != nil {
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
 
-	return flat.filterKVPairs(unfilteredPairs, numSegments), nil
+	var pairs []store.Pair
+
+	for _, pair := range flat.filterKVPairs(unfilteredPairs, numSegments) {
+		// some backends list by raw key prefix, so zones/example.com/sub
+		// would also return the keys of zones/example.com/sub2
+		if strings.HasPrefix(pair.Key(), prefix+"/") {
+			pairs = append(pairs, pair)
+		}
+	}
+
+	return pairs, nil
+}
+
+// nameExists tells if remainder has records in zone or is an empty
+// non-terminal, i.e. only names below it have records. The apex always exists.
+func (flat *FlatSchema) nameExists(kv store.Store, zone string, remainder string) (bool, error) {
+	if remainder == "" {
+		return true, nil
+	}
+
+	pairs, err := kv.List(fmt.Sprintf("zones/%s", zone))
+
+	if err == store.ErrKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	for _, pair := range pairs {
+		tokens := strings.Split(pair.Key(), "/")
+
+		if len(tokens) < 3 || tokens[1] != zone {
+			continue
+		}
+
+		if tokens[2] == remainder || strings.HasSuffix(tokens[2], "."+remainder) {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
 func (flat *FlatSchema) findZoneEntries(kv store.Store, zone string, remainder string, filter_entry_type string, defaultTTL uint32) (entries []*store.Entry, err error) {
@@ -181,16 +314,20 @@ func (flat *FlatSchema) findZoneEntries(kv store.Store, zone string, remainder s
 		return nil, err
 	}
 
+	return flat.entriesFromPairs(pairs, filter_entry_type, defaultTTL), nil
+}
+
+func (flat *FlatSchema) entriesFromPairs(pairs []store.Pair, filter_entry_type string, defaultTTL uint32) (entries []*store.Entry) {
 	for _, pair := range pairs {
 		entry_type_tokens := strings.Split(pair.Key(), "/")
 		entry_type := entry_type_tokens[len(entry_type_tokens)-1]
 
 		if filter_entry_type == "ANY" || entry_type == filter_entry_type {
 			values_in_entry := make([]value, 0)
-			err = json.Unmarshal(pair.Value(), &values_in_entry)
+			err := json.Unmarshal(pair.Value(), &values_in_entry)
 
 			if err != nil {
-				log.Printf("Discarding key %s: %v", pair.Key(), err)
+				logging.Warn("Discarding key", "key", pair.Key(), "error", err)
 				continue
 			}
 
@@ -203,17 +340,32 @@ func (flat *FlatSchema) findZoneEntries(kv store.Store, zone string, remainder s
 				}
 
 				if value.Payload == nil {
-					log.Printf("Discarding entry in key %s because payload is missing", pair.Key())
+					logging.Warn("Discarding entry without payload", "key", pair.Key())
 					continue
 				}
 
-				entry := &store.Entry{entry_type, ttl, *value.Payload}
-				entries = append(entries, entry)
+				payloads := []string{*value.Payload}
+
+				if template.IsTemplate(*value.Payload) {
+					expanded, _, err := template.NewExpander(flat.store).Expand(*value.Payload)
+
+					if err != nil {
+						logging.Warn("Discarding entry", "key", pair.Key(), "error", err)
+						continue
+					}
+
+					payloads = expanded
+				}
+
+				for _, payload := range payloads {
+					entry := &store.Entry{Type: entry_type, Ttl: ttl, Payload: payload}
+					entries = append(entries, entry)
+				}
 			}
 		}
 	}
 
-	return entries, nil
+	return entries
 }
 
 func (flat *FlatSchema) filterKVPairs(pairs []store.Pair, numSegments int) []store.Pair {
@@ -3,6 +3,7 @@ package schema
 import (
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/Shark/powerdns-consul/backend/store"
@@ -54,6 +55,9 @@ var findZoneTests = []struct {
 	{[]string{"öäaö.abc"}, "öäaö.abc", "öäaö.abc", ""},
 	{[]string{}, "öäaö.abc", "", ""},
 	{[]string{"one.com"}, "SoME.oNe.CoM", "one.com", "some"},
+	{[]string{"one.com", "sub.one.com"}, "two.sub.one.com", "sub.one.com", "two"},
+	{[]string{"sub.one.com", "one.com"}, "two.sub.one.com", "sub.one.com", "two"},
+	{[]string{"sub.one.com", "one.com"}, "two.one.com", "one.com", "two"},
 }
 
 func TestFindZone(t *testing.T) {
@@ -145,10 +149,10 @@ var findZoneEntriesTests = []struct {
 		"ANY",
 		60,
 		[]*store.Entry{
-			&store.Entry{"A", 60, "Value"},
-			&store.Entry{"TXT", 3600, "SomeOtherValue"},
-			&store.Entry{"MX", 60, "10\tmx1.example.com"},
-			&store.Entry{"MX", 60, "20\tmx2.example.com"},
+			&store.Entry{Type: "A", Ttl: 60, Payload: "Value"},
+			&store.Entry{Type: "TXT", Ttl: 3600, Payload: "SomeOtherValue"},
+			&store.Entry{Type: "MX", Ttl: 60, Payload: "10\tmx1.example.com"},
+			&store.Entry{Type: "MX", Ttl: 60, Payload: "20\tmx2.example.com"},
 		},
 	},
 	{
@@ -166,10 +170,10 @@ var findZoneEntriesTests = []struct {
 		"ANY",
 		60,
 		[]*store.Entry{
-			&store.Entry{"A", 60, "Value"},
-			&store.Entry{"TXT", 3600, "SomeOtherValue"},
-			&store.Entry{"MX", 60, "10\tmx1.example.com"},
-			&store.Entry{"MX", 60, "20\tmx2.example.com"},
+			&store.Entry{Type: "A", Ttl: 60, Payload: "Value"},
+			&store.Entry{Type: "TXT", Ttl: 3600, Payload: "SomeOtherValue"},
+			&store.Entry{Type: "MX", Ttl: 60, Payload: "10\tmx1.example.com"},
+			&store.Entry{Type: "MX", Ttl: 60, Payload: "20\tmx2.example.com"},
 		},
 	},
 	{
@@ -210,6 +214,145 @@ func TestFindZoneEntries(t *testing.T) {
 	}
 }
 
+var resolveTests = []struct {
+	name               string
+	qtype              string
+	expectedZone       string
+	expectedNameExists bool
+	expectedEntries    int
+	expectedDelegation string
+}{
+	{"example.com", "A", "example.com", true, 1, ""},
+	{"example.com", "AAAA", "example.com", true, 0, ""},
+	{"sub.example.com", "A", "example.com", true, 1, ""},
+	{"sub.example.com", "TXT", "example.com", true, 0, ""},
+	{"ent.example.com", "A", "example.com", true, 0, ""},
+	{"su.example.com", "A", "example.com", false, 0, ""},
+	{"nothing.example.com", "A", "example.com", false, 0, ""},
+	{"example.org", "A", "", false, 0, ""},
+	{"dev.example.com", "NS", "example.com", true, 2, "dev.example.com"},
+	{"dev.example.com", "DS", "example.com", true, 1, ""},
+	{"host.dev.example.com", "A", "example.com", true, 0, "dev.example.com"},
+	{"a.b.dev.example.com", "A", "example.com", true, 0, "dev.example.com"},
+	{"host.sub.dev.example.com", "A", "example.com", true, 0, "dev.example.com"},
+	{"host.undev.example.com", "A", "example.com", false, 0, ""},
+	{"lb.example.com", "A", "example.com", true, 2, ""},
+	{"broken.example.com", "A", "example.com", true, 0, ""},
+}
+
+var resolvePairs = []store.Pair{
+	store.NewPair("zones/example.com/A", []byte("[{\"Payload\":\"127.0.0.1\"}]"), 0),
+	store.NewPair("zones/example.com/sub/A", []byte("[{\"Payload\":\"127.0.0.2\"}]"), 0),
+	store.NewPair("zones/example.com/sub2/A", []byte("[{\"Payload\":\"127.0.0.3\"}]"), 0),
+	store.NewPair("zones/example.com/www.ent/A", []byte("[{\"Payload\":\"127.0.0.4\"}]"), 0),
+	store.NewPair("zones/example.com/dev/NS", []byte("[{\"Payload\":\"ns1.dev.example.com.\"},{\"Payload\":\"ns.example.net.\"}]"), 0),
+	store.NewPair("zones/example.com/dev/DS", []byte("[{\"Payload\":\"12345 13 2 0123456789abcdef\"}]"), 0),
+	store.NewPair("zones/example.com/ns1.dev/A", []byte("[{\"Payload\":\"192.0.2.1\"}]"), 0),
+	store.NewPair("zones/example.com/ns1.dev/AAAA", []byte("[{\"Payload\":\"2001:db8::1\"}]"), 0),
+	store.NewPair("zones/example.com/sub.dev/NS", []byte("[{\"Payload\":\"ns.example.net.\"}]"), 0),
+	store.NewPair("zones/example.com/host.dev/A", []byte("[{\"Payload\":\"192.0.2.2\"}]"), 0),
+	store.NewPair("zones/example.com/lb/A", []byte("[{\"Payload\":\"{{ var \\\"lb-vip\\\" }}\"},{\"Payload\":\"@ref zones/example.com/sub/A\"}]"), 0),
+	store.NewPair("zones/example.com/broken/A", []byte("[{\"Payload\":\"{{ var \\\"missing\\\" }}\"}]"), 0),
+	store.NewPair("vars/lb-vip", []byte("192.0.2.10"), 0),
+}
+
+func resolveStore() store.Store {
+	getFunc := func(key string) (store.Pair, error) {
+		for _, pair := range resolvePairs {
+			if pair.Key() == key {
+				return pair, nil
+			}
+		}
+
+		return nil, store.ErrKeyNotFound
+	}
+	listFunc := func(directory string) (result []store.Pair, err error) {
+		// behave like consul, which lists by raw key prefix
+		for _, pair := range resolvePairs {
+			if strings.HasPrefix(pair.Key(), directory) {
+				result = append(result, pair)
+			}
+		}
+
+		if len(result) == 0 {
+			return nil, store.ErrKeyNotFound
+		}
+
+		return result, nil
+	}
+
+	return &store.MockStore{GetFunc: getFunc, ListFunc: listFunc}
+}
+
+// resolveZone answers query from the zone a ZoneIndex finds for it
+func resolveZone(flat Schema, query *store.Query) (*Result, error) {
+	zone, _, err := NewZoneIndex([]Schema{flat}).Lookup(query.Name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return flat.Resolve(zone, query)
+}
+
+func TestResolve(t *testing.T) {
+	kv := resolveStore()
+
+	for _, tt := range resolveTests {
+		actual, err := resolveZone(NewFlatSchema(kv, 3600), &store.Query{Name: tt.name, Type: tt.qtype})
+
+		if err != nil {
+			t.Errorf("TestResolve(%s): unexpected error %v", tt.name, err)
+			continue
+		}
+
+		if actual.Zone != tt.expectedZone || actual.NameExists != tt.expectedNameExists || len(actual.Entries) != tt.expectedEntries || actual.Delegation != tt.expectedDelegation {
+			t.Errorf("TestResolve(%s %s): actual %s %v %d %s, expected %s %v %d %s", tt.name, tt.qtype, actual.Zone, actual.NameExists, len(actual.Entries), actual.Delegation, tt.expectedZone, tt.expectedNameExists, tt.expectedEntries, tt.expectedDelegation)
+		}
+	}
+}
+
+func TestResolveReferral(t *testing.T) {
+	actual, err := NewFlatSchema(resolveStore(), 3600).Resolve("example.com", &store.Query{Name: "host.dev.example.com", Type: "A"})
+
+	if err != nil {
+		t.Fatalf("TestResolveReferral: unexpected error %v", err)
+	}
+
+	if len(actual.Authority) != 2 || actual.Authority[0].Type != "NS" {
+		t.Errorf("TestResolveReferral: actual authority %v, expected 2 NS records", actual.Authority)
+	}
+
+	expectedGlue := map[string][]*store.Entry{
+		"ns1.dev.example.com": {
+			{Type: "A", Ttl: 3600, Payload: "192.0.2.1"},
+			{Type: "AAAA", Ttl: 3600, Payload: "2001:db8::1"},
+		},
+	}
+
+	if !reflect.DeepEqual(actual.Additional, expectedGlue) {
+		t.Errorf("TestResolveReferral: actual glue %v, expected %v", actual.Additional, expectedGlue)
+	}
+}
+
+func TestResolveListsOnlyTheName(t *testing.T) {
+	kv := resolveStore().(*store.MockStore)
+	listFunc := kv.ListFunc
+	var listed []string
+	kv.ListFunc = func(directory string) ([]store.Pair, error) {
+		listed = append(listed, directory)
+		return listFunc(directory)
+	}
+
+	if _, err := NewFlatSchema(kv, 3600).Resolve("example.com", &store.Query{Name: "sub.example.com", Type: "A"}); err != nil {
+		t.Fatalf("TestResolveListsOnlyTheName: unexpected error %v", err)
+	}
+
+	if expected := []string{"zones/example.com/sub"}; !reflect.DeepEqual(listed, expected) {
+		t.Errorf("TestResolveListsOnlyTheName: actual %v, expected %v", listed, expected)
+	}
+}
+
 var kvPairNumSegmentsTests = []struct {
 	kvPair   store.Pair
 	expected int
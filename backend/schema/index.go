@@ -0,0 +1,131 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+// DefaultZoneIndexMaxAge is how long the zones of a schema are kept before
+// they are listed again
+const DefaultZoneIndexMaxAge = 5 * time.Second
+
+// ZoneIndex finds the schema that is authoritative for a name when several
+// schemas are configured. The most specific zone wins, i.e. dev.example.com
+// over example.com, and a zone served by several schemas is taken from the
+// first one. The zones of every schema are listed again after MaxAge or when
+// Refresh is called, e.g. when a zone watcher sees zones come or go.
+type ZoneIndex struct {
+	MaxAge  time.Duration
+	schemas []Schema
+	mutex   sync.Mutex
+	zones   map[Schema][]string
+	listed  map[Schema]time.Time
+	failed  map[Schema]error // why a schema was never listed, tried at listed
+	now     func() time.Time
+}
+
+func NewZoneIndex(schemas []Schema) *ZoneIndex {
+	return &ZoneIndex{
+		MaxAge:  DefaultZoneIndexMaxAge,
+		schemas: schemas,
+		zones:   make(map[Schema][]string),
+		listed:  make(map[Schema]time.Time),
+		failed:  make(map[Schema]error),
+		now:     time.Now,
+	}
+}
+
+// Lookup returns the most specific zone enclosing name and the schema serving
+// it. zone is empty and schema nil if no schema is authoritative for name.
+// If the zones of a schema cannot be listed, the last zones listed are used.
+// A schema whose zones have never been listed is skipped until MaxAge has
+// passed, so the other schemas keep answering. Lookup only fails if no
+// schema could be listed at all.
+func (index *ZoneIndex) Lookup(name string) (zone string, schema Schema, err error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	skipped := 0
+	var lastErr error
+
+	for _, curSchema := range index.schemas {
+		zones, err := index.zonesOf(curSchema)
+
+		if err != nil {
+			skipped, lastErr = skipped+1, err
+			continue
+		}
+
+		for _, curZone := range zones {
+			if len(curZone) > len(zone) && isInZone(name, curZone) {
+				zone, schema = curZone, curSchema
+			}
+		}
+	}
+
+	if skipped > 0 && skipped == len(index.schemas) {
+		return "", nil, fmt.Errorf("Schema could not list its zones: %v", lastErr)
+	}
+
+	return zone, schema, nil
+}
+
+// Refresh lists the zones of curSchema again. If they cannot be listed, the
+// last zones listed are kept.
+func (index *ZoneIndex) Refresh(curSchema Schema) error {
+	_, err := index.refresh(curSchema)
+	return err
+}
+
+func (index *ZoneIndex) refresh(curSchema Schema) ([]string, error) {
+	zones, err := curSchema.Zones()
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if err != nil {
+		if _, ok := index.zones[curSchema]; !ok {
+			index.failed[curSchema], index.listed[curSchema] = err, index.now()
+		}
+
+		return index.zones[curSchema], err
+	}
+
+	index.zones[curSchema], index.listed[curSchema] = zones, index.now()
+	delete(index.failed, curSchema)
+
+	return zones, nil
+}
+
+func (index *ZoneIndex) zonesOf(curSchema Schema) ([]string, error) {
+	index.mutex.Lock()
+	zones, ok := index.zones[curSchema]
+	failed := index.failed[curSchema]
+	listed := index.listed[curSchema]
+	index.mutex.Unlock()
+
+	fresh := index.now().Sub(listed) < index.MaxAge
+
+	if ok && (index.MaxAge == 0 || fresh) {
+		return zones, nil
+	} else if failed != nil && fresh {
+		return nil, failed
+	}
+
+	zones, err := index.refresh(curSchema)
+
+	if err != nil && ok {
+		logging.Warn("Schema could not list its zones, using the last zones listed", "error", err)
+		return zones, nil
+	} else if err != nil {
+		logging.Warn("Schema could not list its zones, skipping it", "error", err)
+	}
+
+	return zones, err
+}
+
+func isInZone(name string, zone string) bool {
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
@@ -0,0 +1,128 @@
+package schema
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+type zonesSchema struct {
+	Schema
+	zones []string
+	err   error
+}
+
+func (s *zonesSchema) Zones() ([]string, error) {
+	return s.zones, s.err
+}
+
+var zoneIndexTests = []struct {
+	name           string
+	expectedZone   string
+	expectedSchema int
+}{
+	{"example.com", "example.com", 0},
+	{"www.example.com.", "example.com", 0},
+	{"dev.example.com", "dev.example.com", 1},
+	{"WWW.DEV.example.com", "dev.example.com", 1},
+	{"other.example.org", "example.org", 0},
+	{"devexample.com", "", -1},
+	{"example.net", "", -1},
+}
+
+func TestZoneIndexLookup(t *testing.T) {
+	schemas := []Schema{
+		&zonesSchema{zones: []string{"example.com", "example.org"}},
+		&zonesSchema{zones: []string{"dev.example.com", "example.org"}},
+	}
+	index := NewZoneIndex(schemas)
+
+	for _, tt := range zoneIndexTests {
+		zone, schema, err := index.Lookup(tt.name)
+
+		if err != nil {
+			t.Errorf("TestZoneIndexLookup(%s): unexpected error %v", tt.name, err)
+		}
+
+		expectedSchema := Schema(nil)
+		if tt.expectedSchema >= 0 {
+			expectedSchema = schemas[tt.expectedSchema]
+		}
+
+		if zone != tt.expectedZone || schema != expectedSchema {
+			t.Errorf("TestZoneIndexLookup(%s): actual %s %v, expected %s %v", tt.name, zone, schema, tt.expectedZone, expectedSchema)
+		}
+	}
+}
+
+func TestZoneIndexLookupFailure(t *testing.T) {
+	failing := &zonesSchema{err: errors.New("unreachable")}
+	index := NewZoneIndex([]Schema{&zonesSchema{zones: []string{"example.com"}}, failing})
+	now := time.Unix(1000, 0)
+	index.now = func() time.Time { return now }
+
+	if zone, schema, err := index.Lookup("dev.example.com"); zone != "example.com" || schema == failing || err != nil {
+		t.Errorf("TestZoneIndexLookupFailure: actual %s %v %v, expected example.com from the first schema", zone, schema, err)
+	}
+
+	failing.zones, failing.err = []string{"dev.example.com"}, nil
+
+	if zone, _, _ := index.Lookup("dev.example.com"); zone != "example.com" {
+		t.Errorf("TestZoneIndexLookupFailure: actual %s, expected the schema to be skipped until MaxAge", zone)
+	}
+
+	now = now.Add(DefaultZoneIndexMaxAge)
+
+	if zone, schema, err := index.Lookup("dev.example.com"); zone != "dev.example.com" || schema != failing || err != nil {
+		t.Errorf("TestZoneIndexLookupFailure: actual %s %v %v, expected dev.example.com from the second schema", zone, schema, err)
+	}
+
+	failing.zones, failing.err = nil, store.ErrKeyNotFound
+	index.MaxAge = time.Nanosecond
+
+	if err := index.Refresh(failing); err == nil {
+		t.Errorf("TestZoneIndexLookupFailure: expected Refresh to fail")
+	}
+
+	if zone, schema, err := index.Lookup("dev.example.com"); zone != "dev.example.com" || schema != failing || err != nil {
+		t.Errorf("TestZoneIndexLookupFailure: actual %s %v %v, expected the last zones listed", zone, schema, err)
+	}
+
+	index = NewZoneIndex([]Schema{&zonesSchema{err: errors.New("unreachable")}})
+
+	if _, _, err := index.Lookup("example.com"); err == nil {
+		t.Errorf("TestZoneIndexLookupFailure: expected an error when no schema could list its zones")
+	}
+}
+
+func TestZoneIndexRefresh(t *testing.T) {
+	curSchema := &zonesSchema{zones: []string{"example.com"}}
+	index := NewZoneIndex([]Schema{curSchema})
+	now := time.Unix(1000, 0)
+	index.now = func() time.Time { return now }
+
+	if zone, _, _ := index.Lookup("example.org"); zone != "" {
+		t.Errorf("TestZoneIndexRefresh: actual %s, expected no zone", zone)
+	}
+
+	curSchema.zones = []string{"example.com", "example.org"}
+
+	if zone, _, _ := index.Lookup("example.org"); zone != "" {
+		t.Errorf("TestZoneIndexRefresh: actual %s, expected the cached zones before Refresh", zone)
+	}
+
+	index.Refresh(curSchema)
+
+	if zone, _, _ := index.Lookup("example.org"); zone != "example.org" {
+		t.Errorf("TestZoneIndexRefresh: actual %s, expected example.org", zone)
+	}
+
+	curSchema.zones = []string{"example.com"}
+	now = now.Add(DefaultZoneIndexMaxAge)
+
+	if zone, _, _ := index.Lookup("example.org"); zone != "" {
+		t.Errorf("TestZoneIndexRefresh: actual %s, expected the zones to be listed again after MaxAge", zone)
+	}
+}
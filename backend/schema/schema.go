@@ -6,9 +6,29 @@ import (
 	"github.com/Shark/powerdns-consul/backend/store"
 )
 
+// Result is the answer of a schema to a query. Zone is the apex of the zone
+// the name belongs to and is empty if the schema is not authoritative for it.
+// NameExists tells a name without records of the queried type (NODATA) apart
+// from a name that does not exist at all (NXDOMAIN). Authority holds the
+// records for the authority section of negative answers, i.e. the zone's SOA.
+//
+// If the name is at or below a zone cut, Delegation is the name of the cut,
+// Authority holds its NS records and Additional the glue records by name.
+type Result struct {
+	Entries    []*store.Entry
+	Zone       string
+	NameExists bool
+	Authority  []*store.Entry
+	Delegation string
+	Additional map[string][]*store.Entry
+}
+
 type Schema interface {
+	Zones() ([]string, error)
 	HasZone(string) (bool, error)
-	Resolve(*store.Query) ([]*store.Entry, error)
+	// Resolve answers query from zone, the most specific zone of the schema
+	// enclosing the name as found by a ZoneIndex
+	Resolve(zone string, query *store.Query) (*Result, error)
 	Store() store.Store
 }
 
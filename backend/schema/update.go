@@ -0,0 +1,482 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+// Updater is implemented by schemas that accept dynamic updates (RFC 2136)
+type Updater interface {
+	// Update checks the prerequisites of an UPDATE message for zone, applies
+	// its updates and returns the response code
+	Update(zone string, prerequisites []dns.RR, updates []dns.RR) int
+}
+
+// rrset is the state of one record key while an update is applied
+type rrset struct {
+	key      string
+	name     string
+	rrtype   string
+	previous store.Pair
+	values   []value
+	changed  bool
+}
+
+// Update checks the prerequisites before the updates are applied, they are
+// not part of the transaction writing the updates. A concurrent change to
+// a record the updates touch is detected, a concurrent change to one the
+// prerequisites only check is not.
+func (flat *FlatSchema) Update(zone string, prerequisites []dns.RR, updates []dns.RR) int {
+	for _, rr := range append(prerequisites, updates...) {
+		if _, ok := relativeName(zone, rr.Header().Name); !ok {
+			return dns.RcodeNotZone
+		}
+	}
+
+	if rcode := flat.checkPrerequisites(zone, prerequisites); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+
+	for _, rr := range updates {
+		if rcode := checkUpdate(rr); rcode != dns.RcodeSuccess {
+			return rcode
+		}
+	}
+
+	rrsets := make(map[string]*rrset)
+	var order []*rrset
+
+	loaded := func(name string) (result []*rrset) {
+		for _, set := range order {
+			if strings.EqualFold(set.name, name) {
+				result = append(result, set)
+			}
+		}
+		return result
+	}
+
+	get := func(name string, rrtype string) (*rrset, error) {
+		label, _ := relativeName(zone, name)
+		key := recordKey(zone, label, rrtype)
+
+		if set, ok := rrsets[key]; ok {
+			return set, nil
+		}
+
+		set, err := flat.loadRRset(key, name, rrtype)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rrsets[key] = set
+		order = append(order, set)
+		return set, nil
+	}
+
+	for _, rr := range updates {
+		if err := flat.applyUpdate(zone, rr, get, loaded); err != nil {
+			logging.Error("Unable to apply update", "zone", zone, "record", rr.String(), "error", err)
+			return dns.RcodeServerFailure
+		}
+	}
+
+	var changed []*rrset
+	for _, set := range order {
+		if set.changed {
+			changed = append(changed, set)
+		}
+	}
+
+	if err := flat.writeRRsets(changed); err == store.ErrTxnTooLarge {
+		logging.Warn("Refusing update", "zone", zone, "error", err)
+		return dns.RcodeRefused
+	} else if err != nil {
+		logging.Error("Unable to write update", "zone", zone, "error", err)
+		return dns.RcodeServerFailure
+	}
+
+	return dns.RcodeSuccess
+}
+
+// checkPrerequisites implements RFC 2136 section 3.2
+func (flat *FlatSchema) checkPrerequisites(zone string, prerequisites []dns.RR) int {
+	expected := make(map[string][]dns.RR)
+
+	for _, rr := range prerequisites {
+		header := rr.Header()
+		label, _ := relativeName(zone, header.Name)
+		rrtype := dns.TypeToString[header.Rrtype]
+
+		if header.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+
+		switch header.Class {
+		case dns.ClassANY, dns.ClassNONE:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+
+			var exists bool
+			var err error
+
+			if header.Rrtype == dns.TypeANY {
+				var pairs []store.Pair
+				pairs, err = flat.findKVPairsForZone(flat.store, zone, label)
+				exists = len(pairs) > 0
+			} else {
+				_, err = flat.store.Get(recordKey(zone, label, rrtype))
+				exists = err == nil
+
+				if err == store.ErrKeyNotFound {
+					err = nil
+				}
+			}
+
+			if err != nil {
+				logging.Error("Unable to check prerequisite", "zone", zone, "record", rr.String(), "error", err)
+				return dns.RcodeServerFailure
+			}
+
+			if header.Class == dns.ClassANY && !exists {
+				if header.Rrtype == dns.TypeANY {
+					return dns.RcodeNameError
+				}
+				return dns.RcodeNXRrset
+			} else if header.Class == dns.ClassNONE && exists {
+				if header.Rrtype == dns.TypeANY {
+					return dns.RcodeYXDomain
+				}
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := recordKey(zone, label, rrtype)
+			expected[key] = append(expected[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// value dependent prerequisites: the RRset must match exactly
+	for key, rrs := range expected {
+		set, err := flat.loadRRset(key, rrs[0].Header().Name, dns.TypeToString[rrs[0].Header().Rrtype])
+
+		if err != nil {
+			logging.Error("Unable to check prerequisites", "zone", zone, "error", err)
+			return dns.RcodeServerFailure
+		}
+
+		current := set.rrs(flat.defaultTTL)
+
+		if !sameRRs(current, rrs) {
+			return dns.RcodeNXRrset
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// checkUpdate implements the checks of RFC 2136 section 3.4.1
+func checkUpdate(rr dns.RR) int {
+	header := rr.Header()
+
+	switch header.Class {
+	case dns.ClassINET:
+		if header.Rrtype == dns.TypeANY || header.Rrtype == dns.TypeAXFR || header.Rrtype == dns.TypeIXFR {
+			return dns.RcodeFormatError
+		}
+	case dns.ClassANY:
+		if header.Ttl != 0 || header.Rdlength != 0 {
+			return dns.RcodeFormatError
+		}
+	case dns.ClassNONE:
+		if header.Ttl != 0 || header.Rrtype == dns.TypeANY {
+			return dns.RcodeFormatError
+		}
+	default:
+		return dns.RcodeFormatError
+	}
+
+	return dns.RcodeSuccess
+}
+
+// applyUpdate implements RFC 2136 section 3.4.2. SOA records are generated
+// and cannot be changed, the apex NS records can only be replaced. loaded
+// returns the rrsets of a name that get has returned so far.
+func (flat *FlatSchema) applyUpdate(zone string, rr dns.RR, get func(string, string) (*rrset, error), loaded func(string) []*rrset) error {
+	header := rr.Header()
+	label, _ := relativeName(zone, header.Name)
+	rrtype := dns.TypeToString[header.Rrtype]
+
+	if header.Rrtype == dns.TypeSOA {
+		return nil
+	}
+
+	switch header.Class {
+	case dns.ClassINET:
+		types, err := flat.nameTypes(zone, header.Name, get, loaded)
+
+		if err != nil {
+			return err
+		}
+
+		// a CNAME cannot coexist with other data, the update is ignored
+		for curType := range types {
+			if (rrtype == "CNAME") != (curType == "CNAME") {
+				return nil
+			}
+		}
+
+		set, err := get(header.Name, rrtype)
+
+		if err != nil {
+			return err
+		}
+
+		if rrtype == "CNAME" && len(set.values) > 0 {
+			set.values = nil // a name has one CNAME, it is replaced
+		}
+
+		for i, current := range set.rrs(flat.defaultTTL) {
+			if current != nil && dns.IsDuplicate(current, rr) {
+				ttl := header.Ttl
+				set.values[i].TTL = &ttl
+				set.changed = true
+				return nil
+			}
+		}
+
+		ttl, payload := header.Ttl, rrPayload(rr)
+		set.values = append(set.values, value{TTL: &ttl, Payload: &payload})
+		set.changed = true
+	case dns.ClassANY:
+		rrtypes := []string{rrtype}
+
+		if header.Rrtype == dns.TypeANY {
+			pairs, err := flat.findKVPairsForZone(flat.store, zone, label)
+
+			if err != nil {
+				return err
+			}
+
+			rrtypes = nil
+			for _, pair := range pairs {
+				tokens := strings.Split(pair.Key(), "/")
+				rrtypes = append(rrtypes, tokens[len(tokens)-1])
+			}
+		}
+
+		for _, curType := range rrtypes {
+			if label == "" && (curType == "NS" || curType == "SOA") {
+				continue
+			}
+
+			set, err := get(header.Name, curType)
+
+			if err != nil {
+				return err
+			}
+
+			if len(set.values) > 0 {
+				set.values = nil
+				set.changed = true
+			}
+		}
+	case dns.ClassNONE:
+		set, err := get(header.Name, rrtype)
+
+		if err != nil {
+			return err
+		}
+
+		var values []value
+		for i, current := range set.rrs(flat.defaultTTL) {
+			if current == nil || !isSameRecord(current, rr) {
+				values = append(values, set.values[i])
+			}
+		}
+
+		if len(values) == len(set.values) {
+			return nil
+		}
+
+		if label == "" && header.Rrtype == dns.TypeNS && len(values) == 0 {
+			return nil // keep the last apex NS record
+		}
+
+		set.values = values
+		set.changed = true
+	}
+
+	return nil
+}
+
+// nameTypes returns the types that have records at name, with the changes
+// of the update applied so far
+func (flat *FlatSchema) nameTypes(zone string, name string, get func(string, string) (*rrset, error), loaded func(string) []*rrset) (map[string]bool, error) {
+	label, _ := relativeName(zone, name)
+	pairs, err := flat.findKVPairsForZone(flat.store, zone, label)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pair := range pairs {
+		tokens := strings.Split(pair.Key(), "/")
+
+		if _, err := get(name, tokens[len(tokens)-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	types := make(map[string]bool)
+	for _, set := range loaded(name) {
+		if len(set.values) > 0 {
+			types[set.rrtype] = true
+		}
+	}
+
+	return types, nil
+}
+
+func (flat *FlatSchema) loadRRset(key string, name string, rrtype string) (*rrset, error) {
+	set := &rrset{key: key, name: name, rrtype: rrtype}
+	pair, err := flat.store.Get(key)
+
+	if err == store.ErrKeyNotFound {
+		return set, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	set.previous = pair
+
+	if err := json.Unmarshal(pair.Value(), &set.values); err != nil {
+		return nil, fmt.Errorf("Key %s is invalid: %v", key, err)
+	}
+
+	return set, nil
+}
+
+// writeRRsets writes sets in one transaction, it returns ErrConflict if one
+// of them was changed since it was loaded
+func (flat *FlatSchema) writeRRsets(sets []*rrset) error {
+	var ops []*store.TxnOp
+
+	for _, set := range sets {
+		if len(set.values) == 0 {
+			if set.previous != nil {
+				ops = append(ops, &store.TxnOp{Key: set.key, Delete: true, Previous: set.previous})
+			}
+			continue
+		}
+
+		encoded, err := json.Marshal(set.values)
+
+		if err != nil {
+			return err
+		}
+
+		ops = append(ops, &store.TxnOp{Key: set.key, Value: encoded, Previous: set.previous})
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	ok, err := flat.store.AtomicTxn(ops)
+
+	if err == nil && !ok {
+		err = ErrConflict
+	}
+
+	return err
+}
+
+// rrs parses the stored values, entries that cannot be parsed are nil
+func (set *rrset) rrs(defaultTTL uint32) []dns.RR {
+	rrs := make([]dns.RR, len(set.values))
+
+	for i, value := range set.values {
+		if value.Payload == nil {
+			continue
+		}
+
+		ttl := defaultTTL
+		if value.TTL != nil {
+			ttl = *value.TTL
+		}
+
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(set.name), ttl, set.rrtype, *value.Payload))
+
+		if err == nil {
+			rrs[i] = rr
+		}
+	}
+
+	return rrs
+}
+
+func sameRRs(current []dns.RR, expected []dns.RR) bool {
+	if len(current) != len(expected) {
+		return false
+	}
+
+	for _, rr := range expected {
+		found := false
+
+		for _, currentRR := range current {
+			if currentRR != nil && isSameRecord(currentRR, rr) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isSameRecord compares name, type and data, but not class and TTL
+func isSameRecord(a dns.RR, b dns.RR) bool {
+	a, b = dns.Copy(a), dns.Copy(b)
+	a.Header().Class, b.Header().Class = dns.ClassINET, dns.ClassINET
+	return dns.IsDuplicate(a, b)
+}
+
+func rrPayload(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// relativeName returns the label of name in zone, empty for the apex
+func relativeName(zone string, name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if name == zone {
+		return "", true
+	}
+
+	if !strings.HasSuffix(name, "."+zone) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(name, "."+zone), true
+}
+
+func recordKey(zone string, label string, rrtype string) string {
+	if label == "" {
+		return fmt.Sprintf("zones/%s/%s", zone, rrtype)
+	}
+
+	return fmt.Sprintf("zones/%s/%s/%s", zone, label, rrtype)
+}
@@ -0,0 +1,132 @@
+package schema
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+func newRRs(t *testing.T, records ...string) []dns.RR {
+	var rrs []dns.RR
+
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+
+		if err != nil {
+			t.Fatalf("newRRs(%s): unexpected error %v", record, err)
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
+
+func withClass(rrs []dns.RR, class uint16) []dns.RR {
+	for _, rr := range rrs {
+		rr.Header().Class = class
+		rr.Header().Ttl = 0
+	}
+	return rrs
+}
+
+func header(name string, rrtype uint16, class uint16) dns.RR {
+	return &dns.RR_Header{Name: name, Rrtype: rrtype, Class: class}
+}
+
+func keys(pairs map[string]string) []string {
+	var result []string
+	for key, value := range pairs {
+		result = append(result, key+"="+value)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func initialPairs() map[string]string {
+	return map[string]string{
+		"zones/example.com/NS":       `[{"Payload":"ns.example.com."}]`,
+		"zones/example.com/A":        `[{"Payload":"192.0.2.1"}]`,
+		"zones/example.com/host/A":   `[{"TTL":60,"Payload":"192.0.2.10"},{"Payload":"192.0.2.11"}]`,
+		"zones/example.com/host/TXT": `[{"Payload":"\"hello\""}]`,
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name          string
+		prerequisites []dns.RR
+		updates       []dns.RR
+		expectedRcode int
+		expectedKey   string
+		expectedValue string // empty if the key must not exist
+	}{
+		{"add", nil, newRRs(t, "new.example.com. 300 IN A 192.0.2.20"), dns.RcodeSuccess, "zones/example.com/new/A", `[{"TTL":300,"Payload":"192.0.2.20"}]`},
+		{"add to rrset", nil, newRRs(t, "host.example.com. 60 IN A 192.0.2.12"), dns.RcodeSuccess, "zones/example.com/host/A", `[{"TTL":60,"Payload":"192.0.2.10"},{"Payload":"192.0.2.11"},{"TTL":60,"Payload":"192.0.2.12"}]`},
+		{"add duplicate", nil, newRRs(t, "host.example.com. 120 IN A 192.0.2.10"), dns.RcodeSuccess, "zones/example.com/host/A", `[{"TTL":120,"Payload":"192.0.2.10"},{"Payload":"192.0.2.11"}]`},
+		{"delete record", nil, withClass(newRRs(t, "host.example.com. 0 IN A 192.0.2.10"), dns.ClassNONE), dns.RcodeSuccess, "zones/example.com/host/A", `[{"Payload":"192.0.2.11"}]`},
+		{"delete last record", nil, withClass(newRRs(t, "example.com. 0 IN A 192.0.2.1"), dns.ClassNONE), dns.RcodeSuccess, "zones/example.com/A", ""},
+		{"delete rrset", nil, []dns.RR{header("host.example.com.", dns.TypeA, dns.ClassANY)}, dns.RcodeSuccess, "zones/example.com/host/A", ""},
+		{"delete name", nil, []dns.RR{header("host.example.com.", dns.TypeANY, dns.ClassANY)}, dns.RcodeSuccess, "zones/example.com/host/TXT", ""},
+		{"delete apex keeps NS", nil, []dns.RR{header("example.com.", dns.TypeANY, dns.ClassANY)}, dns.RcodeSuccess, "zones/example.com/NS", `[{"Payload":"ns.example.com."}]`},
+		{"delete apex NS rrset ignored", nil, []dns.RR{header("example.com.", dns.TypeNS, dns.ClassANY)}, dns.RcodeSuccess, "zones/example.com/NS", `[{"Payload":"ns.example.com."}]`},
+		{"delete apex SOA ignored", nil, []dns.RR{header("example.com.", dns.TypeSOA, dns.ClassANY)}, dns.RcodeSuccess, "zones/example.com/NS", `[{"Payload":"ns.example.com."}]`},
+		{"cname next to other data ignored", nil, newRRs(t, "host.example.com. 300 IN CNAME example.com."), dns.RcodeSuccess, "zones/example.com/host/CNAME", ""},
+		{"data next to cname ignored", nil, newRRs(t, "alias.example.com. 300 IN CNAME example.com.", "alias.example.com. 300 IN A 192.0.2.20"), dns.RcodeSuccess, "zones/example.com/alias/A", ""},
+		{"cname replaced", nil, newRRs(t, "alias.example.com. 300 IN CNAME example.com.", "alias.example.com. 300 IN CNAME host.example.com."), dns.RcodeSuccess, "zones/example.com/alias/CNAME", `[{"TTL":300,"Payload":"host.example.com."}]`},
+		{"cname after deleting the data", nil, append([]dns.RR{header("host.example.com.", dns.TypeANY, dns.ClassANY)}, newRRs(t, "host.example.com. 300 IN CNAME example.com.")...), dns.RcodeSuccess, "zones/example.com/host/CNAME", `[{"TTL":300,"Payload":"example.com."}]`},
+		{"delete last apex NS", nil, withClass(newRRs(t, "example.com. 0 IN NS ns.example.com."), dns.ClassNONE), dns.RcodeSuccess, "zones/example.com/NS", `[{"Payload":"ns.example.com."}]`},
+		{"outside of zone", nil, newRRs(t, "host.example.org. 300 IN A 192.0.2.20"), dns.RcodeNotZone, "zones/example.com/host/A", `[{"TTL":60,"Payload":"192.0.2.10"},{"Payload":"192.0.2.11"}]`},
+		{"name in use", []dns.RR{header("host.example.com.", dns.TypeANY, dns.ClassANY)}, newRRs(t, "host.example.com. 300 IN AAAA 2001:db8::1"), dns.RcodeSuccess, "zones/example.com/host/AAAA", `[{"TTL":300,"Payload":"2001:db8::1"}]`},
+		{"name not in use", []dns.RR{header("host.example.com.", dns.TypeANY, dns.ClassNONE)}, newRRs(t, "host.example.com. 300 IN AAAA 2001:db8::1"), dns.RcodeYXDomain, "zones/example.com/host/AAAA", ""},
+		{"name in use, missing", []dns.RR{header("new.example.com.", dns.TypeANY, dns.ClassANY)}, newRRs(t, "new.example.com. 300 IN A 192.0.2.20"), dns.RcodeNameError, "zones/example.com/new/A", ""},
+		{"rrset exists", []dns.RR{header("host.example.com.", dns.TypeAAAA, dns.ClassANY)}, newRRs(t, "host.example.com. 300 IN AAAA 2001:db8::1"), dns.RcodeNXRrset, "zones/example.com/host/AAAA", ""},
+		{"rrset does not exist", []dns.RR{header("host.example.com.", dns.TypeAAAA, dns.ClassNONE)}, newRRs(t, "host.example.com. 300 IN AAAA 2001:db8::1"), dns.RcodeSuccess, "zones/example.com/host/AAAA", `[{"TTL":300,"Payload":"2001:db8::1"}]`},
+		{"rrset matches", withClass(newRRs(t, "host.example.com. 0 IN A 192.0.2.11", "host.example.com. 0 IN A 192.0.2.10"), dns.ClassINET), []dns.RR{header("host.example.com.", dns.TypeA, dns.ClassANY)}, dns.RcodeSuccess, "zones/example.com/host/A", ""},
+		{"rrset differs", withClass(newRRs(t, "host.example.com. 0 IN A 192.0.2.10"), dns.ClassINET), []dns.RR{header("host.example.com.", dns.TypeA, dns.ClassANY)}, dns.RcodeNXRrset, "zones/example.com/host/A", `[{"TTL":60,"Payload":"192.0.2.10"},{"Payload":"192.0.2.11"}]`},
+		{"soa ignored", nil, newRRs(t, "example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 2 3 4 5"), dns.RcodeSuccess, "zones/example.com/SOA", ""},
+	}
+
+	for _, tt := range tests {
+		pairs := initialPairs()
+		flat := &FlatSchema{store.NewMemoryStore(pairs), 3600}
+
+		rcode := flat.Update("example.com", tt.prerequisites, tt.updates)
+
+		if rcode != tt.expectedRcode {
+			t.Errorf("TestUpdate(%s): actual rcode %s, expected %s", tt.name, dns.RcodeToString[rcode], dns.RcodeToString[tt.expectedRcode])
+		}
+
+		if value := pairs[tt.expectedKey]; value != tt.expectedValue {
+			t.Errorf("TestUpdate(%s): actual %s=%s, expected %s, all keys %v", tt.name, tt.expectedKey, value, tt.expectedValue, keys(pairs))
+		}
+	}
+}
+
+func TestUpdateConcurrentModification(t *testing.T) {
+	kv := store.NewMemoryStore(initialPairs())
+	kv.AtomicPutFunc = func(key string, value []byte, previous store.Pair, options *store.WriteOptions) (bool, store.Pair, error) {
+		return false, nil, nil
+	}
+
+	rcode := (&FlatSchema{kv, 3600}).Update("example.com", nil, newRRs(t, "new.example.com. 300 IN A 192.0.2.20"))
+
+	if rcode != dns.RcodeServerFailure {
+		t.Errorf("TestUpdateConcurrentModification: actual rcode %s, expected SERVFAIL", dns.RcodeToString[rcode])
+	}
+}
+
+func TestUpdateTooLarge(t *testing.T) {
+	pairs := initialPairs()
+	kv := store.NewMemoryStore(pairs)
+	kv.MaxTxnOps = 1
+
+	rcode := (&FlatSchema{kv, 3600}).Update("example.com", nil, newRRs(t, "a.example.com. 300 IN A 192.0.2.20", "b.example.com. 300 IN A 192.0.2.21"))
+
+	if _, ok := pairs["zones/example.com/a/A"]; rcode != dns.RcodeRefused || ok {
+		t.Errorf("TestUpdateTooLarge: actual rcode %s, a.example.com written %v, expected REFUSED and nothing written", dns.RcodeToString[rcode], ok)
+	}
+}
@@ -7,8 +7,24 @@ import (
 	"time"
 
 	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/backend/template"
 )
 
+const (
+	ModeReadWrite   = "readwrite"   // keep the serial in soa/<zone>, updating it on queries
+	ModeReadOnly    = "readonly"    // serve the serial from soa/<zone>, never write to the store
+	ModeModifyIndex = "modifyindex" // serve the zone's highest modify index, never touch soa/<zone>
+)
+
+func ValidateMode(mode string) error {
+	switch mode {
+	case "", ModeReadWrite, ModeReadOnly, ModeModifyIndex:
+		return nil
+	}
+
+	return fmt.Errorf("Unsupported SOA mode %s", mode)
+}
+
 type soaEntry struct {
 	NameServer string
 	EmailAddr  string
@@ -21,18 +37,21 @@ type soaEntry struct {
 
 type soaRevision struct {
 	SnModifyIndex uint64
-	SnDate        int
-	SnVersion     uint32
+	Sn            uint32 `json:",omitempty"`
+	SnDate        int    `json:",omitempty"` // deprecated, read for revisions without Sn
+	SnVersion     uint32 `json:",omitempty"` // deprecated, read for revisions without Sn
 }
 
 type GeneratorConfig struct {
-	SoaNameServer string
-	SoaEmailAddr  string
-	SoaRefresh    int32
-	SoaRetry      int32
-	SoaExpiry     int32
-	SoaNx         int32
-	DefaultTTL    uint32
+	SoaNameServer  string
+	SoaEmailAddr   string
+	SoaRefresh     int32
+	SoaRetry       int32
+	SoaExpiry      int32
+	SoaNx          int32
+	DefaultTTL     uint32
+	SerialStrategy string
+	Mode           string
 }
 
 type Generator struct {
@@ -64,18 +83,14 @@ func (g *Generator) RetrieveOrCreateSOAEntry(kv store.Store, zone string) (entry
 }
 
 func (g *Generator) tryToRetrieveOrCreateSOAEntry(kv store.Store, zone string) (entry *store.Entry, err error) {
-	prefix := fmt.Sprintf("zones/%s", zone)
-	pairs, err := kv.List(prefix)
+	lastModifyIndex, err := g.lastModifyIndex(kv, zone)
 
 	if err != nil {
 		return nil, err
 	}
 
-	var lastModifyIndex uint64
-	for _, pair := range pairs {
-		if lastModifyIndex == 0 || pair.LastIndex() > lastModifyIndex {
-			lastModifyIndex = pair.LastIndex()
-		}
+	if g.cfg.Mode == ModeModifyIndex {
+		return g.soaEntry(uint32(lastModifyIndex)), nil
 	}
 
 	key := fmt.Sprintf("soa/%s", zone)
@@ -85,73 +100,187 @@ func (g *Generator) tryToRetrieveOrCreateSOAEntry(kv store.Store, zone string) (
 		return nil, err
 	}
 
+	if g.cfg.Mode == ModeReadOnly && revEntryPair == nil {
+		// no writer has created a revision yet
+		return g.soaEntry(uint32(lastModifyIndex)), nil
+	}
+
 	rev := soaRevision{}
+	changed := true
 
 	if revEntryPair != nil { // use existing revision
-		err = json.Unmarshal(revEntryPair.Value(), &rev)
+		rev, err = parseRevision(revEntryPair.Value())
 
 		if err != nil {
 			return nil, err
 		}
 
+		if g.cfg.Mode == ModeReadOnly {
+			return g.soaEntry(rev.Sn), nil
+		}
+
 		if rev.SnModifyIndex != lastModifyIndex {
 			// update the modify index
 			rev.SnModifyIndex = lastModifyIndex
 
-			curSnDate := getDateFormatted(g.currentTime)
-			if rev.SnDate != curSnDate {
-				rev.SnDate = curSnDate
-				rev.SnVersion = 0
-			} else {
-				// TODO: what about SnVersion > 99?
-				rev.SnVersion += 1
-			}
-		} // else nothing to do
+			rev.Sn, err = nextSerial(g.cfg.SerialStrategy, &rev.Sn, lastModifyIndex, g.currentTime)
+		} else {
+			changed = false
+		}
 	} else { // create a new revision
-		rev.SnDate = getDateFormatted(g.currentTime)
-		rev.SnVersion = 0
 		rev.SnModifyIndex = lastModifyIndex
+		rev.Sn, err = nextSerial(g.cfg.SerialStrategy, nil, lastModifyIndex, g.currentTime)
 	}
 
-	json, err := json.Marshal(rev)
-
 	if err != nil {
 		return nil, err
 	}
 
-	ok, _, err := kv.AtomicPut(key, json, revEntryPair, nil)
+	if changed {
+		json, err := json.Marshal(rev)
 
-	if err != nil || !ok {
-		return nil, err
+		if err != nil {
+			return nil, err
+		}
+
+		ok, _, err := kv.AtomicPut(key, json, revEntryPair, nil)
+
+		if err != nil || !ok {
+			return nil, err
+		}
 	}
 
+	return g.soaEntry(rev.Sn), nil
+}
+
+// BumpSerial moves the serial of zone on to the next one even if its
+// records did not change, i.e. after a rollback, and also in ModeReadOnly.
+// In ModeModifyIndex the serial is the zone's modify index and returned as
+// it is.
+func (g *Generator) BumpSerial(kv store.Store, zone string) (*store.Entry, error) {
+	key := fmt.Sprintf("soa/%s", zone)
+
+	for tries := 0; tries < 3; tries++ {
+		lastModifyIndex, err := g.lastModifyIndex(kv, zone)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if g.cfg.Mode == ModeModifyIndex {
+			return g.soaEntry(uint32(lastModifyIndex)), nil
+		}
+
+		revEntryPair, err := kv.Get(key)
+
+		if err != nil && err != store.ErrKeyNotFound {
+			return nil, err
+		}
+
+		var previous *uint32
+
+		if revEntryPair != nil {
+			rev, err := parseRevision(revEntryPair.Value())
+
+			if err != nil {
+				return nil, err
+			}
+
+			previous = &rev.Sn
+		}
+
+		sn, err := nextSerial(g.cfg.SerialStrategy, previous, lastModifyIndex, g.currentTime)
+
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := json.Marshal(soaRevision{SnModifyIndex: lastModifyIndex, Sn: sn})
+
+		if err != nil {
+			return nil, err
+		}
+
+		ok, _, err := kv.AtomicPut(key, value, revEntryPair, nil)
+
+		if err != nil {
+			return nil, err
+		} else if ok {
+			return g.soaEntry(sn), nil
+		}
+	}
+
+	return nil, fmt.Errorf("The SOA entry of %s kept changing while bumping its serial", zone)
+}
+
+// parseRevision reads a revision, converting the deprecated date and
+// version fields
+func parseRevision(value []byte) (rev soaRevision, err error) {
+	if err = json.Unmarshal(value, &rev); err != nil {
+		return rev, err
+	}
+
+	if rev.Sn == 0 && rev.SnDate != 0 {
+		rev.Sn = formatSoaSn(rev.SnDate, rev.SnVersion)
+	}
+	rev.SnDate, rev.SnVersion = 0, 0
+
+	return rev, nil
+}
+
+func (g *Generator) lastModifyIndex(kv store.Store, zone string) (lastModifyIndex uint64, err error) {
+	prefix := fmt.Sprintf("zones/%s", zone)
+	pairs, err := kv.List(prefix)
+
+	if err != nil {
+		return 0, err
+	}
+
+	expander := template.NewExpander(kv)
+
+	for _, pair := range pairs {
+		if lastModifyIndex == 0 || pair.LastIndex() > lastModifyIndex {
+			lastModifyIndex = pair.LastIndex()
+		}
+
+		// records that use variables or references change with the keys
+		// they point to
+		payloads, _ := template.Payloads(pair.Value())
+
+		for _, payload := range payloads {
+			if !template.IsTemplate(payload) {
+				continue
+			}
+
+			if _, index, err := expander.Expand(payload); err == nil && index > lastModifyIndex {
+				lastModifyIndex = index
+			}
+		}
+	}
+
+	return lastModifyIndex, nil
+}
+
+func (g *Generator) soaEntry(sn uint32) *store.Entry {
 	soa := &soaEntry{NameServer: g.cfg.SoaNameServer,
 		EmailAddr: g.cfg.SoaEmailAddr,
-		Sn:        formatSoaSn(rev.SnDate, rev.SnVersion),
+		Sn:        sn,
 		Refresh:   g.cfg.SoaRefresh,
 		Retry:     g.cfg.SoaRetry,
 		Expiry:    g.cfg.SoaExpiry,
 		Nx:        g.cfg.SoaNx}
 
-	soaAsEntry := formatSoaEntry(soa, g.cfg.DefaultTTL)
-	return soaAsEntry, nil
+	return formatSoaEntry(soa, g.cfg.DefaultTTL)
 }
 
 func formatSoaSn(snDate int, snVersion uint32) (sn uint32) {
-	soaSnString := fmt.Sprintf("%d%02d", snDate, snVersion)
-	soaSnInt, err := strconv.Atoi(soaSnString)
-
-	if err != nil {
-		panic("error generating SoaSn")
-	}
-
-	return uint32(soaSnInt)
+	return uint32(snDate)*100 + snVersion
 }
 
 func formatSoaEntry(sEntry *soaEntry, ttl uint32) *store.Entry {
 	value := fmt.Sprintf("%s %s %d %d %d %d %d", sEntry.NameServer, sEntry.EmailAddr, sEntry.Sn, sEntry.Refresh, sEntry.Retry, sEntry.Expiry, sEntry.Nx)
 
-	return &store.Entry{"SOA", ttl, value}
+	return &store.Entry{Type: "SOA", Ttl: ttl, Payload: value}
 }
 
 func getDateFormatted(time time.Time) int {
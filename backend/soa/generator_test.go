@@ -2,6 +2,7 @@ package soa
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -25,7 +26,7 @@ func TestRetrieveOrCreateSOAEntry(t *testing.T) {
 
 	kv := &store.MockStore{ListFunc: listFunc, GetFunc: getFunc, AtomicPutFunc: atomicPutFunc}
 	time, _ := time.Parse("2006-01-02", "2016-05-04")
-	cfg := &GeneratorConfig{"ns.example.com.", "hostmaster.example.com.", 1200, 180, 1209600, 3600, 3600}
+	cfg := &GeneratorConfig{"ns.example.com.", "hostmaster.example.com.", 1200, 180, 1209600, 3600, 3600, "", ""}
 	generator := NewGenerator(cfg, time)
 
 	actual, err := generator.RetrieveOrCreateSOAEntry(kv, "example.com")
@@ -70,10 +71,12 @@ var tryToRetrieveOrCreateSOAEntryTests = []struct {
 	casResult              bool
 	expectedEntry          *store.Entry
 }{
-	{"example.com", "ns.example.com.", "hostmaster.example.com.", 3600, 0, nil, true, &store.Entry{"SOA", 3600, "ns.example.com. hostmaster.example.com. 2016050400 1200 180 1209600 3600"}},
-	{"example.com", "ns.example.com.", "hostmaster.example.com.", 3600, 2342, store.NewPair("", []byte("{\"SnModifyIndex\":2342,\"SnDate\":20160504,\"SnVersion\":1}"), 1234), true, &store.Entry{"SOA", 3600, "ns.example.com. hostmaster.example.com. 2016050401 1200 180 1209600 3600"}},
-	{"example.com", "ns.example.com.", "hostmaster.example.com.", 3600, 2343, store.NewPair("", []byte("{\"SnModifyIndex\":2342,\"SnDate\":20160504,\"SnVersion\":1}"), 1234), true, &store.Entry{"SOA", 3600, "ns.example.com. hostmaster.example.com. 2016050402 1200 180 1209600 3600"}},
+	{"example.com", "ns.example.com.", "hostmaster.example.com.", 3600, 0, nil, true, &store.Entry{Type: "SOA", Ttl: 3600, Payload: "ns.example.com. hostmaster.example.com. 2016050400 1200 180 1209600 3600"}},
+	{"example.com", "ns.example.com.", "hostmaster.example.com.", 3600, 2342, store.NewPair("", []byte("{\"SnModifyIndex\":2342,\"SnDate\":20160504,\"SnVersion\":1}"), 1234), true, &store.Entry{Type: "SOA", Ttl: 3600, Payload: "ns.example.com. hostmaster.example.com. 2016050401 1200 180 1209600 3600"}},
+	{"example.com", "ns.example.com.", "hostmaster.example.com.", 3600, 2343, store.NewPair("", []byte("{\"SnModifyIndex\":2342,\"SnDate\":20160504,\"SnVersion\":1}"), 1234), true, &store.Entry{Type: "SOA", Ttl: 3600, Payload: "ns.example.com. hostmaster.example.com. 2016050402 1200 180 1209600 3600"}},
 	{"example.com", "ns.example.com.", "hostmaster.example.com.", 3600, 2343, store.NewPair("", []byte("{\"SnModifyIndex\":2342,\"SnDate\":20160504,\"SnVersion\":1}"), 1234), false, nil},
+	{"example.com", "ns.example.com.", "hostmaster.example.com.", 3600, 2343, store.NewPair("", []byte("{\"SnModifyIndex\":2342,\"SnDate\":20160504,\"SnVersion\":99}"), 1234), true, &store.Entry{Type: "SOA", Ttl: 3600, Payload: "ns.example.com. hostmaster.example.com. 2016050500 1200 180 1209600 3600"}},
+	{"example.com", "ns.example.com.", "hostmaster.example.com.", 3600, 2343, store.NewPair("", []byte("{\"SnModifyIndex\":2342,\"Sn\":2016050599}"), 1234), true, &store.Entry{Type: "SOA", Ttl: 3600, Payload: "ns.example.com. hostmaster.example.com. 2016050600 1200 180 1209600 3600"}},
 }
 
 func TestTryToRetrieveOrCreateSOAEntry(t *testing.T) {
@@ -97,7 +100,7 @@ func TestTryToRetrieveOrCreateSOAEntry(t *testing.T) {
 
 		kv := &store.MockStore{ListFunc: listFunc, GetFunc: getFunc, AtomicPutFunc: atomicPutFunc}
 		time, _ := time.Parse("2006-01-02", "2016-05-04")
-		cfg := &GeneratorConfig{"ns.example.com.", "hostmaster.example.com.", 1200, 180, 1209600, 3600, 3600}
+		cfg := &GeneratorConfig{"ns.example.com.", "hostmaster.example.com.", 1200, 180, 1209600, 3600, 3600, "", ""}
 		generator := NewGenerator(cfg, time)
 		actual, err := generator.tryToRetrieveOrCreateSOAEntry(kv, tt.zone)
 
@@ -111,6 +114,81 @@ func TestTryToRetrieveOrCreateSOAEntry(t *testing.T) {
 	}
 }
 
+var soaModeTests = []struct {
+	mode             string
+	existingSoaEntry store.Pair
+	expectedSn       string
+}{
+	{ModeReadOnly, store.NewPair("", []byte("{\"SnModifyIndex\":2342,\"Sn\":2016050401}"), 1234), "2016050401"},
+	{ModeReadOnly, nil, "2343"},
+	{ModeModifyIndex, store.NewPair("", []byte("{\"SnModifyIndex\":2342,\"Sn\":2016050401}"), 1234), "2343"},
+}
+
+func TestTryToRetrieveOrCreateSOAEntryModes(t *testing.T) {
+	for _, tt := range soaModeTests {
+		listFunc := func(directory string) ([]store.Pair, error) {
+			return []store.Pair{
+				store.NewPair("", []byte{}, 2343),
+			}, nil
+		}
+
+		getFunc := func(key string) (store.Pair, error) {
+			if tt.mode == ModeModifyIndex {
+				t.Errorf("TestTryToRetrieveOrCreateSOAEntryModes: unexpected Get in mode %s", tt.mode)
+			}
+			if tt.existingSoaEntry == nil {
+				return nil, store.ErrKeyNotFound
+			}
+			return tt.existingSoaEntry, nil
+		}
+
+		atomicPutFunc := func(key string, value []byte, previous store.Pair, options *store.WriteOptions) (bool, store.Pair, error) {
+			t.Errorf("TestTryToRetrieveOrCreateSOAEntryModes: unexpected AtomicPut in mode %s", tt.mode)
+			return false, nil, nil
+		}
+
+		kv := &store.MockStore{ListFunc: listFunc, GetFunc: getFunc, AtomicPutFunc: atomicPutFunc}
+		time, _ := time.Parse("2006-01-02", "2016-05-04")
+		cfg := &GeneratorConfig{"ns.example.com.", "hostmaster.example.com.", 1200, 180, 1209600, 3600, 3600, "", tt.mode}
+		actual, err := NewGenerator(cfg, time).tryToRetrieveOrCreateSOAEntry(kv, "example.com")
+
+		expected := &store.Entry{Type: "SOA", Ttl: 3600, Payload: "ns.example.com. hostmaster.example.com. " + tt.expectedSn + " 1200 180 1209600 3600"}
+		if err != nil || !reflect.DeepEqual(actual, expected) {
+			t.Errorf("TestTryToRetrieveOrCreateSOAEntryModes: actual %v %v, expected %v", actual, err, expected)
+		}
+	}
+}
+
+func TestBumpSerial(t *testing.T) {
+	testCases := []struct {
+		mode       string
+		pairs      map[string]string
+		expectedSn string
+	}{
+		// the modify index did not change, the serial is bumped anyway
+		{ModeReadWrite, map[string]string{"zones/example.com/A": "[]", "soa/example.com": `{"SnModifyIndex":1,"Sn":2016050401}`}, "2016050402"},
+		{ModeReadOnly, map[string]string{"zones/example.com/A": "[]", "soa/example.com": `{"SnModifyIndex":1,"Sn":2016050401}`}, "2016050402"},
+		{ModeReadWrite, map[string]string{"zones/example.com/A": "[]"}, "2016050400"},
+		{ModeModifyIndex, map[string]string{"zones/example.com/A": "[]"}, "1"},
+	}
+
+	for _, tc := range testCases {
+		kv := store.NewMemoryStore(tc.pairs)
+		now, _ := time.Parse("2006-01-02", "2016-05-04")
+		cfg := &GeneratorConfig{"ns.example.com.", "hostmaster.example.com.", 1200, 180, 1209600, 3600, 3600, "", tc.mode}
+		actual, err := NewGenerator(cfg, now).BumpSerial(kv, "example.com")
+
+		expected := &store.Entry{Type: "SOA", Ttl: 3600, Payload: "ns.example.com. hostmaster.example.com. " + tc.expectedSn + " 1200 180 1209600 3600"}
+		if err != nil || !reflect.DeepEqual(actual, expected) {
+			t.Errorf("TestBumpSerial(%s): actual %v %v, expected %v", tc.mode, actual, err, expected)
+		}
+
+		if tc.mode != ModeModifyIndex && !strings.Contains(tc.pairs["soa/example.com"], tc.expectedSn) {
+			t.Errorf("TestBumpSerial(%s): actual revision %s, expected serial %s", tc.mode, tc.pairs["soa/example.com"], tc.expectedSn)
+		}
+	}
+}
+
 func TestFormatSoaSn(t *testing.T) {
 	actual := formatSoaSn(20160504, 01)
 
@@ -122,7 +200,7 @@ func TestFormatSoaSn(t *testing.T) {
 func TestFormatSoaEntry(t *testing.T) {
 	soaEntry := &soaEntry{"A", "B", 1, 2, 3, 4, 5}
 	actual := formatSoaEntry(soaEntry, 6)
-	expected := &store.Entry{"SOA", 6, "A B 1 2 3 4 5"}
+	expected := &store.Entry{Type: "SOA", Ttl: 6, Payload: "A B 1 2 3 4 5"}
 
 	if !reflect.DeepEqual(actual, expected) {
 		t.Errorf("TestFormatSoaEntry: actual %v, expected %v", actual, expected)
@@ -137,3 +215,26 @@ func TestGetDateFormatted(t *testing.T) {
 		t.Errorf("TestGetDateFormatted: actual %d, expected %d", actual, 20160504)
 	}
 }
+
+func TestLastModifyIndexFollowsTemplates(t *testing.T) {
+	listFunc := func(directory string) ([]store.Pair, error) {
+		return []store.Pair{
+			store.NewPair("zones/example.com/A", []byte("[{\"Payload\":\"{{ var \\\"lb-vip\\\" }}\"}]"), 10),
+			store.NewPair("zones/example.com/TXT", []byte("[{\"Payload\":\"{{ var \\\"missing\\\" }}\"}]"), 11),
+			store.NewPair("zones/example.com/MX", []byte("invalid_json"), 12),
+		}, nil
+	}
+	getFunc := func(key string) (store.Pair, error) {
+		if key == "vars/lb-vip" {
+			return store.NewPair(key, []byte("192.0.2.10"), 42), nil
+		}
+		return nil, store.ErrKeyNotFound
+	}
+	kv := &store.MockStore{ListFunc: listFunc, GetFunc: getFunc}
+
+	actual, err := (&Generator{}).lastModifyIndex(kv, "example.com")
+
+	if err != nil || actual != 42 {
+		t.Errorf("TestLastModifyIndexFollowsTemplates: actual %d %v, expected 42", actual, err)
+	}
+}
@@ -0,0 +1,68 @@
+package soa
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	SerialStrategyDate        = "date"        // YYYYMMDDnn
+	SerialStrategyUnixTime    = "unixtime"    // seconds since the epoch
+	SerialStrategyCounter     = "counter"     // 1, 2, 3, ...
+	SerialStrategyModifyIndex = "modifyindex" // the zone's highest modify index
+)
+
+func ValidateSerialStrategy(strategy string) error {
+	switch strategy {
+	case "", SerialStrategyDate, SerialStrategyUnixTime, SerialStrategyCounter, SerialStrategyModifyIndex:
+		return nil
+	}
+
+	return fmt.Errorf("Unsupported SOA serial strategy %s", strategy)
+}
+
+// nextSerial returns the serial following previous (nil for a new zone)
+// according to strategy. The result is always greater than previous in
+// terms of RFC 1982 serial number arithmetic: if the strategy's candidate is
+// not, previous is incremented by one instead. After 100 changes a day with
+// the date strategy, the serial moves on to the following date.
+func nextSerial(strategy string, previous *uint32, lastModifyIndex uint64, currentTime time.Time) (uint32, error) {
+	if err := ValidateSerialStrategy(strategy); err != nil {
+		return 0, err
+	}
+
+	var candidate uint32
+
+	switch strategy {
+	case "", SerialStrategyDate:
+		candidate = formatSoaSn(getDateFormatted(currentTime), 0)
+	case SerialStrategyUnixTime:
+		candidate = uint32(currentTime.Unix())
+	case SerialStrategyCounter:
+		candidate = 1
+		if previous != nil {
+			candidate = *previous + 1
+		}
+	case SerialStrategyModifyIndex:
+		candidate = uint32(lastModifyIndex)
+	}
+
+	if previous == nil || serialGreater(candidate, *previous) {
+		return candidate, nil
+	}
+
+	if strategy == "" || strategy == SerialStrategyDate {
+		if date, err := time.Parse("20060102", fmt.Sprint(*previous/100)); err == nil && *previous%100 == 99 {
+			return formatSoaSn(getDateFormatted(date.AddDate(0, 0, 1)), 0), nil
+		}
+	}
+
+	return *previous + 1, nil
+}
+
+// serialGreater implements the greater than comparison of RFC 1982 for
+// SERIAL_BITS = 32
+func serialGreater(s1 uint32, s2 uint32) bool {
+	const half = 1 << 31
+	return (s1 < s2 && s2-s1 > half) || (s1 > s2 && s1-s2 < half)
+}
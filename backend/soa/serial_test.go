@@ -0,0 +1,81 @@
+package soa
+
+import (
+	"testing"
+	"time"
+)
+
+func uint32Ptr(i uint32) *uint32 {
+	return &i
+}
+
+var nextSerialTests = []struct {
+	strategy        string
+	previous        *uint32
+	lastModifyIndex uint64
+	expected        uint32
+}{
+	{"", nil, 0, 2016050400},
+	{"date", nil, 0, 2016050400},
+	{"date", uint32Ptr(2016050301), 0, 2016050400},
+	{"date", uint32Ptr(2016050400), 0, 2016050401},
+	{"date", uint32Ptr(2016050499), 0, 2016050500},
+	{"date", uint32Ptr(2016050600), 0, 2016050601},
+	{"date", uint32Ptr(2016053199), 0, 2016060100},
+	{"date", uint32Ptr(2016123199), 0, 2017010100},
+	{"date", uint32Ptr(4000000000), 0, 4000000001},
+	{"unixtime", nil, 0, 1462320000},
+	{"unixtime", uint32Ptr(2016050400), 0, 2016050401},
+	{"unixtime", uint32Ptr(1462320000), 0, 1462320001},
+	{"counter", nil, 0, 1},
+	{"counter", uint32Ptr(41), 0, 42},
+	{"counter", uint32Ptr(4294967295), 0, 0},
+	{"modifyindex", nil, 2342, 2342},
+	{"modifyindex", uint32Ptr(2342), 2343, 2343},
+	{"modifyindex", uint32Ptr(2342), 1000, 2343},
+	{"modifyindex", uint32Ptr(4294967295), 4294967296 + 5, 5},
+}
+
+func TestNextSerial(t *testing.T) {
+	currentTime, _ := time.Parse("2006-01-02", "2016-05-04")
+
+	for _, tt := range nextSerialTests {
+		actual, err := nextSerial(tt.strategy, tt.previous, tt.lastModifyIndex, currentTime)
+
+		if err != nil {
+			t.Errorf("TestNextSerial: unexpected error %v", err)
+		}
+
+		if actual != tt.expected {
+			t.Errorf("TestNextSerial(%s, %v, %d): actual %d, expected %d", tt.strategy, tt.previous, tt.lastModifyIndex, actual, tt.expected)
+		}
+	}
+
+	if _, err := nextSerial("random", nil, 0, currentTime); err == nil {
+		t.Errorf("TestNextSerial: expected error for unsupported strategy")
+	}
+}
+
+var serialGreaterTests = []struct {
+	s1       uint32
+	s2       uint32
+	expected bool
+}{
+	{1, 0, true},
+	{0, 1, false},
+	{1, 1, false},
+	{0, 4294967295, true},
+	{4294967295, 0, false},
+	{2147483647, 0, true},
+	{2147483648, 0, false},
+	{0, 2147483648, false},
+}
+
+func TestSerialGreater(t *testing.T) {
+	for _, tt := range serialGreaterTests {
+		actual := serialGreater(tt.s1, tt.s2)
+		if actual != tt.expected {
+			t.Errorf("serialGreater(%d, %d): expected %v, actual %v", tt.s1, tt.s2, tt.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+const (
+	ConsistencyDefault    = "default"
+	ConsistencyStale      = "stale"
+	ConsistencyConsistent = "consistent"
+
+	DefaultConsulWaitTime = 5 * time.Minute
+	ConsulMaxTxnOps       = 64 // the limit of a Consul transaction
+)
+
+var errConsulAddressMissing = errors.New("consulapi requires exactly one address")
+
+func NewConsulStore(kvAddress []string, config *Config) (Store, error) {
+	if len(kvAddress) != 1 {
+		return nil, errConsulAddressMissing
+	}
+
+	if config == nil {
+		config = &Config{}
+	}
+
+	consulConfig := api.DefaultConfig()
+	consulConfig.Address = kvAddress[0]
+	consulConfig.Datacenter = config.Datacenter
+	consulConfig.Namespace = config.Namespace
+	consulConfig.Token = config.Token
+
+	if config.TLS != nil {
+		transport := cleanhttp.DefaultPooledTransport()
+		transport.TLSClientConfig = config.TLS
+		consulConfig.Transport = transport
+		consulConfig.Scheme = "https"
+	}
+
+	if config.Username != "" {
+		consulConfig.HttpAuth = &api.HttpBasicAuth{Username: config.Username, Password: config.Password}
+	}
+
+	queryOptions := api.QueryOptions{}
+
+	switch config.Consistency {
+	case "", ConsistencyDefault:
+	case ConsistencyStale:
+		queryOptions.AllowStale = true
+	case ConsistencyConsistent:
+		queryOptions.RequireConsistent = true
+	default:
+		return nil, fmt.Errorf("Unsupported consistency mode %s", config.Consistency)
+	}
+
+	client, err := api.NewClient(consulConfig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConsulStore{client.KV(), queryOptions}, nil
+}
+
+type ConsulStore struct {
+	kv           *api.KV
+	queryOptions api.QueryOptions
+}
+
+func (s *ConsulStore) Get(key string) (Pair, error) {
+	pair, _, err := s.kv.Get(normalizeKey(key), s.options())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if pair == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return &PairImpl{pair.Key, pair.Value, pair.ModifyIndex}, nil
+}
+
+func (s *ConsulStore) Put(key string, value []byte, options *WriteOptions) error {
+	_, err := s.kv.Put(&api.KVPair{Key: normalizeKey(key), Value: value}, nil)
+	return err
+}
+
+func (s *ConsulStore) List(directory string) ([]Pair, error) {
+	pairs, _, err := s.BlockingList(directory, 0, 0)
+	return pairs, err
+}
+
+// BlockingList lists the directory like List. If waitIndex is not zero, the
+// request blocks until the directory's index (X-Consul-Index) has moved past
+// waitIndex or waitTime is over. The returned index is to be used as the
+// waitIndex of the next call.
+func (s *ConsulStore) BlockingList(directory string, waitIndex uint64, waitTime time.Duration) ([]Pair, uint64, error) {
+	options := s.options()
+	options.WaitIndex = waitIndex
+	options.WaitTime = waitTime
+
+	kvPairs, meta, err := s.kv.List(directoryPrefix(directory), options)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(kvPairs) == 0 {
+		return nil, meta.LastIndex, ErrKeyNotFound
+	}
+
+	pairs := make([]Pair, len(kvPairs))
+
+	for i, pair := range kvPairs {
+		pairs[i] = &PairImpl{pair.Key, pair.Value, pair.ModifyIndex}
+	}
+
+	return pairs, meta.LastIndex, nil
+}
+
+func (s *ConsulStore) AtomicPut(key string, value []byte, previous Pair, options *WriteOptions) (bool, Pair, error) {
+	pair := &api.KVPair{Key: normalizeKey(key), Value: value}
+
+	if previous != nil {
+		pair.ModifyIndex = previous.LastIndex()
+	} // else consul interprets ModifyIndex = 0 as a new key
+
+	ok, _, err := s.kv.CAS(pair, nil)
+
+	if err != nil || !ok {
+		return false, nil, err
+	}
+
+	// the CAS response does not contain the new index, so read the key back
+	// from the leader
+	current, _, err := s.kv.Get(pair.Key, &api.QueryOptions{RequireConsistent: true})
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	if current == nil {
+		return false, nil, ErrKeyNotFound
+	}
+
+	return true, &PairImpl{current.Key, current.Value, current.ModifyIndex}, nil
+}
+
+func (s *ConsulStore) AtomicDelete(key string, previous Pair) (bool, error) {
+	ok, _, err := s.kv.DeleteCAS(&api.KVPair{Key: normalizeKey(key), ModifyIndex: previous.LastIndex()}, nil)
+	return ok, err
+}
+
+func (s *ConsulStore) AtomicTxn(ops []*TxnOp) (bool, error) {
+	if err := validateTxn(ops); err != nil {
+		return false, err
+	}
+
+	if len(ops) > ConsulMaxTxnOps {
+		return false, ErrTxnTooLarge
+	}
+
+	txn := make(api.KVTxnOps, len(ops))
+
+	for i, op := range ops {
+		txn[i] = &api.KVTxnOp{Verb: api.KVCAS, Key: normalizeKey(op.Key), Value: op.Value}
+
+		if op.Delete {
+			txn[i].Verb = api.KVDeleteCAS
+		}
+
+		if op.Previous != nil {
+			txn[i].Index = op.Previous.LastIndex()
+		} // else consul interprets Index = 0 as a new key
+	}
+
+	// a failed check is answered with 409 and ok is false
+	ok, _, _, err := s.kv.Txn(txn, nil)
+	return ok, err
+}
+
+func (s *ConsulStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []Pair, error) {
+	pairs, index, err := s.BlockingList(directory, 0, 0)
+
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+
+	resultChan := make(chan []Pair)
+
+	go func() {
+		defer close(resultChan)
+
+		for {
+			select {
+			case resultChan <- pairs:
+			case <-stopCh:
+				return
+			}
+
+			lastIndex := index
+
+			for index == lastIndex {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+
+				pairs, index, err = s.BlockingList(directory, lastIndex, DefaultConsulWaitTime)
+
+				if err != nil && err != ErrKeyNotFound {
+					return
+				}
+			}
+		}
+	}()
+
+	return resultChan, nil
+}
+
+func (s *ConsulStore) options() *api.QueryOptions {
+	options := s.queryOptions
+	return &options
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestConsulStore(t *testing.T, handler http.HandlerFunc, config *Config) Store {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	kv, err := NewConsulStore([]string{strings.TrimPrefix(server.URL, "http://")}, config)
+
+	if err != nil {
+		t.Fatalf("newTestConsulStore: unexpected error %v", err)
+	}
+
+	return kv
+}
+
+var consulQueryTests = []struct {
+	config   *Config
+	expected []string
+	absent   []string
+}{
+	{nil, []string{"recurse"}, []string{"stale", "consistent", "dc", "ns"}},
+	{&Config{Consistency: ConsistencyStale}, []string{"stale"}, []string{"consistent"}},
+	{&Config{Consistency: ConsistencyConsistent}, []string{"consistent"}, []string{"stale"}},
+	{&Config{Datacenter: "dc2", Namespace: "dns"}, []string{"dc", "ns"}, []string{"stale"}},
+}
+
+func TestConsulStoreList(t *testing.T) {
+	for _, tt := range consulQueryTests {
+		kv := newTestConsulStore(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/kv/zones/example.com/" {
+				t.Errorf("TestConsulStoreList: actual path %s, expected /v1/kv/zones/example.com/", r.URL.Path)
+			}
+
+			query := r.URL.Query()
+			for _, param := range tt.expected {
+				if _, ok := query[param]; !ok {
+					t.Errorf("TestConsulStoreList: expected query parameter %s in %s", param, r.URL.RawQuery)
+				}
+			}
+			for _, param := range tt.absent {
+				if _, ok := query[param]; ok {
+					t.Errorf("TestConsulStoreList: unexpected query parameter %s in %s", param, r.URL.RawQuery)
+				}
+			}
+
+			w.Header().Set("X-Consul-Index", "42")
+			w.Write([]byte(`[{"Key":"zones/example.com/A","Value":"VmFsdWU=","ModifyIndex":23}]`))
+		}, tt.config)
+
+		pairs, err := kv.List("zones/example.com")
+
+		if err != nil {
+			t.Errorf("TestConsulStoreList: unexpected error %v", err)
+		}
+
+		if len(pairs) != 1 || pairs[0].Key() != "zones/example.com/A" || string(pairs[0].Value()) != "Value" || pairs[0].LastIndex() != 23 {
+			t.Errorf("TestConsulStoreList: unexpected pairs %v", pairs)
+		}
+	}
+}
+
+func TestConsulStoreBlockingList(t *testing.T) {
+	kv := newTestConsulStore(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "42" || r.URL.Query().Get("wait") != "10000ms" {
+			t.Errorf("TestConsulStoreBlockingList: unexpected query %s", r.URL.RawQuery)
+		}
+
+		w.Header().Set("X-Consul-Index", "43")
+		w.Write([]byte(`[{"Key":"zones/example.com/A","Value":"VmFsdWU=","ModifyIndex":43}]`))
+	}, nil)
+
+	_, index, err := kv.(*ConsulStore).BlockingList("zones/example.com", 42, 10*time.Second)
+
+	if err != nil || index != 43 {
+		t.Errorf("TestConsulStoreBlockingList: actual %d %v, expected 43 <nil>", index, err)
+	}
+}
+
+func TestConsulStoreGet(t *testing.T) {
+	kv := newTestConsulStore(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}, nil)
+
+	_, err := kv.Get("soa/example.com")
+
+	if err != ErrKeyNotFound {
+		t.Errorf("TestConsulStoreGet: actual %v, expected %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestConsulStoreAtomicPut(t *testing.T) {
+	kv := newTestConsulStore(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			t.Errorf("TestConsulStoreAtomicPut: unexpected %s request", r.Method)
+		}
+
+		if r.URL.Query().Get("cas") != "23" {
+			t.Errorf("TestConsulStoreAtomicPut: actual cas %s, expected 23", r.URL.Query().Get("cas"))
+		}
+
+		w.Write([]byte("false"))
+	}, nil)
+
+	ok, pair, err := kv.AtomicPut("soa/example.com", []byte("Value"), NewPair("soa/example.com", []byte{}, 23), nil)
+
+	if ok || pair != nil || err != nil {
+		t.Errorf("TestConsulStoreAtomicPut: actual %v %v %v, expected false <nil> <nil>", ok, pair, err)
+	}
+}
+
+func TestConsulStoreAtomicDelete(t *testing.T) {
+	kv := newTestConsulStore(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" || r.URL.Path != "/v1/kv/zones/example.com/A" {
+			t.Errorf("TestConsulStoreAtomicDelete: unexpected %s request for %s", r.Method, r.URL.Path)
+		}
+
+		if r.URL.Query().Get("cas") != "23" {
+			t.Errorf("TestConsulStoreAtomicDelete: actual cas %s, expected 23", r.URL.Query().Get("cas"))
+		}
+
+		w.Write([]byte("true"))
+	}, nil)
+
+	ok, err := kv.AtomicDelete("zones/example.com/A", NewPair("zones/example.com/A", []byte{}, 23))
+
+	if !ok || err != nil {
+		t.Errorf("TestConsulStoreAtomicDelete: actual %v %v, expected true <nil>", ok, err)
+	}
+}
+
+func TestConsulStoreAtomicTxn(t *testing.T) {
+	status := http.StatusConflict
+
+	kv := newTestConsulStore(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/v1/txn" {
+			t.Errorf("TestConsulStoreAtomicTxn: unexpected %s request for %s", r.Method, r.URL.Path)
+		}
+
+		var ops []struct {
+			KV struct {
+				Verb, Key string
+				Index     uint64
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&ops)
+
+		if len(ops) != 2 || ops[0].KV.Verb != "cas" || ops[0].KV.Index != 0 || ops[1].KV.Verb != "delete-cas" || ops[1].KV.Key != "zones/example.com/A" || ops[1].KV.Index != 23 {
+			t.Errorf("TestConsulStoreAtomicTxn: unexpected operations %+v", ops)
+		}
+
+		w.WriteHeader(status)
+		w.Write([]byte(`{"Results":null,"Errors":[]}`))
+	}, nil)
+
+	ops := []*TxnOp{
+		{Key: "zones/example.com/www/A", Value: []byte("Value")},
+		{Key: "zones/example.com/A", Delete: true, Previous: NewPair("zones/example.com/A", []byte{}, 23)},
+	}
+
+	if ok, err := kv.AtomicTxn(ops); ok || err != nil {
+		t.Errorf("TestConsulStoreAtomicTxn: actual %v %v, expected false <nil>", ok, err)
+	}
+
+	status = http.StatusOK
+
+	if ok, err := kv.AtomicTxn(ops); !ok || err != nil {
+		t.Errorf("TestConsulStoreAtomicTxn: actual %v %v, expected true <nil>", ok, err)
+	}
+
+	var tooLarge []*TxnOp
+	for i := 0; i <= ConsulMaxTxnOps; i++ {
+		tooLarge = append(tooLarge, &TxnOp{Key: fmt.Sprintf("zones/example.com/host%d/A", i), Value: []byte("Value")})
+	}
+
+	if ok, err := kv.AtomicTxn(tooLarge); ok || err != ErrTxnTooLarge {
+		t.Errorf("TestConsulStoreAtomicTxn: actual %v %v, expected false %v", ok, err, ErrTxnTooLarge)
+	}
+}
+
+func TestNewConsulStore(t *testing.T) {
+	if _, err := NewConsulStore([]string{"127.0.0.1:8500"}, &Config{Consistency: "eventual"}); err == nil {
+		t.Errorf("TestNewConsulStore: expected error for unsupported consistency mode")
+	}
+
+	if _, err := NewConsulStore([]string{}, nil); err == nil {
+		t.Errorf("TestNewConsulStore: expected error for missing address")
+	}
+}
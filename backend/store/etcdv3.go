@@ -0,0 +1,215 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+const DefaultEtcdV3Timeout = 5 * time.Second
+
+func NewEtcdV3Store(endpoints []string, config *Config) (Store, error) {
+	etcdConfig := clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: DefaultEtcdV3Timeout,
+	}
+
+	if config != nil {
+		if config.ConnectionTimeout != 0 {
+			etcdConfig.DialTimeout = config.ConnectionTimeout
+		}
+		etcdConfig.TLS = config.TLS
+		etcdConfig.Username = config.Username
+		etcdConfig.Password = config.Password
+	}
+
+	client, err := clientv3.New(etcdConfig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &EtcdV3Store{client.KV, client.Watcher, etcdConfig.DialTimeout}, nil
+}
+
+type EtcdV3Store struct {
+	client  clientv3.KV
+	watcher clientv3.Watcher
+	timeout time.Duration
+}
+
+func (s *EtcdV3Store) Get(key string) (Pair, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	resp, err := s.client.Get(ctx, normalizeKey(key))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	kv := resp.Kvs[0]
+	return &PairImpl{string(kv.Key), kv.Value, uint64(kv.ModRevision)}, nil
+}
+
+func (s *EtcdV3Store) Put(key string, value []byte, options *WriteOptions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.client.Put(ctx, normalizeKey(key), string(value))
+	return err
+}
+
+func (s *EtcdV3Store) List(directory string) ([]Pair, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	pairs, _, err := s.list(ctx, directory)
+	return pairs, err
+}
+
+func (s *EtcdV3Store) AtomicPut(key string, value []byte, previous Pair, options *WriteOptions) (bool, Pair, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	key = normalizeKey(key)
+
+	var cmp clientv3.Cmp
+	if previous == nil {
+		cmp = clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	} else {
+		cmp = clientv3.Compare(clientv3.ModRevision(key), "=", int64(previous.LastIndex()))
+	}
+
+	resp, err := s.client.Txn(ctx).If(cmp).Then(clientv3.OpPut(key, string(value))).Commit()
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	if !resp.Succeeded {
+		return false, nil, nil
+	}
+
+	return true, &PairImpl{key, value, uint64(resp.Header.Revision)}, nil
+}
+
+func (s *EtcdV3Store) AtomicDelete(key string, previous Pair) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	key = normalizeKey(key)
+	cmp := clientv3.Compare(clientv3.ModRevision(key), "=", int64(previous.LastIndex()))
+	resp, err := s.client.Txn(ctx).If(cmp).Then(clientv3.OpDelete(key)).Commit()
+
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Succeeded, nil
+}
+
+func (s *EtcdV3Store) AtomicTxn(ops []*TxnOp) (bool, error) {
+	if err := validateTxn(ops); err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	cmps := make([]clientv3.Cmp, len(ops))
+	writes := make([]clientv3.Op, len(ops))
+
+	for i, op := range ops {
+		key := normalizeKey(op.Key)
+
+		if op.Previous == nil {
+			cmps[i] = clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+		} else {
+			cmps[i] = clientv3.Compare(clientv3.ModRevision(key), "=", int64(op.Previous.LastIndex()))
+		}
+
+		if op.Delete {
+			writes[i] = clientv3.OpDelete(key)
+		} else {
+			writes[i] = clientv3.OpPut(key, string(op.Value))
+		}
+	}
+
+	resp, err := s.client.Txn(ctx).If(cmps...).Then(writes...).Commit()
+
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Succeeded, nil
+}
+
+func (s *EtcdV3Store) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []Pair, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	pairs, revision, err := s.list(ctx, directory)
+
+	if err != nil && err != ErrKeyNotFound {
+		cancel()
+		return nil, err
+	}
+
+	watchChan := s.watcher.Watch(ctx, directoryPrefix(directory), clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+	resultChan := make(chan []Pair)
+
+	go func() {
+		defer cancel()
+		defer close(resultChan)
+
+		for {
+			select {
+			case resultChan <- pairs:
+			case <-stopCh:
+				return
+			}
+
+			select {
+			case resp, ok := <-watchChan:
+				if !ok || resp.Err() != nil {
+					return
+				}
+			case <-stopCh:
+				return
+			}
+
+			pairs, _, err = s.list(ctx, directory)
+
+			if err != nil && err != ErrKeyNotFound {
+				return
+			}
+		}
+	}()
+
+	return resultChan, nil
+}
+
+func (s *EtcdV3Store) list(ctx context.Context, directory string) ([]Pair, int64, error) {
+	resp, err := s.client.Get(ctx, directoryPrefix(directory), clientv3.WithPrefix())
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, resp.Header.Revision, ErrKeyNotFound
+	}
+
+	pairs := make([]Pair, len(resp.Kvs))
+
+	for i, kv := range resp.Kvs {
+		pairs[i] = &PairImpl{string(kv.Key), kv.Value, uint64(kv.ModRevision)}
+	}
+
+	return pairs, resp.Header.Revision, nil
+}
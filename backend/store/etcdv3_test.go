@@ -0,0 +1,280 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// fakeEtcd keeps keys in memory with etcd's revisions and implements the
+// parts of clientv3.KV and clientv3.Watcher used by EtcdV3Store
+type fakeEtcd struct {
+	revision int64
+	kvs      map[string]*mvccpb.KeyValue
+	watches  chan clientv3.WatchResponse
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{revision: 1, kvs: make(map[string]*mvccpb.KeyValue), watches: make(chan clientv3.WatchResponse)}
+}
+
+func (f *fakeEtcd) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: f.revision}
+}
+
+func (f *fakeEtcd) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	f.apply(clientv3.OpPut(key, val))
+	return &clientv3.PutResponse{Header: f.header()}, nil
+}
+
+func (f *fakeEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	op := clientv3.OpGet(key, opts...)
+	start, end := string(op.KeyBytes()), string(op.RangeBytes())
+	resp := &clientv3.GetResponse{Header: f.header()}
+
+	for curKey, kv := range f.kvs {
+		if curKey == start || (end != "" && curKey >= start && (end == "\x00" || curKey < end)) {
+			resp.Kvs = append(resp.Kvs, kv)
+		}
+	}
+
+	sort.Slice(resp.Kvs, func(i, j int) bool { return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key) })
+	return resp, nil
+}
+
+func (f *fakeEtcd) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	f.apply(clientv3.OpDelete(key))
+	return &clientv3.DeleteResponse{Header: f.header()}, nil
+}
+
+func (f *fakeEtcd) Compact(ctx context.Context, rev int64, opts ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
+	return nil, errors.New("not supported")
+}
+
+func (f *fakeEtcd) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	return clientv3.OpResponse{}, errors.New("not supported")
+}
+
+func (f *fakeEtcd) Txn(ctx context.Context) clientv3.Txn {
+	return &fakeTxn{etcd: f}
+}
+
+func (f *fakeEtcd) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	return f.watches
+}
+
+func (f *fakeEtcd) RequestProgress(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeEtcd) Close() error {
+	return nil
+}
+
+func (f *fakeEtcd) apply(op clientv3.Op) {
+	f.revision++
+	key := string(op.KeyBytes())
+
+	if op.IsDelete() {
+		delete(f.kvs, key)
+		return
+	}
+
+	kv := &mvccpb.KeyValue{Key: []byte(key), Value: op.ValueBytes(), CreateRevision: f.revision, ModRevision: f.revision}
+	if previous, ok := f.kvs[key]; ok {
+		kv.CreateRevision = previous.CreateRevision
+	}
+
+	f.kvs[key] = kv
+}
+
+type fakeTxn struct {
+	etcd *fakeEtcd
+	cmps []clientv3.Cmp
+	ops  []clientv3.Op
+}
+
+func (txn *fakeTxn) If(cmps ...clientv3.Cmp) clientv3.Txn {
+	txn.cmps = cmps
+	return txn
+}
+
+func (txn *fakeTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	txn.ops = ops
+	return txn
+}
+
+func (txn *fakeTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	return txn
+}
+
+func (txn *fakeTxn) Commit() (*clientv3.TxnResponse, error) {
+	for _, cmp := range txn.cmps {
+		var actual, expected int64
+
+		if kv, ok := txn.etcd.kvs[string(cmp.Key)]; ok {
+			actual = kv.ModRevision
+			if cmp.Target == pb.Compare_CREATE {
+				actual = kv.CreateRevision
+			}
+		}
+
+		switch target := cmp.TargetUnion.(type) {
+		case *pb.Compare_CreateRevision:
+			expected = target.CreateRevision
+		case *pb.Compare_ModRevision:
+			expected = target.ModRevision
+		}
+
+		if cmp.Result != pb.Compare_EQUAL || actual != expected {
+			return &clientv3.TxnResponse{Header: txn.etcd.header(), Succeeded: false}, nil
+		}
+	}
+
+	for _, op := range txn.ops {
+		txn.etcd.apply(op)
+	}
+
+	return &clientv3.TxnResponse{Header: txn.etcd.header(), Succeeded: true}, nil
+}
+
+func keysOf(pairs []Pair) []string {
+	var keys []string
+	for _, pair := range pairs {
+		keys = append(keys, pair.Key())
+	}
+	return keys
+}
+
+func TestEtcdV3StoreGetList(t *testing.T) {
+	fake := newFakeEtcd()
+	kv := &EtcdV3Store{fake, fake, time.Second}
+
+	if _, err := kv.Get("zones/example.com/A"); err != ErrKeyNotFound {
+		t.Errorf("TestEtcdV3StoreGetList: actual %v, expected %v", err, ErrKeyNotFound)
+	}
+
+	if _, err := kv.List("zones"); err != ErrKeyNotFound {
+		t.Errorf("TestEtcdV3StoreGetList: actual %v, expected %v", err, ErrKeyNotFound)
+	}
+
+	for _, key := range []string{"/zones/example.com/A", "zones/example.com/sub/A", "zones/example.com.au/A"} {
+		if err := kv.Put(key, []byte("Value"), nil); err != nil {
+			t.Fatalf("TestEtcdV3StoreGetList: unexpected error %v", err)
+		}
+	}
+
+	pair, err := kv.Get("zones/example.com/A")
+
+	if expected := NewPair("zones/example.com/A", []byte("Value"), 2); err != nil || !reflect.DeepEqual(pair, expected) {
+		t.Errorf("TestEtcdV3StoreGetList: actual %v %v, expected %v", pair, err, expected)
+	}
+
+	pairs, err := kv.List("zones/example.com")
+
+	if expected := []string{"zones/example.com/A", "zones/example.com/sub/A"}; err != nil || !reflect.DeepEqual(keysOf(pairs), expected) {
+		t.Errorf("TestEtcdV3StoreGetList: actual %v %v, expected %v", keysOf(pairs), err, expected)
+	}
+}
+
+func TestEtcdV3StoreAtomic(t *testing.T) {
+	fake := newFakeEtcd()
+	kv := &EtcdV3Store{fake, fake, time.Second}
+
+	ok, created, err := kv.AtomicPut("zones/example.com/A", []byte("Value"), nil, nil)
+
+	if !ok || err != nil || created.LastIndex() != 2 {
+		t.Errorf("TestEtcdV3StoreAtomic: actual %v %v %v on create, expected true with index 2", ok, created, err)
+	}
+
+	ok, pair, err := kv.AtomicPut("zones/example.com/A", []byte("Other"), nil, nil)
+
+	if ok || pair != nil || err != nil {
+		t.Errorf("TestEtcdV3StoreAtomic: actual %v %v %v on existing key, expected false <nil> <nil>", ok, pair, err)
+	}
+
+	stale := NewPair("zones/example.com/A", []byte("Value"), 1)
+	ok, pair, err = kv.AtomicPut("zones/example.com/A", []byte("Other"), stale, nil)
+
+	if ok || pair != nil || err != nil {
+		t.Errorf("TestEtcdV3StoreAtomic: actual %v %v %v on lost CAS, expected false <nil> <nil>", ok, pair, err)
+	}
+
+	ok, updated, err := kv.AtomicPut("zones/example.com/A", []byte("Other"), created, nil)
+
+	if !ok || err != nil || updated.LastIndex() != 3 || string(fake.kvs["zones/example.com/A"].Value) != "Other" {
+		t.Errorf("TestEtcdV3StoreAtomic: actual %v %v %v on update, expected true with index 3", ok, updated, err)
+	}
+
+	if ok, err = kv.AtomicDelete("zones/example.com/A", created); ok || err != nil {
+		t.Errorf("TestEtcdV3StoreAtomic: actual %v %v on lost CAS delete, expected false <nil>", ok, err)
+	}
+
+	if ok, err = kv.AtomicDelete("zones/example.com/A", updated); !ok || err != nil || len(fake.kvs) != 0 {
+		t.Errorf("TestEtcdV3StoreAtomic: actual %v %v %v on delete, expected true <nil> and no keys", ok, err, fake.kvs)
+	}
+}
+
+func TestEtcdV3StoreAtomicTxn(t *testing.T) {
+	fake := newFakeEtcd()
+	kv := &EtcdV3Store{fake, fake, time.Second}
+	kv.Put("zones/example.com/A", []byte("Value"), nil)
+	current, _ := kv.Get("zones/example.com/A")
+
+	ops := []*TxnOp{
+		{Key: "zones/example.com/www/A", Value: []byte("Value")},
+		{Key: "zones/example.com/A", Delete: true, Previous: NewPair(current.Key(), current.Value(), current.LastIndex()+1)},
+	}
+
+	if ok, err := kv.AtomicTxn(ops); ok || err != nil || len(fake.kvs) != 1 {
+		t.Errorf("TestEtcdV3StoreAtomicTxn: actual %v %v %v on lost CAS, expected false <nil> and no change", ok, err, fake.kvs)
+	}
+
+	ops[1].Previous = current
+
+	if ok, err := kv.AtomicTxn(ops); !ok || err != nil || fake.kvs["zones/example.com/A"] != nil || fake.kvs["zones/example.com/www/A"] == nil {
+		t.Errorf("TestEtcdV3StoreAtomicTxn: actual %v %v %v, expected www to be created and the apex deleted", ok, err, fake.kvs)
+	}
+
+	if _, err := kv.AtomicTxn([]*TxnOp{{Key: "zones/example.com/A", Delete: true}}); err == nil {
+		t.Errorf("TestEtcdV3StoreAtomicTxn: expected an error for a delete without previous pair")
+	}
+}
+
+func TestEtcdV3StoreWatchTree(t *testing.T) {
+	fake := newFakeEtcd()
+	kv := &EtcdV3Store{fake, fake, time.Second}
+	kv.Put("zones/example.com/A", []byte("Value"), nil)
+
+	stopCh := make(chan struct{})
+	watchChan, err := kv.WatchTree("zones", stopCh)
+
+	if err != nil {
+		t.Fatalf("TestEtcdV3StoreWatchTree: unexpected error %v", err)
+	}
+
+	if pairs := <-watchChan; !reflect.DeepEqual(keysOf(pairs), []string{"zones/example.com/A"}) {
+		t.Errorf("TestEtcdV3StoreWatchTree: actual %v, expected the initial keys", keysOf(pairs))
+	}
+
+	kv.Put("zones/example.com/www/A", []byte("Value"), nil)
+	fake.watches <- clientv3.WatchResponse{}
+
+	if pairs := <-watchChan; strings.Join(keysOf(pairs), " ") != "zones/example.com/A zones/example.com/www/A" {
+		t.Errorf("TestEtcdV3StoreWatchTree: actual %v, expected the changed keys", keysOf(pairs))
+	}
+
+	close(stopCh)
+
+	if _, ok := <-watchChan; ok {
+		t.Errorf("TestEtcdV3StoreWatchTree: expected the channel to be closed after stopping")
+	}
+}
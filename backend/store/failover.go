@@ -0,0 +1,132 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+const DefaultFailoverRetryInterval = 30 * time.Second
+
+// FailoverStore holds an ordered list of stores containing the same data.
+// Every read goes to the first healthy store. A store that returns an error
+// is considered unhealthy and skipped for retryInterval, after which it is
+// tried again. If no store is healthy, all of them are tried in order.
+//
+// Writes only go to the first store, the primary. A replica may lag behind
+// or refuse writes, and a write applied to it would not reach the primary,
+// so the stores would diverge. While the primary is down writes fail.
+type FailoverStore struct {
+	stores         []Store
+	retryInterval  time.Duration
+	unhealthyUntil []time.Time
+	mutex          sync.Mutex
+	now            func() time.Time
+}
+
+func NewFailoverStore(stores []Store, retryInterval time.Duration) Store {
+	if retryInterval == 0 {
+		retryInterval = DefaultFailoverRetryInterval
+	}
+
+	return &FailoverStore{stores: stores, retryInterval: retryInterval, unhealthyUntil: make([]time.Time, len(stores)), now: time.Now}
+}
+
+func (s *FailoverStore) Get(key string) (pair Pair, err error) {
+	err = s.do(func(kv Store) (err error) {
+		pair, err = kv.Get(key)
+		return err
+	})
+
+	return pair, err
+}
+
+func (s *FailoverStore) Put(key string, value []byte, options *WriteOptions) error {
+	return s.stores[0].Put(key, value, options)
+}
+
+func (s *FailoverStore) List(directory string) (pairs []Pair, err error) {
+	err = s.do(func(kv Store) (err error) {
+		pairs, err = kv.List(directory)
+		return err
+	})
+
+	return pairs, err
+}
+
+func (s *FailoverStore) AtomicPut(key string, value []byte, previous Pair, options *WriteOptions) (bool, Pair, error) {
+	return s.stores[0].AtomicPut(key, value, previous, options)
+}
+
+func (s *FailoverStore) AtomicDelete(key string, previous Pair) (bool, error) {
+	return s.stores[0].AtomicDelete(key, previous)
+}
+
+func (s *FailoverStore) AtomicTxn(ops []*TxnOp) (bool, error) {
+	return s.stores[0].AtomicTxn(ops)
+}
+
+func (s *FailoverStore) WatchTree(directory string, stopCh <-chan struct{}) (watchChan <-chan []Pair, err error) {
+	err = s.do(func(kv Store) (err error) {
+		watchChan, err = kv.WatchTree(directory, stopCh)
+		return err
+	})
+
+	return watchChan, err
+}
+
+func (s *FailoverStore) do(operation func(Store) error) (err error) {
+	for _, i := range s.candidates() {
+		err = operation(s.stores[i])
+
+		if err == nil || err == ErrKeyNotFound {
+			s.markHealthy(i)
+			return err
+		}
+
+		s.markUnhealthy(i, err)
+	}
+
+	return err
+}
+
+func (s *FailoverStore) candidates() []int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	healthy := make([]int, 0, len(s.stores))
+	var unhealthy []int
+
+	for i, until := range s.unhealthyUntil {
+		if now.Before(until) {
+			unhealthy = append(unhealthy, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+func (s *FailoverStore) markHealthy(i int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.unhealthyUntil[i].IsZero() {
+		logging.Info("Store recovered", "store", i+1, "stores", len(s.stores))
+		s.unhealthyUntil[i] = time.Time{}
+	}
+}
+
+func (s *FailoverStore) markUnhealthy(i int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.unhealthyUntil[i].IsZero() {
+		logging.Warn("Store failed, failing over", "store", i+1, "stores", len(s.stores), "error", err)
+	}
+
+	s.unhealthyUntil[i] = s.now().Add(s.retryInterval)
+}
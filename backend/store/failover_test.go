@@ -0,0 +1,134 @@
+package store
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFailoverStore(t *testing.T) {
+	var (
+		primaryDown bool
+		calls       []string
+	)
+
+	primary := &MockStore{GetFunc: func(key string) (Pair, error) {
+		calls = append(calls, "primary")
+		if primaryDown {
+			return nil, errors.New("connection refused")
+		}
+		return NewPair(key, []byte("primary"), 1), nil
+	}}
+	replica := &MockStore{GetFunc: func(key string) (Pair, error) {
+		calls = append(calls, "replica")
+		return NewPair(key, []byte("replica"), 1), nil
+	}}
+
+	now := time.Unix(0, 0)
+	kv := NewFailoverStore([]Store{primary, replica}, time.Minute).(*FailoverStore)
+	kv.now = func() time.Time { return now }
+
+	var failoverTests = []struct {
+		primaryDown   bool
+		elapsed       time.Duration
+		expectedValue string
+		expectedCalls []string
+	}{
+		{false, 0, "primary", []string{"primary"}},
+		{true, 0, "replica", []string{"primary", "replica"}},
+		{true, 20 * time.Second, "replica", []string{"replica"}},
+		{false, 20 * time.Second, "replica", []string{"replica"}},
+		{false, 20 * time.Second, "primary", []string{"primary"}},
+		{false, 0, "primary", []string{"primary"}},
+	}
+
+	for i, tt := range failoverTests {
+		primaryDown = tt.primaryDown
+		now = now.Add(tt.elapsed)
+		calls = nil
+
+		pair, err := kv.Get("zones/example.com/A")
+
+		if err != nil {
+			t.Errorf("TestFailoverStore %d: unexpected error %v", i, err)
+			continue
+		}
+
+		if string(pair.Value()) != tt.expectedValue {
+			t.Errorf("TestFailoverStore %d: actual %s, expected %s", i, pair.Value(), tt.expectedValue)
+		}
+
+		if !reflect.DeepEqual(calls, tt.expectedCalls) {
+			t.Errorf("TestFailoverStore %d: actual calls %v, expected %v", i, calls, tt.expectedCalls)
+		}
+	}
+}
+
+func TestFailoverStoreWrites(t *testing.T) {
+	var calls []string
+	primary := &MockStore{PutFunc: func(key string, value []byte, options *WriteOptions) error {
+		calls = append(calls, "primary")
+		return errors.New("connection refused")
+	}}
+	replica := &MockStore{PutFunc: func(key string, value []byte, options *WriteOptions) error {
+		calls = append(calls, "replica")
+		return nil
+	}}
+	kv := NewFailoverStore([]Store{primary, replica}, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if err := kv.Put("soa/example.com", []byte("{}"), nil); err == nil {
+			t.Errorf("TestFailoverStoreWrites %d: expected the error of the primary", i)
+		}
+	}
+
+	if expected := []string{"primary", "primary"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("TestFailoverStoreWrites: actual calls %v, expected %v", calls, expected)
+	}
+}
+
+func TestFailoverStoreAllDown(t *testing.T) {
+	down := &MockStore{ListFunc: func(directory string) ([]Pair, error) {
+		return nil, errors.New("connection refused")
+	}}
+	notFound := &MockStore{ListFunc: func(directory string) ([]Pair, error) {
+		return nil, ErrKeyNotFound
+	}}
+
+	_, err := NewFailoverStore([]Store{down, down}, 0).List("zones")
+
+	if err == nil {
+		t.Errorf("TestFailoverStoreAllDown: expected error")
+	}
+
+	_, err = NewFailoverStore([]Store{notFound, down}, 0).List("zones")
+
+	if err != ErrKeyNotFound {
+		t.Errorf("TestFailoverStoreAllDown: actual %v, expected %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	down := &MockStore{GetFunc: func(key string) (Pair, error) {
+		return nil, errors.New("connection refused")
+	}}
+	up := &MockStore{GetFunc: func(key string) (Pair, error) {
+		return nil, ErrKeyNotFound
+	}}
+
+	snapshot, _ := NewSnapshotStore(NewFailoverStore([]Store{up, down}, 0), "")
+	backends := Backends(snapshot)
+
+	if len(backends) != 2 || backends[0] != up || backends[1] != down {
+		t.Errorf("TestBackends: actual %v, expected %v", backends, []Store{up, down})
+	}
+
+	if err := Ping(up); err != nil {
+		t.Errorf("TestBackends: actual %v, expected no error for a missing health key", err)
+	}
+
+	if err := Ping(down); err == nil {
+		t.Errorf("TestBackends: expected error for a store that is down")
+	}
+}
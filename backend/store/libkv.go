@@ -1,31 +1,49 @@
 package store
 
 import (
+	"strings"
+
 	"github.com/docker/libkv"
 	libkvStore "github.com/docker/libkv/store"
+	"github.com/docker/libkv/store/boltdb"
 	"github.com/docker/libkv/store/consul"
 	"github.com/docker/libkv/store/etcd"
 )
 
-func NewLibKVStore(kvBackend string, kvAddress []string) (Store, error) {
+const DefaultBoltBucket = "powerdns-consul"
+
+func NewLibKVStore(kvBackend string, kvAddress []string, config *Config) (Store, error) {
 	consul.Register()
 	etcd.Register()
+	boltdb.Register()
+
+	backend := libkvStore.Backend(kvBackend)
+	libkvConfig := &libkvStore.Config{}
 
-	client, err := libkv.NewStore(
-		libkvStore.Backend(kvBackend),
-		kvAddress,
-		nil,
-	)
+	if config != nil {
+		libkvConfig.ConnectionTimeout = config.ConnectionTimeout
+		libkvConfig.TLS = config.TLS
+		libkvConfig.Username = config.Username
+		libkvConfig.Password = config.Password
+		libkvConfig.Bucket = config.Bucket
+	}
+
+	if backend == libkvStore.BOLTDB && libkvConfig.Bucket == "" {
+		libkvConfig.Bucket = DefaultBoltBucket
+	}
+
+	client, err := libkv.NewStore(backend, kvAddress, libkvConfig)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &LibKVStore{client}, nil
+	return &LibKVStore{upstream: client, backend: backend}, nil
 }
 
 type LibKVStore struct {
 	upstream libkvStore.Store
+	backend  libkvStore.Backend
 }
 
 func (s LibKVStore) Get(key string) (Pair, error) {
@@ -49,26 +67,97 @@ func (s LibKVStore) List(directory string) (result []Pair, err error) {
 		return nil, err
 	}
 
-	result = make([]Pair, len(pairs))
-
-	for i, pair := range pairs {
-		result[i] = &PairImpl{pair.Key, pair.Value, pair.LastIndex}
-	}
-
-	return result, nil
+	return s.normalizePairs(directory, pairs)
 }
 
 func (s LibKVStore) AtomicPut(key string, value []byte, previous Pair, options *WriteOptions) (bool, Pair, error) {
 	var prev *libkvStore.KVPair
 	if previous != nil {
-		prev = &libkvStore.KVPair{previous.Key(), previous.Value(), previous.LastIndex()}
+		prev = &libkvStore.KVPair{Key: previous.Key(), Value: previous.Value(), LastIndex: previous.LastIndex()}
 	}
 
 	ok, pair, err := s.upstream.AtomicPut(key, value, prev, nil)
 
-	if err != nil {
+	if err == libkvStore.ErrKeyExists || err == libkvStore.ErrKeyModified {
+		return false, nil, nil
+	} else if err != nil {
 		return false, nil, err
 	}
 
 	return ok, &PairImpl{pair.Key, pair.Value, pair.LastIndex}, err
 }
+
+func (s LibKVStore) AtomicDelete(key string, previous Pair) (bool, error) {
+	prev := &libkvStore.KVPair{Key: previous.Key(), Value: previous.Value(), LastIndex: previous.LastIndex()}
+	ok, err := s.upstream.AtomicDelete(key, prev)
+
+	if err == libkvStore.ErrKeyModified || err == libkvStore.ErrKeyNotFound {
+		return false, nil
+	}
+
+	return ok, err
+}
+
+// AtomicTxn is emulated, libkv has no transactions
+func (s LibKVStore) AtomicTxn(ops []*TxnOp) (bool, error) {
+	return emulateTxn(s, ops)
+}
+
+func (s LibKVStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []Pair, error) {
+	upstreamChan, err := s.upstream.WatchTree(directory, stopCh)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resultChan := make(chan []Pair)
+
+	go func() {
+		defer close(resultChan)
+
+		for pairs := range upstreamChan {
+			result, err := s.normalizePairs(directory, pairs)
+
+			if err != nil {
+				return
+			}
+
+			select {
+			case resultChan <- result:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+
+	return resultChan, nil
+}
+
+func (s LibKVStore) normalizePairs(directory string, pairs []*libkvStore.KVPair) (result []Pair, err error) {
+	// backends behavior is inconsistent:
+	// say keys exist at zones/example.invalid/A and zones/example.invalid.com/A
+	// - consul and etcd return pairs with their full key
+	// - boltdb does a plain prefix match, so zones/example.invalid will also
+	//   return zones/example.invalid.com/A and zones/example.invalid itself
+	result = make([]Pair, 0, len(pairs))
+
+	for _, pair := range pairs {
+		if s.backend == libkvStore.BOLTDB && !isInDirectory(pair.Key, directory) {
+			continue
+		}
+
+		result = append(result, &PairImpl{pair.Key, pair.Value, pair.LastIndex})
+	}
+
+	return result, nil
+}
+
+func isInDirectory(key string, directory string) bool {
+	normalizedKey, normalizedDirectory := normalizeKey(key), normalizeKey(directory)
+
+	if normalizedDirectory == "" {
+		return true
+	}
+
+	return strings.HasPrefix(normalizedKey, normalizedDirectory+"/")
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLibKVStoreBoltDB(t *testing.T) {
+	kv, err := NewLibKVStore("boltdb", []string{filepath.Join(t.TempDir(), "powerdns-consul.db")}, nil)
+
+	if err != nil {
+		t.Fatalf("TestLibKVStoreBoltDB: unexpected error %v", err)
+	}
+
+	for _, key := range []string{"zones/example.com", "zones/example.com/A", "zones/example.com/sub/A", "zones/example.com.au/A"} {
+		if err := kv.Put(key, []byte("Value"), nil); err != nil {
+			t.Fatalf("TestLibKVStoreBoltDB: unexpected error %v", err)
+		}
+	}
+
+	pairs, err := kv.List("zones/example.com")
+
+	if err != nil {
+		t.Errorf("TestLibKVStoreBoltDB: unexpected error %v", err)
+	}
+
+	var actual []string
+	for _, pair := range pairs {
+		actual = append(actual, pair.Key())
+	}
+
+	expected := []string{"zones/example.com/A", "zones/example.com/sub/A"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TestLibKVStoreBoltDB: actual %v, expected %v", actual, expected)
+	}
+
+	ok, _, err := kv.AtomicPut("zones/example.com/A", []byte("Other"), nil, nil)
+
+	if ok || err != nil {
+		t.Errorf("TestLibKVStoreBoltDB: actual %v %v on failed AtomicPut, expected false <nil>", ok, err)
+	}
+
+	pair, _ := kv.Get("zones/example.com/A")
+	ok, err = kv.AtomicDelete("zones/example.com/A", NewPair(pair.Key(), pair.Value(), pair.LastIndex()+1))
+
+	if ok || err != nil {
+		t.Errorf("TestLibKVStoreBoltDB: actual %v %v on failed AtomicDelete, expected false <nil>", ok, err)
+	}
+
+	ok, err = kv.AtomicDelete("zones/example.com/A", pair)
+
+	if _, getErr := kv.Get("zones/example.com/A"); !ok || err != nil || getErr != ErrKeyNotFound {
+		t.Errorf("TestLibKVStoreBoltDB: actual %v %v %v on AtomicDelete, expected true <nil> %v", ok, err, getErr, ErrKeyNotFound)
+	}
+
+	sub, _ := kv.Get("zones/example.com/sub/A")
+	stale := []*TxnOp{
+		{Key: "zones/example.com/www/A", Value: []byte("Value")},
+		{Key: "zones/example.com/sub/A", Delete: true, Previous: NewPair(sub.Key(), sub.Value(), sub.LastIndex()+1)},
+	}
+	ok, err = kv.AtomicTxn(stale)
+
+	if _, getErr := kv.Get("zones/example.com/www/A"); ok || err != nil || getErr != ErrKeyNotFound {
+		t.Errorf("TestLibKVStoreBoltDB: actual %v %v %v on failed AtomicTxn, expected false <nil> %v", ok, err, getErr, ErrKeyNotFound)
+	}
+
+	stale[1].Previous = sub
+	ok, err = kv.AtomicTxn(stale)
+	_, wwwErr := kv.Get("zones/example.com/www/A")
+	_, subErr := kv.Get("zones/example.com/sub/A")
+
+	if !ok || err != nil || wwwErr != nil || subErr != ErrKeyNotFound {
+		t.Errorf("TestLibKVStoreBoltDB: actual %v %v %v %v on AtomicTxn, expected true <nil> <nil> %v", ok, err, wwwErr, subErr, ErrKeyNotFound)
+	}
+}
+
+var isInDirectoryTests = []struct {
+	key       string
+	directory string
+	expected  bool
+}{
+	{"zones/example.com/A", "zones/example.com", true},
+	{"zones/example.com/A", "zones/example.com/", true},
+	{"/zones/example.com/A", "zones", true},
+	{"zones/example.com.au/A", "zones/example.com", false},
+	{"zones/example.com", "zones/example.com", false},
+	{"zones/example.com", "", true},
+}
+
+func TestIsInDirectory(t *testing.T) {
+	for _, tt := range isInDirectoryTests {
+		actual := isInDirectory(tt.key, tt.directory)
+		if actual != tt.expected {
+			t.Errorf("isInDirectory(%s, %s): expected %v, actual %v", tt.key, tt.directory, tt.expected, actual)
+		}
+	}
+}
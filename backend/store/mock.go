@@ -1,10 +1,16 @@
 package store
 
+import "strings"
+
 type MockStore struct {
-	GetFunc       func(string) (Pair, error)
-	PutFunc       func(key string, value []byte, options *WriteOptions) error
-	ListFunc      func(directory string) ([]Pair, error)
-	AtomicPutFunc func(key string, value []byte, previous Pair, options *WriteOptions) (bool, Pair, error)
+	GetFunc          func(string) (Pair, error)
+	PutFunc          func(key string, value []byte, options *WriteOptions) error
+	ListFunc         func(directory string) ([]Pair, error)
+	AtomicPutFunc    func(key string, value []byte, previous Pair, options *WriteOptions) (bool, Pair, error)
+	AtomicDeleteFunc func(key string, previous Pair) (bool, error)
+	AtomicTxnFunc    func(ops []*TxnOp) (bool, error)
+	WatchTreeFunc    func(directory string, stopCh <-chan struct{}) (<-chan []Pair, error)
+	MaxTxnOps        int // AtomicTxn returns ErrTxnTooLarge above, like Consul
 }
 
 func (kv MockStore) Get(key string) (Pair, error) {
@@ -22,3 +28,81 @@ func (kv MockStore) List(directory string) ([]Pair, error) {
 func (kv MockStore) AtomicPut(key string, value []byte, previous Pair, options *WriteOptions) (bool, Pair, error) {
 	return kv.AtomicPutFunc(key, value, previous, options)
 }
+
+func (kv MockStore) AtomicDelete(key string, previous Pair) (bool, error) {
+	return kv.AtomicDeleteFunc(key, previous)
+}
+
+// AtomicTxn is emulated with the other functions if AtomicTxnFunc is nil
+func (kv MockStore) AtomicTxn(ops []*TxnOp) (bool, error) {
+	if kv.MaxTxnOps != 0 && len(ops) > kv.MaxTxnOps {
+		return false, ErrTxnTooLarge
+	} else if kv.AtomicTxnFunc == nil {
+		return emulateTxn(kv, ops)
+	}
+	return kv.AtomicTxnFunc(ops)
+}
+
+func (kv MockStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []Pair, error) {
+	return kv.WatchTreeFunc(directory, stopCh)
+}
+
+// NewMemoryStore returns a MockStore keeping pairs in a map, for tests that
+// need a store that can be written. The modify index of all initial pairs is
+// 1 and every write increments it.
+func NewMemoryStore(pairs map[string]string) *MockStore {
+	indexes := make(map[string]uint64)
+	index := uint64(1)
+
+	for key := range pairs {
+		indexes[key] = index
+	}
+
+	get := func(key string) (Pair, error) {
+		if value, ok := pairs[key]; ok {
+			return NewPair(key, []byte(value), indexes[key]), nil
+		}
+		return nil, ErrKeyNotFound
+	}
+
+	return &MockStore{
+		GetFunc: get,
+		PutFunc: func(key string, value []byte, options *WriteOptions) error {
+			index++
+			pairs[key], indexes[key] = string(value), index
+			return nil
+		},
+		ListFunc: func(directory string) (result []Pair, err error) {
+			for key := range pairs {
+				if strings.HasPrefix(key, directory) {
+					pair, _ := get(key)
+					result = append(result, pair)
+				}
+			}
+
+			if len(result) == 0 {
+				return nil, ErrKeyNotFound
+			}
+
+			return result, nil
+		},
+		AtomicPutFunc: func(key string, value []byte, previous Pair, options *WriteOptions) (bool, Pair, error) {
+			if _, exists := pairs[key]; exists != (previous != nil) || (previous != nil && previous.LastIndex() != indexes[key]) {
+				return false, nil, nil
+			}
+
+			index++
+			pairs[key], indexes[key] = string(value), index
+			pair, _ := get(key)
+			return true, pair, nil
+		},
+		AtomicDeleteFunc: func(key string, previous Pair) (bool, error) {
+			if _, exists := pairs[key]; !exists || previous.LastIndex() != indexes[key] {
+				return false, nil
+			}
+
+			delete(pairs, key)
+			return true, nil
+		},
+	}
+}
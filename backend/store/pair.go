@@ -33,3 +33,15 @@ func (p *PairImpl) LastIndex() uint64 {
 func normalizeKey(key string) string {
 	return strings.TrimSuffix(strings.TrimPrefix(key, "/"), "/")
 }
+
+func directoryPrefix(directory string) string {
+	// native stores keep keys without a leading slash and list by prefix, so
+	// zones/example.invalid must not match zones/example.invalid.com/A
+	directory = normalizeKey(directory)
+
+	if directory == "" {
+		return ""
+	}
+
+	return directory + "/"
+}
@@ -22,3 +22,22 @@ func TestNormalizeKey(t *testing.T) {
 		}
 	}
 }
+
+var directoryPrefixTests = []struct {
+	directory string
+	expected  string
+}{
+	{"zones/example.com", "zones/example.com/"},
+	{"/zones/example.com/", "zones/example.com/"},
+	{"zones", "zones/"},
+	{"", ""},
+}
+
+func TestDirectoryPrefix(t *testing.T) {
+	for _, tt := range directoryPrefixTests {
+		actual := directoryPrefix(tt.directory)
+		if actual != tt.expected {
+			t.Errorf("directoryPrefix(%s): expected %s, actual %s", tt.directory, tt.expected, actual)
+		}
+	}
+}
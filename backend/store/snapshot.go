@@ -0,0 +1,354 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+const (
+	// SnapshotPersistDelay is how long changes are collected before the
+	// snapshot is written to disk
+	SnapshotPersistDelay = 5 * time.Second
+	// MaxSnapshotEntries bounds the Gets and Lists kept, the oldest are
+	// dropped first
+	MaxSnapshotEntries = 10000
+)
+
+// SnapshotStore remembers the last successful result of every Get and List
+// and serves it when the upstream store fails, so lookups keep working while
+// the store is unreachable. If path is set, the snapshot is also kept on disk,
+// written in the background at most every SnapshotPersistDelay, and loaded on
+// startup.
+type SnapshotStore struct {
+	upstream     Store
+	path         string
+	mutex        sync.Mutex
+	writeMutex   sync.Mutex
+	snapshot     snapshot
+	stats        SnapshotStats
+	changed      bool
+	changes      chan struct{}
+	persistDelay time.Duration
+	maxEntries   int
+	now          func() time.Time
+}
+
+type SnapshotStats struct {
+	StaleReads   uint64
+	FailedSince  time.Time // zero if the upstream store is healthy
+	OldestServed time.Time // when the oldest data served during the current failure was taken
+}
+
+type snapshot struct {
+	Gets  map[string]*snapshotEntry
+	Lists map[string]*snapshotEntry
+}
+
+type snapshotEntry struct {
+	Taken time.Time
+	Pairs []snapshotPair
+}
+
+type snapshotPair struct {
+	Key       string
+	Value     []byte
+	LastIndex uint64
+}
+
+func NewSnapshotStore(upstream Store, path string) (*SnapshotStore, error) {
+	s := &SnapshotStore{
+		upstream:     upstream,
+		path:         path,
+		snapshot:     snapshot{make(map[string]*snapshotEntry), make(map[string]*snapshotEntry)},
+		changes:      make(chan struct{}, 1),
+		persistDelay: SnapshotPersistDelay,
+		maxEntries:   MaxSnapshotEntries,
+		now:          time.Now,
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	go s.persistChanges()
+
+	contents, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(contents, &s.snapshot); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *SnapshotStore) Get(key string) (Pair, error) {
+	pair, err := s.upstream.Get(key)
+
+	switch err {
+	case nil:
+		s.update(s.snapshot.Gets, key, []Pair{pair})
+		return pair, nil
+	case ErrKeyNotFound:
+		s.update(s.snapshot.Gets, key, nil)
+		return nil, err
+	}
+
+	pairs, ok := s.stale(key, err, func() *snapshotEntry {
+		return s.snapshot.Gets[key]
+	})
+
+	if !ok {
+		return nil, err
+	}
+
+	return pairs[0], nil
+}
+
+func (s *SnapshotStore) Put(key string, value []byte, options *WriteOptions) error {
+	return s.upstream.Put(key, value, options)
+}
+
+func (s *SnapshotStore) List(directory string) ([]Pair, error) {
+	pairs, err := s.upstream.List(directory)
+
+	switch err {
+	case nil:
+		s.update(s.snapshot.Lists, directory, pairs)
+		return pairs, nil
+	case ErrKeyNotFound:
+		s.update(s.snapshot.Lists, directory, nil)
+		return nil, err
+	}
+
+	pairs, ok := s.stale(directory, err, func() *snapshotEntry {
+		if entry, ok := s.snapshot.Lists[directory]; ok {
+			return entry
+		}
+
+		return s.snapshot.fromAncestor(directory)
+	})
+
+	if !ok {
+		return nil, err
+	}
+
+	return pairs, nil
+}
+
+func (s *SnapshotStore) AtomicPut(key string, value []byte, previous Pair, options *WriteOptions) (bool, Pair, error) {
+	return s.upstream.AtomicPut(key, value, previous, options)
+}
+
+func (s *SnapshotStore) AtomicDelete(key string, previous Pair) (bool, error) {
+	return s.upstream.AtomicDelete(key, previous)
+}
+
+func (s *SnapshotStore) AtomicTxn(ops []*TxnOp) (bool, error) {
+	return s.upstream.AtomicTxn(ops)
+}
+
+func (s *SnapshotStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []Pair, error) {
+	return s.upstream.WatchTree(directory, stopCh)
+}
+
+func (s *SnapshotStore) Stats() SnapshotStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.stats
+}
+
+func (s *SnapshotStore) update(entries map[string]*snapshotEntry, key string, pairs []Pair) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.stats.FailedSince.IsZero() {
+		logging.Info("Store recovered", "failed_for", s.now().Sub(s.stats.FailedSince), "stale_reads", s.stats.StaleReads)
+		s.stats = SnapshotStats{}
+	}
+
+	previous, exists := entries[key]
+
+	if pairs == nil {
+		if exists {
+			delete(entries, key)
+			s.markChanged()
+		}
+		return
+	}
+
+	entry := &snapshotEntry{Taken: s.now(), Pairs: make([]snapshotPair, len(pairs))}
+	for i, pair := range pairs {
+		entry.Pairs[i] = snapshotPair{pair.Key(), pair.Value(), pair.LastIndex()}
+	}
+	entries[key] = entry
+
+	if !exists && len(entries) > s.maxEntries {
+		s.trim(entries)
+	}
+
+	if !exists || !previous.equal(entry) {
+		s.markChanged()
+	}
+}
+
+// trim drops the oldest tenth of entries, so names that were queried once
+// do not grow the snapshot forever. s.mutex must be held.
+func (s *SnapshotStore) trim(entries map[string]*snapshotEntry) {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return entries[keys[i]].Taken.Before(entries[keys[j]].Taken) })
+
+	for _, key := range keys[:len(keys)-s.maxEntries*9/10] {
+		delete(entries, key)
+	}
+}
+
+// markChanged schedules writing the snapshot, s.mutex must be held
+func (s *SnapshotStore) markChanged() {
+	if s.path == "" {
+		return
+	}
+
+	s.changed = true
+
+	select {
+	case s.changes <- struct{}{}:
+	default: // already scheduled
+	}
+}
+
+func (s *SnapshotStore) persistChanges() {
+	for range s.changes {
+		time.Sleep(s.persistDelay)
+		s.Flush()
+	}
+}
+
+func (s *SnapshotStore) stale(key string, err error, lookup func() *snapshotEntry) ([]Pair, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+
+	if s.stats.FailedSince.IsZero() {
+		logging.Warn("Store failed, serving data from snapshot", "error", err)
+		s.stats.FailedSince = now
+	}
+
+	entry := lookup()
+
+	if entry == nil {
+		logging.Warn("Store failed and there is no snapshot", "key", key)
+		return nil, false
+	}
+
+	s.stats.StaleReads++
+	if s.stats.OldestServed.IsZero() || entry.Taken.Before(s.stats.OldestServed) {
+		s.stats.OldestServed = entry.Taken
+		logging.Warn("Serving old data from snapshot", "age", now.Sub(entry.Taken))
+	}
+
+	pairs := make([]Pair, len(entry.Pairs))
+	for i, pair := range entry.Pairs {
+		pairs[i] = &PairImpl{pair.Key, pair.Value, pair.LastIndex}
+	}
+
+	return pairs, true
+}
+
+// Flush writes the snapshot to disk if it changed since it was last written
+func (s *SnapshotStore) Flush() {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	s.mutex.Lock()
+	if !s.changed {
+		s.mutex.Unlock()
+		return
+	}
+
+	contents, err := json.Marshal(s.snapshot)
+	s.changed = false
+	s.mutex.Unlock()
+
+	if err != nil {
+		logging.Error("Unable to encode snapshot", "error", err)
+		return
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+
+	if err != nil {
+		logging.Error("Unable to write snapshot", "path", s.path, "error", err)
+		return
+	}
+
+	_, err = tmpFile.Write(contents)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), s.path)
+	}
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		logging.Error("Unable to write snapshot", "path", s.path, "error", err)
+	}
+}
+
+func (snap *snapshot) fromAncestor(directory string) *snapshotEntry {
+	// recursive backends (i.e. consul) return everything below a directory,
+	// so a listing of zones/example.invalid can be served from zones
+	for ancestor, entry := range snap.Lists {
+		if !isInDirectory(directory, ancestor) {
+			continue
+		}
+
+		result := &snapshotEntry{Taken: entry.Taken}
+		for _, pair := range entry.Pairs {
+			if isInDirectory(pair.Key, directory) {
+				result.Pairs = append(result.Pairs, pair)
+			}
+		}
+
+		if len(result.Pairs) > 0 {
+			return result
+		}
+	}
+
+	return nil
+}
+
+func (entry *snapshotEntry) equal(other *snapshotEntry) bool {
+	if len(entry.Pairs) != len(other.Pairs) {
+		return false
+	}
+
+	for i, pair := range entry.Pairs {
+		otherPair := other.Pairs[i]
+		if pair.Key != otherPair.Key || pair.LastIndex != otherPair.LastIndex || !bytes.Equal(pair.Value, otherPair.Value) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotStore(t *testing.T) {
+	var upstreamErr error
+
+	upstream := &MockStore{
+		GetFunc: func(key string) (Pair, error) {
+			if upstreamErr != nil {
+				return nil, upstreamErr
+			}
+			return NewPair(key, []byte("Value"), 1), nil
+		},
+		ListFunc: func(directory string) ([]Pair, error) {
+			if upstreamErr != nil {
+				return nil, upstreamErr
+			}
+			return []Pair{
+				NewPair("zones/example.com/A", []byte("Value"), 1),
+				NewPair("zones/example.com/sub/A", []byte("Value"), 2),
+				NewPair("zones/example.org/A", []byte("Value"), 3),
+			}, nil
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	kv, err := NewSnapshotStore(upstream, path)
+
+	if err != nil {
+		t.Fatalf("TestSnapshotStore: unexpected error %v", err)
+	}
+
+	taken := time.Unix(1000, 0)
+	kv.now = func() time.Time { return taken }
+
+	expected, _ := kv.List("zones")
+	kv.Get("soa/example.com")
+
+	upstreamErr = errors.New("connection refused")
+	kv.now = func() time.Time { return taken.Add(time.Minute) }
+
+	actual, err := kv.List("zones")
+
+	if err != nil || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TestSnapshotStore: actual %v %v, expected %v", actual, err, expected)
+	}
+
+	actual, err = kv.List("zones/example.com")
+
+	if err != nil || len(actual) != 2 {
+		t.Errorf("TestSnapshotStore: actual %v %v, expected 2 pairs from the zones snapshot", actual, err)
+	}
+
+	if _, err = kv.List("zones/example.net"); err != upstreamErr {
+		t.Errorf("TestSnapshotStore: actual %v, expected %v", err, upstreamErr)
+	}
+
+	stats := kv.Stats()
+	if stats.StaleReads != 2 || !stats.FailedSince.Equal(taken.Add(time.Minute)) || !stats.OldestServed.Equal(taken) {
+		t.Errorf("TestSnapshotStore: unexpected stats %+v", stats)
+	}
+
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("TestSnapshotStore: expected the snapshot to be written in the background, actual %v", err)
+	}
+
+	kv.Flush()
+	reloaded, err := NewSnapshotStore(upstream, path)
+
+	if err != nil {
+		t.Fatalf("TestSnapshotStore: unexpected error %v", err)
+	}
+
+	pair, err := reloaded.Get("soa/example.com")
+
+	if err != nil || pair.Key() != "soa/example.com" || string(pair.Value()) != "Value" {
+		t.Errorf("TestSnapshotStore: actual %v %v from reloaded snapshot", pair, err)
+	}
+
+	upstreamErr = nil
+	kv.List("zones")
+
+	if stats = kv.Stats(); !stats.FailedSince.IsZero() {
+		t.Errorf("TestSnapshotStore: expected recovery, actual stats %+v", stats)
+	}
+}
+
+func TestSnapshotStoreKeyNotFound(t *testing.T) {
+	upstreamErr := error(nil)
+	upstream := &MockStore{GetFunc: func(key string) (Pair, error) {
+		if upstreamErr != nil {
+			return nil, upstreamErr
+		}
+		return NewPair(key, []byte("Value"), 1), nil
+	}}
+
+	kv, _ := NewSnapshotStore(upstream, "")
+	kv.Get("soa/example.com")
+
+	upstreamErr = ErrKeyNotFound
+	kv.Get("soa/example.com")
+
+	upstreamErr = errors.New("connection refused")
+	if _, err := kv.Get("soa/example.com"); err != upstreamErr {
+		t.Errorf("TestSnapshotStoreKeyNotFound: actual %v, expected %v", err, upstreamErr)
+	}
+}
+
+func TestSnapshotStorePersistsInBackground(t *testing.T) {
+	upstream := &MockStore{GetFunc: func(key string) (Pair, error) {
+		return NewPair(key, []byte("Value"), 1), nil
+	}}
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	kv, _ := NewSnapshotStore(upstream, path)
+	kv.persistDelay = 10 * time.Millisecond
+	kv.Get("soa/example.com")
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("TestSnapshotStorePersistsInBackground: snapshot not written to %s", path)
+}
+
+func TestSnapshotStoreBounded(t *testing.T) {
+	upstream := &MockStore{GetFunc: func(key string) (Pair, error) {
+		return NewPair(key, []byte("Value"), 1), nil
+	}}
+
+	kv, _ := NewSnapshotStore(upstream, "")
+	kv.maxEntries = 10
+	taken := time.Unix(1000, 0)
+
+	for i := 0; i < 25; i++ {
+		kv.now = func() time.Time { return taken.Add(time.Duration(i) * time.Second) }
+		kv.Get(fmt.Sprintf("soa/example%d.com", i))
+	}
+
+	if actual := len(kv.snapshot.Gets); actual > 10 {
+		t.Errorf("TestSnapshotStoreBounded: actual %d entries, expected at most 10", actual)
+	}
+
+	if _, exists := kv.snapshot.Gets["soa/example24.com"]; !exists {
+		t.Errorf("TestSnapshotStoreBounded: expected the newest entry to be kept")
+	}
+
+	if _, exists := kv.snapshot.Gets["soa/example0.com"]; exists {
+		t.Errorf("TestSnapshotStoreBounded: expected the oldest entry to be dropped")
+	}
+}
@@ -1,12 +1,21 @@
 package store
 
 import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/docker/libkv/store"
 )
 
 type Query struct {
-	Name string
-	Type string
+	Name      string
+	Type      string
+	RemoteIp  string // of the client, for logging
+	Id        string // of the PowerDNS pipe request, for logging
+	Authority bool   // add the SOA to the authority section of negative answers
 }
 
 type Entry struct {
@@ -20,9 +29,96 @@ type Store interface {
 	Put(key string, value []byte, options *WriteOptions) error
 	List(directory string) ([]Pair, error)
 	AtomicPut(key string, value []byte, previous Pair, options *WriteOptions) (bool, Pair, error)
+	AtomicDelete(key string, previous Pair) (bool, error)
+	AtomicTxn(ops []*TxnOp) (bool, error)
+	WatchTree(directory string, stopCh <-chan struct{}) (<-chan []Pair, error)
+}
+
+type Config struct {
+	ConnectionTimeout time.Duration
+	TLS               *tls.Config
+	Username          string
+	Password          string
+	Bucket            string // boltdb only
+	Datacenter        string // consulapi only
+	Namespace         string // consulapi only
+	Token             string // consulapi only
+	Consistency       string // consulapi only, one of default, stale or consistent
+}
+
+// backends creates a store for every supported KVBackend, the other
+// backends of libkv are not tested
+var backends = map[string]func(kvBackend string, kvAddress []string, config *Config) (Store, error){
+	"consul": NewLibKVStore,
+	"consulapi": func(kvBackend string, kvAddress []string, config *Config) (Store, error) {
+		return NewConsulStore(kvAddress, config)
+	},
+	"etcd": NewLibKVStore,
+	"etcdv3": func(kvBackend string, kvAddress []string, config *Config) (Store, error) {
+		return NewEtcdV3Store(kvAddress, config)
+	},
+	"zk": func(kvBackend string, kvAddress []string, config *Config) (Store, error) {
+		return NewZKStore(kvAddress, config)
+	},
+	"boltdb": NewLibKVStore,
+}
+
+// ValidateBackend returns an error if NewStore does not support kvBackend
+func ValidateBackend(kvBackend string) error {
+	if _, ok := backends[kvBackend]; ok {
+		return nil
+	}
+
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return fmt.Errorf("Unsupported KVBackend %s, use %s or %s", kvBackend, strings.Join(names[:len(names)-1], ", "), names[len(names)-1])
+}
+
+func NewStore(kvBackend string, kvAddress []string, config *Config) (Store, error) {
+	if err := ValidateBackend(kvBackend); err != nil {
+		return nil, err
+	}
+
+	return backends[kvBackend](kvBackend, kvAddress, config)
 }
 
 type WriteOptions store.WriteOptions
 type Backend store.Backend
 
 var ErrKeyNotFound error = store.ErrKeyNotFound
+
+// HealthKey is read to check that a store can be reached, it does not need
+// to exist
+const HealthKey = "powerdns-consul/health"
+
+// Ping returns an error if kv cannot be reached
+func Ping(kv Store) error {
+	_, err := kv.Get(HealthKey)
+
+	if err == ErrKeyNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// Backends returns the stores behind kv, looking through failover and
+// snapshot stores which would hide their failures
+func Backends(kv Store) []Store {
+	switch wrapper := kv.(type) {
+	case *FailoverStore:
+		var stores []Store
+		for _, curStore := range wrapper.stores {
+			stores = append(stores, Backends(curStore)...)
+		}
+		return stores
+	case *SnapshotStore:
+		return Backends(wrapper.upstream)
+	}
+
+	return []Store{kv}
+}
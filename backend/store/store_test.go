@@ -0,0 +1,30 @@
+package store
+
+import "testing"
+
+func TestValidateBackend(t *testing.T) {
+	testCases := map[string]bool{
+		"consul":    true,
+		"consulapi": true,
+		"etcd":      true,
+		"etcdv3":    true,
+		"zk":        true,
+		"boltdb":    true,
+		"":          false,
+		"redis":     false,
+	}
+
+	for kvBackend, expected := range testCases {
+		if err := ValidateBackend(kvBackend); (err == nil) != expected {
+			t.Errorf("TestValidateBackend(%s): actual %v, expected valid %v", kvBackend, err, expected)
+		}
+	}
+}
+
+func TestNewStoreUnsupported(t *testing.T) {
+	expected := "Unsupported KVBackend redis, use boltdb, consul, consulapi, etcd, etcdv3 or zk"
+
+	if _, err := NewStore("redis", []string{"127.0.0.1:6379"}, nil); err == nil || err.Error() != expected {
+		t.Errorf("TestNewStoreUnsupported: actual %v, expected %s", err, expected)
+	}
+}
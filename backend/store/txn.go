@@ -0,0 +1,80 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTxnInterrupted is returned by emulated transactions if a key changed
+// after the transaction was checked and only some of its writes were applied
+var ErrTxnInterrupted = errors.New("Transaction was interrupted by a concurrent change and applied partially")
+
+// ErrTxnTooLarge is returned by consulapi if a transaction has more than
+// ConsulMaxTxnOps operations. Nothing is written then.
+var ErrTxnTooLarge = fmt.Errorf("The change writes more than %d keys, the most a Consul transaction can apply at once", ConsulMaxTxnOps)
+
+// TxnOp is one write of a transaction passed to AtomicTxn. Like AtomicPut
+// and AtomicDelete it only applies if the key was not changed since
+// Previous was read, or does not exist if Previous is nil. Deletes require
+// Previous.
+type TxnOp struct {
+	Key      string
+	Value    []byte
+	Delete   bool
+	Previous Pair
+}
+
+func validateTxn(ops []*TxnOp) error {
+	for _, op := range ops {
+		if op.Delete && op.Previous == nil {
+			return fmt.Errorf("Deleting %s in a transaction requires its previous pair", op.Key)
+		}
+	}
+
+	return nil
+}
+
+// emulateTxn applies ops one by one on stores without transactions. It
+// returns false if a key was changed before anything was written, or
+// ErrTxnInterrupted if a key changed while writing.
+func emulateTxn(kv Store, ops []*TxnOp) (bool, error) {
+	if err := validateTxn(ops); err != nil {
+		return false, err
+	}
+
+	for _, op := range ops {
+		current, err := kv.Get(op.Key)
+
+		if err != nil && err != ErrKeyNotFound {
+			return false, err
+		}
+
+		if (current == nil) != (op.Previous == nil) || (current != nil && current.LastIndex() != op.Previous.LastIndex()) {
+			return false, nil
+		}
+	}
+
+	for i, op := range ops {
+		var ok bool
+		var err error
+
+		if op.Delete {
+			ok, err = kv.AtomicDelete(op.Key, op.Previous)
+		} else {
+			ok, _, err = kv.AtomicPut(op.Key, op.Value, op.Previous, nil)
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if !ok {
+			if i == 0 {
+				return false, nil
+			}
+			return false, ErrTxnInterrupted
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const DefaultZKTimeout = 10 * time.Second
+
+var errZKWatch = errors.New("ZooKeeper only watches the direct children of a node, watching keys below zones/ is not supported")
+
+// ZKStore uses ZooKeeper directly. libkv lists only the direct children of
+// a node and uses the node's own version as index, which does not tell
+// which key of a zone changed last. The modify index of a key is the zxid
+// of its last change (Mzxid) instead.
+type ZKStore struct {
+	conn zkClient
+}
+
+// zkClient is the part of the ZooKeeper client used by ZKStore
+type zkClient interface {
+	Children(path string) ([]string, *zk.Stat, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Delete(path string, version int32) error
+}
+
+func NewZKStore(kvAddress []string, config *Config) (Store, error) {
+	timeout := DefaultZKTimeout
+	if config != nil && config.ConnectionTimeout != 0 {
+		timeout = config.ConnectionTimeout
+	}
+
+	conn, _, err := zk.Connect(kvAddress, timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ZKStore{conn}, nil
+}
+
+func zkPath(key string) string {
+	return "/" + normalizeKey(key)
+}
+
+func (s *ZKStore) Get(key string) (Pair, error) {
+	value, stat, err := s.conn.Get(zkPath(key))
+
+	if err == zk.ErrNoNode {
+		return nil, ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &PairImpl{normalizeKey(key), value, uint64(stat.Mzxid)}, nil
+}
+
+func (s *ZKStore) Put(key string, value []byte, options *WriteOptions) error {
+	_, err := s.conn.Set(zkPath(key), value, -1)
+
+	if err == zk.ErrNoNode {
+		if err = s.create(key, value); err == zk.ErrNodeExists {
+			_, err = s.conn.Set(zkPath(key), value, -1)
+		}
+	}
+
+	return err
+}
+
+// create creates the node of key and the nodes of its parents if missing
+func (s *ZKStore) create(key string, value []byte) error {
+	parts := strings.Split(normalizeKey(key), "/")
+
+	for i := 1; i < len(parts); i++ {
+		_, err := s.conn.Create("/"+strings.Join(parts[:i], "/"), nil, 0, zk.WorldACL(zk.PermAll))
+
+		if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+
+	_, err := s.conn.Create(zkPath(key), value, 0, zk.WorldACL(zk.PermAll))
+	return err
+}
+
+func (s *ZKStore) List(directory string) ([]Pair, error) {
+	return s.list(normalizeKey(directory))
+}
+
+// AtomicPut compares the Mzxid of the node with previous and then sets it
+// with the node's version, which fails if it changed in between
+func (s *ZKStore) AtomicPut(key string, value []byte, previous Pair, options *WriteOptions) (bool, Pair, error) {
+	if previous == nil {
+		if err := s.create(key, value); err == zk.ErrNodeExists {
+			return false, nil, nil
+		} else if err != nil {
+			return false, nil, err
+		}
+
+		pair, err := s.Get(key)
+		return err == nil, pair, err
+	}
+
+	_, stat, err := s.conn.Get(zkPath(key))
+
+	if err == zk.ErrNoNode || (err == nil && uint64(stat.Mzxid) != previous.LastIndex()) {
+		return false, nil, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+
+	stat, err = s.conn.Set(zkPath(key), value, stat.Version)
+
+	if err == zk.ErrBadVersion || err == zk.ErrNoNode {
+		return false, nil, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+
+	return true, &PairImpl{normalizeKey(key), value, uint64(stat.Mzxid)}, nil
+}
+
+func (s *ZKStore) AtomicDelete(key string, previous Pair) (bool, error) {
+	_, stat, err := s.conn.Get(zkPath(key))
+
+	if err == zk.ErrNoNode || (err == nil && uint64(stat.Mzxid) != previous.LastIndex()) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	err = s.conn.Delete(zkPath(key), stat.Version)
+
+	if err == zk.ErrBadVersion || err == zk.ErrNoNode {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// AtomicTxn is emulated, the transaction would have to read every node for
+// its version first
+func (s *ZKStore) AtomicTxn(ops []*TxnOp) (bool, error) {
+	return emulateTxn(s, ops)
+}
+
+// WatchTree is not supported, ZooKeeper watches do not see changes to keys
+// below the direct children of a node
+func (s *ZKStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []Pair, error) {
+	return nil, errZKWatch
+}
+
+// list returns the keys without children below directory, reading every
+// node once. ZooKeeper nodes are directories and values at the same time,
+// the nodes created for the parents of a key are left out.
+func (s *ZKStore) list(directory string) ([]Pair, error) {
+	children, _, err := s.conn.Children("/" + directory)
+
+	if err == zk.ErrNoNode {
+		return nil, ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := make([]Pair, 0, len(children))
+
+	for _, child := range children {
+		key := strings.TrimPrefix(directory+"/"+child, "/")
+		value, stat, err := s.conn.Get("/" + key)
+
+		if err == zk.ErrNoNode {
+			continue // deleted in the meantime
+		} else if err != nil {
+			return nil, err
+		}
+
+		if stat.NumChildren == 0 {
+			result = append(result, &PairImpl{key, value, uint64(stat.Mzxid)})
+			continue
+		}
+
+		pairs, err := s.list(key)
+
+		if err == ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		result = append(result, pairs...)
+	}
+
+	return result, nil
+}
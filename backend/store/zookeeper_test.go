@@ -0,0 +1,192 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// zkNodes is a ZooKeeper tree, every key of a node's children is a node too
+type zkNodes struct {
+	stats  map[string]*zk.Stat
+	values map[string][]byte
+	zxid   int64
+}
+
+func (nodes *zkNodes) Children(path string) ([]string, *zk.Stat, error) {
+	stat, ok := nodes.stats[path]
+
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+
+	var children []string
+	for key := range nodes.stats {
+		if strings.HasPrefix(key, path+"/") && !strings.Contains(strings.TrimPrefix(key, path+"/"), "/") {
+			children = append(children, strings.TrimPrefix(key, path+"/"))
+		}
+	}
+
+	sort.Strings(children)
+	return children, stat, nil
+}
+
+func (nodes *zkNodes) Get(path string) ([]byte, *zk.Stat, error) {
+	stat, ok := nodes.stats[path]
+
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+
+	return nodes.values[path], stat, nil
+}
+
+func (nodes *zkNodes) Set(path string, data []byte, version int32) (*zk.Stat, error) {
+	stat, ok := nodes.stats[path]
+
+	if !ok {
+		return nil, zk.ErrNoNode
+	} else if version != -1 && version != stat.Version {
+		return nil, zk.ErrBadVersion
+	}
+
+	nodes.zxid++
+	nodes.values[path] = data
+	nodes.stats[path] = &zk.Stat{Version: stat.Version + 1, Mzxid: nodes.zxid, NumChildren: stat.NumChildren}
+	return nodes.stats[path], nil
+}
+
+func (nodes *zkNodes) Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	if _, ok := nodes.stats[path]; ok {
+		return "", zk.ErrNodeExists
+	}
+
+	parent := path[:strings.LastIndex(path, "/")]
+	if _, ok := nodes.stats[parent]; parent != "" && !ok {
+		return "", zk.ErrNoNode
+	} else if ok {
+		nodes.stats[parent].NumChildren++
+	}
+
+	nodes.zxid++
+	nodes.values[path] = data
+	nodes.stats[path] = &zk.Stat{Mzxid: nodes.zxid}
+	return path, nil
+}
+
+func (nodes *zkNodes) Delete(path string, version int32) error {
+	stat, ok := nodes.stats[path]
+
+	if !ok {
+		return zk.ErrNoNode
+	} else if version != -1 && version != stat.Version {
+		return zk.ErrBadVersion
+	}
+
+	delete(nodes.stats, path)
+	delete(nodes.values, path)
+	nodes.stats[path[:strings.LastIndex(path, "/")]].NumChildren--
+	return nil
+}
+
+func newZKNodes(keys map[string]int64) *zkNodes {
+	nodes := &zkNodes{stats: make(map[string]*zk.Stat), values: make(map[string][]byte)}
+
+	for key, mzxid := range keys {
+		nodes.values[key] = []byte("Value")
+		nodes.stats[key] = &zk.Stat{Version: 1, Mzxid: mzxid}
+
+		if mzxid > nodes.zxid {
+			nodes.zxid = mzxid
+		}
+	}
+
+	for key := range keys {
+		if parent := key[:strings.LastIndex(key, "/")]; parent != "" {
+			nodes.stats[parent].NumChildren++
+		}
+	}
+
+	return nodes
+}
+
+func TestZKStoreList(t *testing.T) {
+	kv := &ZKStore{newZKNodes(map[string]int64{
+		"/zones":                           1,
+		"/zones/example.com":               2,
+		"/zones/example.com/A":             5,
+		"/zones/example.com/sub":           3,
+		"/zones/example.com/sub/A":         4,
+		"/zones/example.com/sub/deep":      3,
+		"/zones/example.com/sub/deep/AAAA": 9,
+		"/zones/example.com/www":           2,
+		"/zones/example.com/www/CNAME":     6,
+		"/zones/example.com.au":            2,
+		"/zones/example.com.au/A":          7,
+	})}
+
+	actual, err := kv.List("zones/example.com")
+	expected := []Pair{
+		NewPair("zones/example.com/A", []byte("Value"), 5),
+		NewPair("zones/example.com/sub/A", []byte("Value"), 4),
+		NewPair("zones/example.com/sub/deep/AAAA", []byte("Value"), 9),
+		NewPair("zones/example.com/www/CNAME", []byte("Value"), 6),
+	}
+
+	if err != nil || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TestZKStoreList: actual %v %v, expected %v", actual, err, expected)
+	}
+
+	if _, err = kv.List("zones/example.org"); err != ErrKeyNotFound {
+		t.Errorf("TestZKStoreList: actual %v, expected %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestZKStoreWrites(t *testing.T) {
+	nodes := newZKNodes(map[string]int64{"/zones": 1, "/zones/example.com": 2, "/zones/example.com/A": 3})
+	kv := &ZKStore{nodes}
+
+	// a new key has the highest modify index of the zone
+	if err := kv.Put("zones/example.com/www/A", []byte("Value"), nil); err != nil {
+		t.Fatalf("TestZKStoreWrites: unexpected error %v", err)
+	}
+
+	www, err := kv.Get("zones/example.com/www/A")
+
+	if err != nil || www.LastIndex() != 5 {
+		t.Errorf("TestZKStoreWrites: actual %v %v, expected modify index 5", www, err)
+	}
+
+	pair, _ := kv.Get("zones/example.com/A")
+
+	if ok, _, err := kv.AtomicPut("zones/example.com/A", []byte("Other"), nil, nil); ok || err != nil {
+		t.Errorf("TestZKStoreWrites: actual %v %v creating an existing key, expected false <nil>", ok, err)
+	}
+
+	if ok, _, err := kv.AtomicPut("zones/example.com/A", []byte("Other"), NewPair(pair.Key(), pair.Value(), pair.LastIndex()+1), nil); ok || err != nil {
+		t.Errorf("TestZKStoreWrites: actual %v %v on a stale AtomicPut, expected false <nil>", ok, err)
+	}
+
+	ok, updated, err := kv.AtomicPut("zones/example.com/A", []byte("Other"), pair, nil)
+
+	if !ok || err != nil || updated.LastIndex() != 6 || string(nodes.values["/zones/example.com/A"]) != "Other" {
+		t.Errorf("TestZKStoreWrites: actual %v %v %v on AtomicPut, expected true <nil> with modify index 6", ok, updated, err)
+	}
+
+	if ok, err := kv.AtomicDelete("zones/example.com/A", pair); ok || err != nil {
+		t.Errorf("TestZKStoreWrites: actual %v %v on a stale AtomicDelete, expected false <nil>", ok, err)
+	}
+
+	ok, err = kv.AtomicDelete("zones/example.com/A", updated)
+
+	if _, getErr := kv.Get("zones/example.com/A"); !ok || err != nil || getErr != ErrKeyNotFound {
+		t.Errorf("TestZKStoreWrites: actual %v %v %v on AtomicDelete, expected true <nil> %v", ok, err, getErr, ErrKeyNotFound)
+	}
+
+	if _, err := kv.WatchTree("zones", nil); err != errZKWatch {
+		t.Errorf("TestZKStoreWrites: actual %v on WatchTree, expected %v", err, errZKWatch)
+	}
+}
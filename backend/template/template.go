@@ -0,0 +1,199 @@
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+// VarsPrefix is where variables are stored, i.e. vars/lb-vip holds the value
+// of {{ var "lb-vip" }}
+const VarsPrefix = "vars"
+
+// refPrefix marks a payload that is replaced by all payloads of another
+// record, i.e. "@ref zones/example.com/lb/A"
+const refPrefix = "@ref "
+
+// zonesPrefix is where referenced records must be, so references cannot
+// expose other keys such as the SOA state or history
+const zonesPrefix = "zones/"
+
+var varPattern = regexp.MustCompile(`\{\{\s*var\s+"([^"]+)"\s*\}\}`)
+
+type value struct {
+	Payload *string
+}
+
+// IsTemplate tells if payload references variables or other records
+func IsTemplate(payload string) bool {
+	return strings.HasPrefix(payload, refPrefix) || varPattern.MatchString(payload)
+}
+
+// Payloads returns the payloads of a record value in the flat schema format
+func Payloads(recordValue []byte) ([]string, error) {
+	values := make([]value, 0)
+
+	if err := json.Unmarshal(recordValue, &values); err != nil {
+		return nil, err
+	}
+
+	payloads := make([]string, 0, len(values))
+	for _, value := range values {
+		if value.Payload != nil {
+			payloads = append(payloads, *value.Payload)
+		}
+	}
+
+	return payloads, nil
+}
+
+// Expander replaces variables and references in payloads with the values
+// they point to in the store
+type Expander struct {
+	kv   store.Store
+	used map[string]bool
+}
+
+func NewExpander(kv store.Store) *Expander {
+	return &Expander{kv: kv}
+}
+
+// Expand returns the payloads payload expands to and the highest modify
+// index of the keys it depends on. A reference expands to every payload of
+// the referenced record, a variable to its value. Both may contain further
+// variables and references; a cycle is an error.
+func (e *Expander) Expand(payload string) (payloads []string, lastIndex uint64, err error) {
+	return e.expand(payload, make(map[string]bool))
+}
+
+// Dependencies returns the keys of the variables and records payload expands
+// from, including those of nested templates and keys that do not exist. If
+// expanding fails, the keys used up to the failure are returned with the
+// error.
+func (e *Expander) Dependencies(payload string) ([]string, error) {
+	e.used = make(map[string]bool)
+	defer func() { e.used = nil }()
+
+	_, _, err := e.expand(payload, make(map[string]bool))
+
+	keys := make([]string, 0, len(e.used))
+	for key := range e.used {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, err
+}
+
+func (e *Expander) expand(payload string, path map[string]bool) (payloads []string, lastIndex uint64, err error) {
+	if strings.HasPrefix(payload, refPrefix) {
+		key := strings.TrimSpace(strings.TrimPrefix(payload, refPrefix))
+
+		if !strings.HasPrefix(key, zonesPrefix) {
+			return nil, 0, fmt.Errorf("Referenced key %s is not a record below %s", key, zonesPrefix)
+		}
+
+		pair, err := e.enter(key, path)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		defer delete(path, key)
+
+		values, err := Payloads(pair.Value())
+
+		if err != nil {
+			return nil, 0, fmt.Errorf("Referenced key %s is invalid: %v", key, err)
+		}
+
+		lastIndex = pair.LastIndex()
+
+		for _, value := range values {
+			expanded, index, err := e.expand(value, path)
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			payloads = append(payloads, expanded...)
+			if index > lastIndex {
+				lastIndex = index
+			}
+		}
+
+		return payloads, lastIndex, nil
+	}
+
+	expanded := varPattern.ReplaceAllStringFunc(payload, func(match string) string {
+		if err != nil {
+			return ""
+		}
+
+		key := fmt.Sprintf("%s/%s", VarsPrefix, varPattern.FindStringSubmatch(match)[1])
+		pair, enterErr := e.enter(key, path)
+
+		if enterErr != nil {
+			err = enterErr
+			return ""
+		}
+
+		defer delete(path, key)
+
+		values, index, expandErr := e.expand(strings.TrimSpace(string(pair.Value())), path)
+
+		if expandErr != nil {
+			err = expandErr
+			return ""
+		} else if len(values) != 1 {
+			err = fmt.Errorf("Variable %s expands to %d values, expected one", key, len(values))
+			return ""
+		}
+
+		if pair.LastIndex() > lastIndex {
+			lastIndex = pair.LastIndex()
+		}
+		if index > lastIndex {
+			lastIndex = index
+		}
+
+		return values[0]
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return []string{expanded}, lastIndex, nil
+}
+
+// enter fetches key and marks it as being expanded
+func (e *Expander) enter(key string, expanding map[string]bool) (store.Pair, error) {
+	if path.Clean(key) != key {
+		return nil, fmt.Errorf("Referenced key %s is not a clean path", key)
+	}
+
+	if expanding[key] {
+		return nil, fmt.Errorf("Reference cycle at %s", key)
+	}
+
+	if e.used != nil {
+		e.used[key] = true
+	}
+
+	pair, err := e.kv.Get(key)
+
+	if err == store.ErrKeyNotFound {
+		return nil, fmt.Errorf("Referenced key %s does not exist", key)
+	} else if err != nil {
+		return nil, err
+	}
+
+	expanding[key] = true
+	return pair, nil
+}
@@ -0,0 +1,111 @@
+package template
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+var templatePairs = map[string]store.Pair{
+	"vars/lb-vip":            store.NewPair("vars/lb-vip", []byte("192.0.2.10\n"), 10),
+	"vars/prefix":            store.NewPair("vars/prefix", []byte("2001:db8"), 11),
+	"vars/v6":                store.NewPair("vars/v6", []byte("{{ var \"prefix\" }}::1"), 12),
+	"vars/ref":               store.NewPair("vars/ref", []byte("@ref zones/example.com/lb/A"), 13),
+	"vars/loop":              store.NewPair("vars/loop", []byte("{{ var \"loop\" }}"), 14),
+	"zones/example.com/lb/A": store.NewPair("zones/example.com/lb/A", []byte("[{\"Payload\":\"{{var \\\"lb-vip\\\"}}\"},{\"Payload\":\"192.0.2.11\"}]"), 20),
+	"zones/example.com/a/A":  store.NewPair("zones/example.com/a/A", []byte("[{\"Payload\":\"@ref zones/example.com/b/A\"}]"), 21),
+	"zones/example.com/b/A":  store.NewPair("zones/example.com/b/A", []byte("[{\"Payload\":\"@ref zones/example.com/a/A\"}]"), 22),
+}
+
+var expandTests = []struct {
+	payload           string
+	expectedPayloads  []string
+	expectedLastIndex uint64
+	expectedErr       bool
+}{
+	{"192.0.2.1", []string{"192.0.2.1"}, 0, false},
+	{"{{ var \"lb-vip\" }}", []string{"192.0.2.10"}, 10, false},
+	{"10 {{var \"lb-vip\"}} 20 {{ var \"lb-vip\" }}", []string{"10 192.0.2.10 20 192.0.2.10"}, 10, false},
+	{"{{ var \"v6\" }}", []string{"2001:db8::1"}, 12, false},
+	{"@ref zones/example.com/lb/A", []string{"192.0.2.10", "192.0.2.11"}, 20, false},
+	{"{{ var \"ref\" }}", nil, 0, true},
+	{"{{ var \"missing\" }}", nil, 0, true},
+	{"@ref zones/example.com/missing/A", nil, 0, true},
+	{"{{ var \"loop\" }}", nil, 0, true},
+	{"@ref zones/example.com/a/A", nil, 0, true},
+	{"@ref soa/example.com", nil, 0, true},
+	{"@ref zones/../soa/example.com", nil, 0, true},
+	{"{{ var \"../soa/example.com\" }}", nil, 0, true},
+}
+
+func TestExpand(t *testing.T) {
+	getFunc := func(key string) (store.Pair, error) {
+		if pair, ok := templatePairs[key]; ok {
+			return pair, nil
+		}
+		return nil, store.ErrKeyNotFound
+	}
+	expander := NewExpander(&store.MockStore{GetFunc: getFunc})
+
+	for _, tt := range expandTests {
+		payloads, lastIndex, err := expander.Expand(tt.payload)
+
+		if (err != nil) != tt.expectedErr {
+			t.Errorf("TestExpand(%s): actual error %v, expected error %v", tt.payload, err, tt.expectedErr)
+			continue
+		}
+
+		if !reflect.DeepEqual(payloads, tt.expectedPayloads) || lastIndex != tt.expectedLastIndex {
+			t.Errorf("TestExpand(%s): actual %v %d, expected %v %d", tt.payload, payloads, lastIndex, tt.expectedPayloads, tt.expectedLastIndex)
+		}
+	}
+}
+
+var dependenciesTests = []struct {
+	payload      string
+	expectedKeys []string
+	expectedErr  bool
+}{
+	{"192.0.2.1", []string{}, false},
+	{"{{ var \"v6\" }}", []string{"vars/prefix", "vars/v6"}, false},
+	{"@ref zones/example.com/lb/A", []string{"vars/lb-vip", "zones/example.com/lb/A"}, false},
+	{"{{ var \"missing\" }}", []string{"vars/missing"}, true},
+}
+
+func TestDependencies(t *testing.T) {
+	getFunc := func(key string) (store.Pair, error) {
+		if pair, ok := templatePairs[key]; ok {
+			return pair, nil
+		}
+		return nil, store.ErrKeyNotFound
+	}
+	expander := NewExpander(&store.MockStore{GetFunc: getFunc})
+
+	for _, tt := range dependenciesTests {
+		keys, err := expander.Dependencies(tt.payload)
+
+		if (err != nil) != tt.expectedErr || !reflect.DeepEqual(keys, tt.expectedKeys) {
+			t.Errorf("TestDependencies(%s): actual %v %v, expected %v", tt.payload, keys, err, tt.expectedKeys)
+		}
+	}
+}
+
+var isTemplateTests = []struct {
+	payload  string
+	expected bool
+}{
+	{"192.0.2.1", false},
+	{"{{ var \"lb-vip\" }}", true},
+	{"{{var \"lb-vip\"}}", true},
+	{"@ref zones/example.com/lb/A", true},
+	{"v=spf1 {{ include }}", false},
+}
+
+func TestIsTemplate(t *testing.T) {
+	for _, tt := range isTemplateTests {
+		if actual := IsTemplate(tt.payload); actual != tt.expected {
+			t.Errorf("TestIsTemplate(%s): actual %v, expected %v", tt.payload, actual, tt.expected)
+		}
+	}
+}
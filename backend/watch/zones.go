@@ -0,0 +1,134 @@
+package watch
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+const DefaultRetryInterval = 5 * time.Second
+
+// ZoneChange describes the keys of a zone before and after a change. Current
+// is empty if the zone was removed.
+type ZoneChange struct {
+	Zone      string
+	LastIndex uint64
+	Previous  []store.Pair
+	Current   []store.Pair
+}
+
+// ZoneWatcher watches zones/ in a store and calls its handlers for every
+// zone whose keys or modify indexes have changed.
+type ZoneWatcher struct {
+	kv            store.Store
+	handlers      []func(*ZoneChange)
+	zones         map[string][]store.Pair
+	retryInterval time.Duration
+}
+
+func NewZoneWatcher(kv store.Store) *ZoneWatcher {
+	return &ZoneWatcher{kv: kv, retryInterval: DefaultRetryInterval}
+}
+
+func (w *ZoneWatcher) OnChange(handler func(*ZoneChange)) {
+	w.handlers = append(w.handlers, handler)
+}
+
+// Run watches the store until stopCh is closed. The first state seen is
+// taken as baseline and does not trigger the handlers.
+func (w *ZoneWatcher) Run(stopCh <-chan struct{}) {
+	for {
+		watchChan, err := w.kv.WatchTree("zones", stopCh)
+
+		if err != nil {
+			logging.Warn("Unable to watch zones", "error", err)
+		} else {
+			for pairs := range watchChan {
+				w.process(pairs)
+			}
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(w.retryInterval):
+			logging.Warn("Watch on zones ended, restarting")
+		}
+	}
+}
+
+func (w *ZoneWatcher) process(pairs []store.Pair) {
+	zones := groupByZone(pairs)
+
+	if w.zones == nil { // baseline
+		w.zones = zones
+		return
+	}
+
+	for zone, current := range zones {
+		if previous := w.zones[zone]; !samePairs(previous, current) {
+			w.notify(&ZoneChange{zone, lastIndex(current), previous, current})
+		}
+	}
+
+	for zone, previous := range w.zones {
+		if _, ok := zones[zone]; !ok {
+			w.notify(&ZoneChange{zone, lastIndex(previous), previous, nil})
+		}
+	}
+
+	w.zones = zones
+}
+
+func (w *ZoneWatcher) notify(change *ZoneChange) {
+	for _, handler := range w.handlers {
+		handler(change)
+	}
+}
+
+func groupByZone(pairs []store.Pair) map[string][]store.Pair {
+	zones := make(map[string][]store.Pair)
+
+	for _, pair := range pairs {
+		tokens := strings.Split(pair.Key(), "/")
+
+		if len(tokens) < 2 || tokens[1] == "" {
+			continue
+		}
+
+		zones[tokens[1]] = append(zones[tokens[1]], pair)
+	}
+
+	return zones
+}
+
+func samePairs(previous []store.Pair, current []store.Pair) bool {
+	if len(previous) != len(current) {
+		return false
+	}
+
+	indexes := make(map[string]uint64, len(previous))
+	for _, pair := range previous {
+		indexes[pair.Key()] = pair.LastIndex()
+	}
+
+	for _, pair := range current {
+		if index, ok := indexes[pair.Key()]; !ok || index != pair.LastIndex() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func lastIndex(pairs []store.Pair) (lastModifyIndex uint64) {
+	for _, pair := range pairs {
+		if pair.LastIndex() > lastModifyIndex {
+			lastModifyIndex = pair.LastIndex()
+		}
+	}
+
+	return lastModifyIndex
+}
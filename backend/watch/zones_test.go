@@ -0,0 +1,71 @@
+package watch
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+func TestZoneWatcher(t *testing.T) {
+	watchChan := make(chan []store.Pair)
+	stopCh := make(chan struct{})
+
+	kv := &store.MockStore{WatchTreeFunc: func(directory string, stopCh <-chan struct{}) (<-chan []store.Pair, error) {
+		return watchChan, nil
+	}}
+
+	var changes []*ZoneChange
+	watcher := NewZoneWatcher(kv)
+	watcher.OnChange(func(change *ZoneChange) {
+		changes = append(changes, change)
+	})
+
+	done := make(chan bool)
+	go func() {
+		watcher.Run(stopCh)
+		done <- true
+	}()
+
+	a1 := store.NewPair("zones/a.com/A", []byte("Value"), 1)
+	a2 := store.NewPair("zones/a.com/A", []byte("Other"), 3)
+	b := store.NewPair("zones/b.com/sub/A", []byte("Value"), 2)
+
+	watchChan <- []store.Pair{a1, b}
+	watchChan <- []store.Pair{a1, b}
+	watchChan <- []store.Pair{a2, b}
+	watchChan <- []store.Pair{a2}
+	close(stopCh)
+	close(watchChan)
+	<-done
+
+	expected := []*ZoneChange{
+		{"a.com", 3, []store.Pair{a1}, []store.Pair{a2}},
+		{"b.com", 2, []store.Pair{b}, nil},
+	}
+
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("TestZoneWatcher: actual %v, expected %v", changes, expected)
+	}
+}
+
+var samePairsTests = []struct {
+	previous []store.Pair
+	current  []store.Pair
+	expected bool
+}{
+	{nil, nil, true},
+	{[]store.Pair{store.NewPair("a", nil, 1)}, []store.Pair{store.NewPair("a", nil, 1)}, true},
+	{[]store.Pair{store.NewPair("a", nil, 1)}, []store.Pair{store.NewPair("a", nil, 2)}, false},
+	{[]store.Pair{store.NewPair("a", nil, 1)}, []store.Pair{store.NewPair("b", nil, 1)}, false},
+	{[]store.Pair{store.NewPair("a", nil, 1), store.NewPair("b", nil, 1)}, []store.Pair{store.NewPair("a", nil, 1)}, false},
+}
+
+func TestSamePairs(t *testing.T) {
+	for _, tt := range samePairsTests {
+		actual := samePairs(tt.previous, tt.current)
+		if actual != tt.expected {
+			t.Errorf("samePairs(%v, %v): expected %v, actual %v", tt.previous, tt.current, tt.expected, actual)
+		}
+	}
+}
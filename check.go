@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/soa"
+	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/health"
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+// validate returns every problem of the configuration without connecting
+// to any store
+func (cfg Config) validate() (problems []error) {
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, a...))
+	}
+
+	if _, ok := dns.IsDomainName(cfg.Hostname); cfg.Hostname == "" || !ok {
+		add("Hostname %q must be the domain name of the primary name server", cfg.Hostname)
+	}
+
+	if _, ok := dns.IsDomainName(cfg.HostmasterEmailAddress); cfg.HostmasterEmailAddress == "" || !ok {
+		add("HostmasterEmailAddress %q must be a domain name, i.e. hostmaster.example.com.", cfg.HostmasterEmailAddress)
+	}
+
+	if len(cfg.Schemas) == 0 {
+		add("No schemas are defined")
+	}
+
+	for i, schemaConfig := range cfg.Schemas {
+		for _, problem := range schemaConfig.validate() {
+			add("Schemas %d: %v", i, problem)
+		}
+	}
+
+	if err := soa.ValidateSerialStrategy(cfg.SoaSerialStrategy); err != nil {
+		add("SoaSerialStrategy: %v", err)
+	}
+
+	if err := soa.ValidateMode(cfg.SoaMode); err != nil {
+		add("SoaMode: %v", err)
+	}
+
+	// libkv keeps the modify index of boltdb in memory, it starts over
+	// after a restart
+	if cfg.usesBackend("boltdb") {
+		if cfg.SoaMode == soa.ModeModifyIndex || cfg.SoaMode == soa.ModeReadOnly {
+			add("SoaMode %s is not supported with boltdb, its modify index starts over after a restart", cfg.SoaMode)
+		}
+
+		if cfg.SoaSerialStrategy == soa.SerialStrategyModifyIndex {
+			add("SoaSerialStrategy modifyindex is not supported with boltdb, its modify index starts over after a restart")
+		}
+	}
+
+	if cfg.usesBackend("zk") && (cfg.WatchZones || cfg.AuditLog != "") {
+		add("WatchZones and AuditLog are not supported with zk, ZooKeeper only watches the direct children of a node")
+	}
+
+	if cfg.HistoryVersions < 0 {
+		add("HistoryVersions must not be negative")
+	}
+
+	for name, address := range map[string]string{"ListenAddress": cfg.ListenAddress, "APIListenAddress": cfg.APIListenAddress, "HealthListenAddress": cfg.HealthListenAddress, "AliasResolver": cfg.AliasResolver} {
+		if err := validateAddress(address); address != "" && err != nil {
+			add("%s: %v", name, err)
+		}
+	}
+
+	for name, secret := range cfg.TsigKeys {
+		if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+			add("TsigKeys %s: secret is not base64: %v", name, err)
+		}
+	}
+
+	for zone, zoneConfig := range cfg.Zones {
+		if _, ok := dns.IsDomainName(zone); !ok {
+			add("Zones %s: not a domain name", zone)
+		}
+
+		if err := soa.ValidateSerialStrategy(zoneConfig.SoaSerialStrategy); err != nil {
+			add("Zones %s: %v", zone, err)
+		} else if zoneConfig.SoaSerialStrategy == soa.SerialStrategyModifyIndex && cfg.usesBackend("boltdb") {
+			add("Zones %s: SoaSerialStrategy modifyindex is not supported with boltdb", zone)
+		}
+
+		for _, secondary := range zoneConfig.Notify {
+			if err := validateAddress(secondary); err != nil {
+				add("Zones %s: Notify: %v", zone, err)
+			}
+		}
+
+		for _, keyName := range zoneConfig.AllowUpdate {
+			if !cfg.hasTsigKey(keyName) {
+				add("Zones %s: AllowUpdate: TSIG key %s is not defined in TsigKeys", zone, keyName)
+			}
+		}
+	}
+
+	if cfg.LogLevel != "" {
+		if _, err := logging.ParseLevel(cfg.LogLevel); err != nil {
+			add("LogLevel: %v", err)
+		}
+	}
+
+	if _, err := logging.New(ioutil.Discard, logging.LevelInfo, cfg.LogFormat); err != nil {
+		add("LogFormat: %v", err)
+	}
+
+	if cfg.QueryLogSampleRate < 0 || cfg.QueryLogSampleRate > 1 {
+		add("QueryLogSampleRate must be between 0 and 1")
+	}
+
+	return problems
+}
+
+func (schemaConfig SchemaConfig) validate() (problems []error) {
+	if _, err := schema.NewSchema(schemaConfig.Name, nil, 0); err != nil {
+		problems = append(problems, err)
+	}
+
+	storeConfigs := []StoreConfig{schemaConfig.StoreConfig}
+
+	switch schemaConfig.Mode {
+	case "":
+	case "failover":
+		storeConfigs = schemaConfig.Stores
+
+		if len(storeConfigs) == 0 {
+			problems = append(problems, fmt.Errorf("No Stores are defined for failover mode"))
+		}
+	default:
+		return append(problems, fmt.Errorf("Unsupported Mode %s, use failover or leave it empty", schemaConfig.Mode))
+	}
+
+	for _, storeConfig := range storeConfigs {
+		if err := store.ValidateBackend(storeConfig.KVBackend); err != nil {
+			problems = append(problems, err)
+		}
+
+		if storeConfig.KVAddress == "" {
+			problems = append(problems, fmt.Errorf("KVAddress of %s is not set", storeConfig.KVBackend))
+		}
+
+		switch storeConfig.KVConsistency {
+		case "", store.ConsistencyDefault, store.ConsistencyStale, store.ConsistencyConsistent:
+		default:
+			problems = append(problems, fmt.Errorf("Unsupported KVConsistency %s, use default, stale or consistent", storeConfig.KVConsistency))
+		}
+	}
+
+	return problems
+}
+
+// usesBackend tells if a store of any schema uses kvBackend
+func (cfg Config) usesBackend(kvBackend string) bool {
+	for _, schemaConfig := range cfg.Schemas {
+		storeConfigs := append([]StoreConfig{schemaConfig.StoreConfig}, schemaConfig.Stores...)
+
+		for _, storeConfig := range storeConfigs {
+			if storeConfig.KVBackend == kvBackend {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (cfg Config) hasTsigKey(name string) bool {
+	for keyName := range cfg.TsigKeys {
+		if strings.EqualFold(keyName, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateAddress accepts a host with an optional port, i.e. 192.0.2.1,
+// :53 or ns.example.com:5353
+func validateAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+
+	if err != nil {
+		host, port = address, "53"
+	}
+
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("Invalid port in %s", address)
+	}
+
+	if _, ok := dns.IsDomainName(host); host != "" && net.ParseIP(host) == nil && !ok {
+		return fmt.Errorf("Invalid host in %s", address)
+	}
+
+	return nil
+}
+
+type checkResult struct {
+	Problems []string       `json:"problems"`
+	Schemas  []*schemaCheck `json:"schemas"`
+}
+
+type schemaCheck struct {
+	Schema string        `json:"schema"`
+	Error  string        `json:"error,omitempty"`
+	Stores []*storeCheck `json:"stores"`
+	Zones  []string      `json:"zones"`
+}
+
+type storeCheck struct {
+	Store string `json:"store"`
+	Error string `json:"error,omitempty"`
+}
+
+// checkConfig validates the configuration, connects to the stores of every
+// schema and lists their zones. It returns an error if anything failed.
+func (cmd *command) checkConfig() error {
+	result := &checkResult{Problems: make([]string, 0), Schemas: make([]*schemaCheck, 0)}
+	failed := 0
+
+	for _, problem := range cmd.config.validate() {
+		result.Problems = append(result.Problems, problem.Error())
+		failed++
+	}
+
+	for _, schemaConfig := range cmd.config.Schemas {
+		check := cmd.checkSchema(schemaConfig)
+
+		if check.Error != "" {
+			failed++
+		}
+
+		for _, storeCheck := range check.Stores {
+			if storeCheck.Error != "" {
+				failed++
+			}
+		}
+
+		result.Schemas = append(result.Schemas, check)
+	}
+
+	if cmd.output == "json" {
+		if err := cmd.printJSON(result); err != nil {
+			return err
+		}
+	} else if err := cmd.printCheck(result); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Found %d problems in the configuration", failed)
+	}
+
+	return nil
+}
+
+func (cmd *command) checkSchema(schemaConfig SchemaConfig) *schemaCheck {
+	check := &schemaCheck{Schema: schemaConfig.Name, Stores: make([]*storeCheck, 0), Zones: make([]string, 0)}
+
+	storeConfigs := []StoreConfig{schemaConfig.StoreConfig}
+	if schemaConfig.Mode == "failover" {
+		storeConfigs = schemaConfig.Stores
+	}
+
+	kvStore, err := newSchemaStore(schemaConfig)
+
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	curSchema, err := schema.NewSchema(schemaConfig.Name, kvStore, cmd.config.DefaultTTL)
+
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	report := (&health.Checker{Schemas: []schema.Schema{curSchema}}).Check().Schemas[0]
+
+	for i, storeReport := range report.Stores {
+		name := fmt.Sprintf("store %d", i)
+		if i < len(storeConfigs) {
+			name = storeConfigs[i].String()
+		}
+
+		check.Stores = append(check.Stores, &storeCheck{Store: name, Error: storeReport.Error})
+	}
+
+	// a failover schema lists its zones from the first store that answers
+	zones, err := curSchema.Zones()
+
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	sort.Strings(zones)
+	check.Zones = zones
+	return check
+}
+
+func (cmd *command) printCheck(result *checkResult) error {
+	for _, problem := range result.Problems {
+		fmt.Fprintf(cmd.out, "Problem: %s\n", problem)
+	}
+
+	if len(result.Problems) > 0 {
+		fmt.Fprintln(cmd.out)
+	}
+
+	var table [][]interface{}
+	for i, check := range result.Schemas {
+		schemaName := fmt.Sprintf("%d %s", i, check.Schema)
+
+		if check.Error != "" && len(check.Stores) == 0 {
+			table = append(table, []interface{}{schemaName, "-", check.Error, "-"})
+			continue
+		}
+
+		for j, storeCheck := range check.Stores {
+			status, zones := "ok", "-"
+
+			if storeCheck.Error != "" {
+				status = storeCheck.Error
+			}
+
+			if j == 0 {
+				zones = strings.Join(check.Zones, ", ")
+
+				if len(check.Zones) == 0 {
+					zones = "none"
+				}
+
+				if check.Error != "" {
+					zones = check.Error
+				}
+			}
+
+			table = append(table, []interface{}{schemaName, storeCheck.Store, status, zones})
+		}
+	}
+
+	return cmd.printTable([]string{"SCHEMA", "STORE", "STATUS", "ZONES"}, table)
+}
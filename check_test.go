@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+func validConfig() Config {
+	return Config{
+		Hostname:               "ns.example.com.",
+		HostmasterEmailAddress: "hostmaster.example.com.",
+		Schemas:                []SchemaConfig{{Name: "flat", StoreConfig: StoreConfig{KVBackend: "consulapi", KVAddress: "127.0.0.1:8500"}}},
+		TsigKeys:               map[string]string{"dhcp": "c2VjcmV0"},
+		Zones:                  map[string]ZoneConfig{"example.com": {Notify: []string{"192.0.2.1", "ns2.example.com:5353"}, AllowUpdate: []string{"DHCP"}}},
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	testCases := []struct {
+		change   func(cfg *Config)
+		expected []string
+	}{
+		{func(cfg *Config) {}, nil},
+		{func(cfg *Config) { cfg.Hostname = "" }, []string{"Hostname"}},
+		{func(cfg *Config) { cfg.HostmasterEmailAddress = "hostmaster@example..com" }, []string{"HostmasterEmailAddress"}},
+		{func(cfg *Config) { cfg.Schemas = nil }, []string{"No schemas are defined"}},
+		{func(cfg *Config) { cfg.Schemas[0].Name = "skydns2" }, []string{"Schemas 0: "}},
+		{func(cfg *Config) { cfg.Schemas[0].KVBackend = "redis" }, []string{"Schemas 0: Unsupported KVBackend redis"}},
+		{func(cfg *Config) { cfg.Schemas[0].KVAddress = "" }, []string{"Schemas 0: KVAddress of consulapi is not set"}},
+		{func(cfg *Config) { cfg.Schemas[0].KVConsistency = "eventual" }, []string{"Schemas 0: Unsupported KVConsistency eventual"}},
+		{func(cfg *Config) { cfg.Schemas[0].Mode = "failover" }, []string{"Schemas 0: No Stores are defined for failover mode"}},
+		{func(cfg *Config) { cfg.Schemas[0].Mode = "roundrobin" }, []string{"Schemas 0: Unsupported Mode roundrobin"}},
+		{func(cfg *Config) { cfg.SoaSerialStrategy = "random" }, []string{"SoaSerialStrategy"}},
+		{func(cfg *Config) { cfg.SoaMode = "writeonly" }, []string{"SoaMode"}},
+		{func(cfg *Config) { cfg.HistoryVersions = -1 }, []string{"HistoryVersions must not be negative"}},
+		{func(cfg *Config) { cfg.Schemas[0].KVBackend, cfg.SoaMode = "boltdb", "readonly" }, []string{"SoaMode readonly is not supported with boltdb"}},
+		{func(cfg *Config) { cfg.Schemas[0].KVBackend, cfg.SoaSerialStrategy = "boltdb", "modifyindex" }, []string{"SoaSerialStrategy modifyindex is not supported with boltdb"}},
+		{func(cfg *Config) { cfg.Schemas[0].KVBackend, cfg.SoaMode = "boltdb", "readwrite" }, nil},
+		{func(cfg *Config) { cfg.Schemas[0].KVBackend, cfg.WatchZones = "zk", true }, []string{"WatchZones and AuditLog are not supported with zk"}},
+		{func(cfg *Config) {
+			cfg.Schemas[0].Mode, cfg.Schemas[0].Stores = "failover", []StoreConfig{{KVBackend: "zk", KVAddress: "zk:2181"}}
+			cfg.AuditLog = "-"
+		}, []string{"WatchZones and AuditLog are not supported with zk"}},
+		{func(cfg *Config) { cfg.ListenAddress = ":99999" }, []string{"ListenAddress: Invalid port"}},
+		{func(cfg *Config) { cfg.TsigKeys["dhcp"] = "not base64!" }, []string{"TsigKeys dhcp: secret is not base64"}},
+		{func(cfg *Config) { cfg.Zones["example.com"] = ZoneConfig{AllowUpdate: []string{"acme"}} }, []string{"Zones example.com: AllowUpdate: TSIG key acme"}},
+		{func(cfg *Config) { cfg.Zones["example.com"] = ZoneConfig{Notify: []string{"192.0.2.1:dns"}} }, []string{"Zones example.com: Notify: Invalid port"}},
+		{func(cfg *Config) { cfg.Zones["example.com"] = ZoneConfig{SoaSerialStrategy: "random"} }, []string{"Zones example.com: "}},
+		{func(cfg *Config) { cfg.LogLevel = "verbose" }, []string{"LogLevel"}},
+		{func(cfg *Config) { cfg.LogFormat = "xml" }, []string{"LogFormat"}},
+		{func(cfg *Config) { cfg.QueryLogSampleRate = 1.5 }, []string{"QueryLogSampleRate must be between 0 and 1"}},
+		{func(cfg *Config) { cfg.Hostname, cfg.HistoryVersions = "", -1 }, []string{"Hostname", "HistoryVersions"}},
+	}
+
+	for i, tc := range testCases {
+		cfg := validConfig()
+		tc.change(&cfg)
+		problems := cfg.validate()
+
+		if len(problems) != len(tc.expected) {
+			t.Errorf("TestConfigValidate %d: actual %v, expected %v", i, problems, tc.expected)
+			continue
+		}
+
+		for j, problem := range problems {
+			if !strings.HasPrefix(problem.Error(), tc.expected[j]) {
+				t.Errorf("TestConfigValidate %d: actual %v, expected %s", i, problem, tc.expected[j])
+			}
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zones.db")
+	kv, err := store.NewStore("boltdb", []string{path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"zones/example.com/NS", "zones/example.org/NS"} {
+		if err := kv.Put(key, []byte(`[{"Payload":"ns.example.com."}]`), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	working := SchemaConfig{Name: "flat", StoreConfig: StoreConfig{KVBackend: "boltdb", KVAddress: path}}
+	down := SchemaConfig{Name: "flat", StoreConfig: StoreConfig{KVBackend: "consulapi", KVAddress: "127.0.0.1:1"}}
+
+	testCases := []struct {
+		schemas     []SchemaConfig
+		hostname    string
+		expectedErr bool
+		expected    []string
+	}{
+		{[]SchemaConfig{working}, "ns.example.com.", false, []string{"0 flat  boltdb " + path + "  ok", "example.com, example.org"}},
+		{[]SchemaConfig{working}, "", true, []string{"Problem: Hostname"}},
+		{[]SchemaConfig{working, down}, "ns.example.com.", true, []string{"1 flat  consulapi 127.0.0.1:1", "connection refused"}},
+	}
+
+	for i, tc := range testCases {
+		cfg := validConfig()
+		cfg.Schemas, cfg.Hostname = tc.schemas, tc.hostname
+		out := new(bytes.Buffer)
+		cmd := &command{config: cfg, output: "table", out: out}
+
+		if err := cmd.run([]string{"check-config"}); (err != nil) != tc.expectedErr {
+			t.Errorf("TestCheckConfig %d: actual %v, expected error %v", i, err, tc.expectedErr)
+		}
+
+		for _, expected := range tc.expected {
+			if !strings.Contains(out.String(), expected) {
+				t.Errorf("TestCheckConfig %d: actual %q, expected it to contain %q", i, out.String(), expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Shark/powerdns-consul/backend/history"
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/soa"
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+const commandUsage = `Commands:
+  check-config                              validate the configuration, connect to every store and list its zones
+  zone list                                 list all zones
+  zone create <zone> <nameserver>...        create a zone with its NS records
+  zone history <zone>                       list the recorded versions of a zone
+  zone diff <zone> <serial> [<serial>]      show the changes between two versions or a version and now
+  zone rollback <zone> <serial>             restore a recorded version of a zone
+  record ls <zone>                          list the records of a zone
+  record add [-ttl n] <name> <type> <data>  add a record to the most specific zone of name
+  record rm <name> <type> [<data>]          remove one or all records of name and type
+  soa show <zone>                           show the SOA record of a zone
+`
+
+// command manages zones and records from the command line
+type command struct {
+	config  Config
+	schemas []schema.Schema
+	output  string // table or json
+	out     io.Writer
+}
+
+type zoneRow struct {
+	Zone   string
+	Serial uint32
+}
+
+func (cmd *command) run(args []string) error {
+	if cmd.output != "table" && cmd.output != "json" {
+		return fmt.Errorf("Unsupported output %s, use table or json", cmd.output)
+	}
+
+	if len(args) == 1 && args[0] == "check-config" {
+		return cmd.checkConfig()
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("Missing command\n%s", commandUsage)
+	}
+
+	switch args[0] + " " + args[1] {
+	case "zone list":
+		return cmd.zoneList()
+	case "zone create":
+		if len(args) < 4 {
+			return fmt.Errorf("Usage: zone create <zone> <nameserver>...")
+		}
+		return cmd.zoneCreate(normalizeName(args[2]), args[3:])
+	case "zone history":
+		if len(args) != 3 {
+			return fmt.Errorf("Usage: zone history <zone>")
+		}
+		return cmd.zoneHistory(normalizeName(args[2]))
+	case "zone diff":
+		if len(args) != 4 && len(args) != 5 {
+			return fmt.Errorf("Usage: zone diff <zone> <serial> [<serial>]")
+		}
+		return cmd.zoneDiff(normalizeName(args[2]), args[3:])
+	case "zone rollback":
+		if len(args) != 4 {
+			return fmt.Errorf("Usage: zone rollback <zone> <serial>")
+		}
+		return cmd.zoneRollback(normalizeName(args[2]), args[3])
+	case "record ls":
+		if len(args) != 3 {
+			return fmt.Errorf("Usage: record ls <zone>")
+		}
+		return cmd.recordList(normalizeName(args[2]))
+	case "record add":
+		return cmd.recordAdd(args[2:])
+	case "record rm":
+		if len(args) != 4 && len(args) != 5 {
+			return fmt.Errorf("Usage: record rm <name> <type> [<data>]")
+		}
+		return cmd.recordRemove(args[2], args[3], args[4:])
+	case "soa show":
+		if len(args) != 3 {
+			return fmt.Errorf("Usage: soa show <zone>")
+		}
+		return cmd.soaShow(normalizeName(args[2]))
+	}
+
+	return fmt.Errorf("Unknown command %s\n%s", strings.Join(args, " "), commandUsage)
+}
+
+func (cmd *command) zoneList() error {
+	rows := make([]zoneRow, 0)
+	seen := make(map[string]bool)
+
+	for _, curSchema := range cmd.schemas {
+		zones, err := curSchema.Zones()
+
+		if err != nil {
+			return err
+		}
+
+		for _, zone := range zones {
+			if seen[zone] {
+				continue
+			}
+			seen[zone] = true
+
+			row := zoneRow{Zone: zone}
+			if entry, err := cmd.soa(zone, curSchema.Store()); err == nil {
+				row.Serial = serialOf(entry)
+			}
+
+			rows = append(rows, row)
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Zone < rows[j].Zone })
+
+	if cmd.output == "json" {
+		return cmd.printJSON(rows)
+	}
+
+	var table [][]interface{}
+	for _, row := range rows {
+		table = append(table, []interface{}{row.Zone, row.Serial})
+	}
+
+	return cmd.printTable([]string{"ZONE", "SERIAL"}, table)
+}
+
+func (cmd *command) zoneCreate(zone string, nameservers []string) error {
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return fmt.Errorf("Invalid zone name %s", zone)
+	}
+
+	if _, _, err := cmd.editor(zone); err == nil {
+		return fmt.Errorf("Zone %s already exists", zone)
+	}
+
+	var editor schema.Editor
+	for _, curSchema := range cmd.schemas {
+		if curEditor, ok := curSchema.(schema.Editor); ok {
+			editor = curEditor
+			break
+		}
+	}
+
+	if editor == nil {
+		return fmt.Errorf("No schema supports creating zones")
+	}
+
+	rrset := &schema.RRset{Name: zone + ".", Type: "NS", TTL: cmd.config.DefaultTTL}
+	for _, nameserver := range nameservers {
+		rrset.Payloads = append(rrset.Payloads, dns.Fqdn(nameserver))
+	}
+
+	if err := rrset.Validate(zone); err != nil {
+		return err
+	}
+
+	return cmd.replace(zone, editor, rrset)
+}
+
+func (cmd *command) zoneHistory(zone string) error {
+	zoneHistory, _, err := cmd.history(zone)
+
+	if err != nil {
+		return err
+	}
+
+	serials, err := zoneHistory.Serials(zone)
+
+	if err != nil {
+		return err
+	}
+
+	versions := make([]*history.Version, 0, len(serials))
+	for _, serial := range serials {
+		version, err := zoneHistory.Load(zone, serial)
+
+		if err != nil {
+			return err
+		}
+
+		versions = append(versions, version)
+	}
+
+	if cmd.output == "json" {
+		return cmd.printJSON(versions)
+	}
+
+	var rows [][]interface{}
+	for _, version := range versions {
+		rows = append(rows, []interface{}{version.Serial, version.Taken.Format(time.RFC3339), len(version.Pairs)})
+	}
+
+	return cmd.printTable([]string{"SERIAL", "TAKEN", "KEYS"}, rows)
+}
+
+func (cmd *command) zoneDiff(zone string, serials []string) error {
+	zoneHistory, kv, err := cmd.history(zone)
+
+	if err != nil {
+		return err
+	}
+
+	var versions []*history.Version
+	for _, serial := range serials {
+		version, err := loadVersion(zoneHistory, zone, serial)
+
+		if err != nil {
+			return err
+		}
+
+		versions = append(versions, version)
+	}
+
+	if len(versions) == 1 {
+		current, err := history.Take(kv, zone, 0, time.Now())
+
+		if err != nil {
+			return err
+		}
+
+		versions = append(versions, current)
+	}
+
+	changes := history.Diff(versions[0], versions[1])
+
+	if cmd.output == "json" {
+		return cmd.printJSON(changes)
+	}
+
+	var rows [][]interface{}
+	for _, change := range changes {
+		rows = append(rows, []interface{}{change.Key, change.Old, change.New})
+	}
+
+	return cmd.printTable([]string{"KEY", "OLD", "NEW"}, rows)
+}
+
+func (cmd *command) zoneRollback(zone string, serial string) error {
+	zoneHistory, kv, err := cmd.history(zone)
+
+	if err != nil {
+		return err
+	}
+
+	version, err := loadVersion(zoneHistory, zone, serial)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := cmd.recordVersion(zone); err != nil {
+		return err
+	}
+
+	if err := history.Restore(kv, version); err != nil {
+		return err
+	}
+
+	if _, _, err := cmd.editor(zone); err != nil {
+		// the restored version has no records, so the zone is gone
+		if cmd.output == "json" {
+			return cmd.printJSON(nil)
+		}
+
+		_, err = fmt.Fprintf(cmd.out, "Restored zone %s from serial %d, the zone has no records now\n", zone, version.Serial)
+		return err
+	}
+
+	// secondaries only transfer the zone again with a higher serial, which
+	// the restored records alone do not give if nothing changed or the SOA
+	// mode is read-only
+	entry, err := soa.NewGenerator(cmd.config.generatorConfig(zone), time.Now()).BumpSerial(kv, zone)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := cmd.recordVersion(zone); err != nil {
+		return err
+	}
+
+	if cmd.output == "json" {
+		return cmd.printJSON(entry)
+	}
+
+	_, err = fmt.Fprintf(cmd.out, "Restored zone %s from serial %d, serial is now %d\n", zone, version.Serial, serialOf(entry))
+	return err
+}
+
+func (cmd *command) recordList(zone string) error {
+	editor, _, err := cmd.editor(zone)
+
+	if err != nil {
+		return err
+	}
+
+	rrsets, err := editor.RRsets(zone)
+
+	if err != nil {
+		return err
+	}
+
+	if cmd.output == "json" {
+		return cmd.printJSON(rrsets)
+	}
+
+	var rows [][]interface{}
+	for _, rrset := range rrsets {
+		for _, payload := range rrset.Payloads {
+			rows = append(rows, []interface{}{rrset.Name, rrset.TTL, rrset.Type, payload})
+		}
+	}
+
+	return cmd.printTable([]string{"NAME", "TTL", "TYPE", "DATA"}, rows)
+}
+
+func (cmd *command) recordAdd(args []string) error {
+	flags := flag.NewFlagSet("record add", flag.ContinueOnError)
+	flags.SetOutput(cmd.out)
+	ttl := flags.Uint("ttl", 0, "TTL of the record set, defaults to its current TTL or DefaultTTL")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 3 {
+		return fmt.Errorf("Usage: record add [-ttl n] <name> <type> <data>")
+	}
+
+	name, rrtype, payload := normalizeName(flags.Arg(0))+".", strings.ToUpper(flags.Arg(1)), flags.Arg(2)
+	zone, editor, rrset, err := cmd.rrset(name, rrtype)
+
+	if err != nil {
+		return err
+	}
+
+	if rrset == nil {
+		rrset = &schema.RRset{Name: name, Type: rrtype, TTL: cmd.config.DefaultTTL}
+	}
+
+	if *ttl != 0 {
+		rrset.TTL = uint32(*ttl)
+	}
+
+	for _, existing := range rrset.Payloads {
+		if existing == payload {
+			return fmt.Errorf("%s %s %s already exists", name, rrtype, payload)
+		}
+	}
+	rrset.Payloads = append(rrset.Payloads, payload)
+
+	if err := rrset.Validate(zone); err != nil {
+		return err
+	}
+
+	return cmd.replace(zone, editor, rrset)
+}
+
+func (cmd *command) recordRemove(name string, rrtype string, payloads []string) error {
+	name, rrtype = normalizeName(name)+".", strings.ToUpper(rrtype)
+	zone, editor, rrset, err := cmd.rrset(name, rrtype)
+
+	if err != nil {
+		return err
+	}
+
+	if rrset == nil {
+		return fmt.Errorf("%s has no %s records", name, rrtype)
+	}
+
+	if len(payloads) == 0 {
+		rrset.Payloads = nil
+		return cmd.replace(zone, editor, rrset)
+	}
+
+	var remaining []string
+	for _, existing := range rrset.Payloads {
+		if existing != payloads[0] {
+			remaining = append(remaining, existing)
+		}
+	}
+
+	if len(remaining) == len(rrset.Payloads) {
+		return fmt.Errorf("%s %s %s does not exist", name, rrtype, payloads[0])
+	}
+
+	rrset.Payloads = remaining
+	return cmd.replace(zone, editor, rrset)
+}
+
+func (cmd *command) soaShow(zone string) error {
+	_, zoneSchema, err := cmd.editor(zone)
+
+	if err != nil {
+		return err
+	}
+
+	entry, err := cmd.soa(zone, zoneSchema.Store())
+
+	if err != nil {
+		return err
+	}
+
+	if cmd.output == "json" {
+		return cmd.printJSON(entry)
+	}
+
+	return cmd.printTable([]string{"NAME", "TTL", "TYPE", "DATA"}, [][]interface{}{{zone + ".", entry.Ttl, entry.Type, entry.Payload}})
+}
+
+// rrset returns the records of name and type in the most specific zone
+// containing name, or nil if there are none
+func (cmd *command) rrset(name string, rrtype string) (string, schema.Editor, *schema.RRset, error) {
+	zone, zoneSchema, err := schema.NewZoneIndex(cmd.schemas).Lookup(strings.TrimSuffix(name, "."))
+
+	if err != nil {
+		return "", nil, nil, err
+	} else if zoneSchema == nil {
+		return "", nil, nil, fmt.Errorf("No zone contains %s", name)
+	}
+
+	editor, ok := zoneSchema.(schema.Editor)
+
+	if !ok {
+		return "", nil, nil, fmt.Errorf("The schema of zone %s does not support editing", zone)
+	}
+
+	rrsets, err := editor.RRsets(zone)
+
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	for _, rrset := range rrsets {
+		if rrset.Name == name && rrset.Type == rrtype {
+			return zone, editor, rrset, nil
+		}
+	}
+
+	return zone, editor, nil, nil
+}
+
+// replace writes rrset and keeps the versions of zone before and after
+func (cmd *command) replace(zone string, editor schema.Editor, rrset *schema.RRset) error {
+	recorded, err := cmd.recordVersion(zone)
+
+	if err != nil {
+		return err
+	}
+
+	if err := editor.ReplaceRRsets(zone, []*schema.RRset{rrset}); err != nil {
+		return err
+	}
+
+	// the zone is gone if the last record was removed
+	if _, zoneSchema, err := cmd.editor(zone); err == nil {
+		entry, err := cmd.updateSOA(zone, zoneSchema.Store())
+
+		if err == nil && recorded != 0 && serialOf(entry) == recorded {
+			// a zone without soa/<zone> was recorded with the serial it is
+			// served with, which the first revision may repeat
+			_, err = soa.NewGenerator(cmd.config.generatorConfig(zone), time.Now()).BumpSerial(zoneSchema.Store(), zone)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = cmd.recordVersion(zone)
+	return err
+}
+
+// recordVersion keeps the current version of zone if History is configured
+// and the zone exists, returning its serial or 0
+func (cmd *command) recordVersion(zone string) (uint32, error) {
+	if _, _, err := cmd.editor(zone); cmd.config.History == "" || err != nil {
+		return 0, nil
+	}
+
+	zoneHistory, kv, err := cmd.history(zone)
+
+	if err != nil {
+		return 0, err
+	}
+
+	entry, err := cmd.soa(zone, kv)
+
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := history.Take(kv, zone, serialOf(entry), time.Now())
+
+	if err != nil {
+		return 0, err
+	}
+
+	return version.Serial, history.Record(zoneHistory, version, cmd.config.HistoryVersions)
+}
+
+// history returns the configured history and the store of zone. Zones that
+// no longer exist are looked up in the first schema that supports editing.
+func (cmd *command) history(zone string) (history.History, store.Store, error) {
+	if cmd.config.History == "" {
+		return nil, nil, fmt.Errorf("No History is configured")
+	}
+
+	if _, zoneSchema, err := cmd.editor(zone); err == nil {
+		return history.New(cmd.config.History, zoneSchema.Store()), zoneSchema.Store(), nil
+	}
+
+	for _, curSchema := range cmd.schemas {
+		if _, ok := curSchema.(schema.Editor); ok {
+			return history.New(cmd.config.History, curSchema.Store()), curSchema.Store(), nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("No schema supports editing zones")
+}
+
+// editor returns the schema serving exactly zone
+func (cmd *command) editor(zone string) (schema.Editor, schema.Schema, error) {
+	found, zoneSchema, err := schema.NewZoneIndex(cmd.schemas).Lookup(zone)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if zoneSchema == nil || found != zone {
+		return nil, nil, fmt.Errorf("Zone %s does not exist", zone)
+	}
+
+	editor, ok := zoneSchema.(schema.Editor)
+
+	if !ok {
+		return nil, nil, fmt.Errorf("The schema of zone %s does not support editing", zone)
+	}
+
+	return editor, zoneSchema, nil
+}
+
+// soa returns the SOA record of zone without creating or bumping its serial
+func (cmd *command) soa(zone string, kv store.Store) (*store.Entry, error) {
+	return cmd.soaEntry(cmd.config.readOnlyGeneratorConfig(zone), zone, kv)
+}
+
+// updateSOA updates the serial of zone after an edit according to SoaMode
+func (cmd *command) updateSOA(zone string, kv store.Store) (*store.Entry, error) {
+	return cmd.soaEntry(cmd.config.generatorConfig(zone), zone, kv)
+}
+
+func (cmd *command) soaEntry(generatorConfig *soa.GeneratorConfig, zone string, kv store.Store) (*store.Entry, error) {
+	entry, err := soa.NewGenerator(generatorConfig, time.Now()).RetrieveOrCreateSOAEntry(kv, zone)
+
+	if err == nil && entry == nil {
+		err = fmt.Errorf("Zone %s has no SOA record", zone)
+	}
+
+	return entry, err
+}
+
+func (cmd *command) printJSON(value interface{}) error {
+	encoder := json.NewEncoder(cmd.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func (cmd *command) printTable(header []string, rows [][]interface{}) error {
+	writer := tabwriter.NewWriter(cmd.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, strings.Join(header, "\t"))
+
+	for _, row := range rows {
+		columns := make([]string, len(row))
+		for i, column := range row {
+			columns[i] = fmt.Sprint(column)
+		}
+		fmt.Fprintln(writer, strings.Join(columns, "\t"))
+	}
+
+	return writer.Flush()
+}
+
+func serialOf(entry *store.Entry) uint32 {
+	if fields := strings.Fields(entry.Payload); len(fields) > 2 {
+		var serial uint32
+		fmt.Sscan(fields[2], &serial)
+		return serial
+	}
+
+	return 0
+}
+
+func loadVersion(zoneHistory history.History, zone string, serial string) (*history.Version, error) {
+	parsed, err := strconv.ParseUint(serial, 10, 32)
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid serial %s", serial)
+	}
+
+	return zoneHistory.Load(zone, uint32(parsed))
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
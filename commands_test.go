@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shark/powerdns-consul/backend/history"
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+func testCommand(pairs map[string]string, output string) (*command, *bytes.Buffer) {
+	out := new(bytes.Buffer)
+	cfg := Config{
+		Hostname:               "ns.example.com.",
+		HostmasterEmailAddress: "hostmaster.example.com.",
+		DefaultTTL:             60,
+		SoaRefresh:             1200,
+		SoaRetry:               180,
+		SoaExpiry:              1209600,
+		SoaNx:                  60,
+		SoaSerialStrategy:      "counter",
+		History:                "store",
+	}
+
+	return &command{config: cfg, schemas: []schema.Schema{schema.NewFlatSchema(store.NewMemoryStore(pairs), 60)}, output: output, out: out}, out
+}
+
+func zoneKeys(pairs map[string]string) []string {
+	var result []string
+	for key := range pairs {
+		if strings.HasPrefix(key, "zones/") {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestZoneCommands(t *testing.T) {
+	pairs := map[string]string{"zones/example.org/NS": `[{"Payload":"ns.example.org."}]`}
+	cmd, out := testCommand(pairs, "table")
+
+	testCases := []struct {
+		args        []string
+		expectedErr bool
+	}{
+		{[]string{"zone", "create", "example.com", "ns1.example.com", "ns2.example.com."}, false},
+		{[]string{"zone", "create", "example.com", "ns1.example.com"}, true},
+		{[]string{"zone", "create", "bad..name", "ns1.example.com"}, true},
+		{[]string{"zone", "create", "example.net"}, true},
+		{[]string{"zone", "bogus"}, true},
+	}
+
+	for _, tc := range testCases {
+		if err := cmd.run(tc.args); (err != nil) != tc.expectedErr {
+			t.Errorf("TestZoneCommands(%v): actual %v, expected error %v", tc.args, err, tc.expectedErr)
+		}
+	}
+
+	if expected := `[{"TTL":60,"Payload":"ns1.example.com."},{"TTL":60,"Payload":"ns2.example.com."}]`; pairs["zones/example.com/NS"] != expected {
+		t.Errorf("TestZoneCommands: actual %s, expected %s", pairs["zones/example.com/NS"], expected)
+	}
+
+	out.Reset()
+	if err := cmd.run([]string{"zone", "list"}); err != nil {
+		t.Fatalf("TestZoneCommands: %v", err)
+	}
+
+	if expected := "ZONE         SERIAL\nexample.com  1\nexample.org  1\n"; out.String() != expected {
+		t.Errorf("TestZoneCommands: actual %q, expected %q", out.String(), expected)
+	}
+
+	out.Reset()
+	cmd.output = "json"
+	if err := cmd.run([]string{"zone", "list"}); err != nil {
+		t.Fatalf("TestZoneCommands: %v", err)
+	}
+
+	var rows []zoneRow
+	if err := json.Unmarshal(out.Bytes(), &rows); err != nil || !reflect.DeepEqual(rows, []zoneRow{{"example.com", 1}, {"example.org", 1}}) {
+		t.Errorf("TestZoneCommands: actual %v %v, expected example.com and example.org", rows, err)
+	}
+
+	if _, ok := pairs["soa/example.org"]; ok {
+		t.Errorf("TestZoneCommands: actual soa/example.org exists, expected listing zones not to create it")
+	}
+}
+
+func TestRecordCommands(t *testing.T) {
+	pairs := map[string]string{
+		"zones/example.com/NS":     `[{"Payload":"ns.example.com."}]`,
+		"zones/dev.example.com/NS": `[{"Payload":"ns.example.com."}]`,
+	}
+	cmd, out := testCommand(pairs, "table")
+
+	testCases := []struct {
+		args        []string
+		expectedErr bool
+	}{
+		{[]string{"record", "add", "-ttl", "300", "www.example.com", "A", "192.0.2.1"}, false},
+		{[]string{"record", "add", "WWW.example.com.", "a", "192.0.2.2"}, false},
+		{[]string{"record", "add", "www.example.com", "A", "192.0.2.2"}, true},
+		{[]string{"record", "add", "www.example.com", "A", "not-an-address"}, true},
+		{[]string{"record", "add", "www.example.org", "A", "192.0.2.1"}, true},
+		{[]string{"record", "add", "host.dev.example.com", "AAAA", "2001:db8::1"}, false},
+		{[]string{"record", "add", "mail.example.com", "MX", "10 mx.example.com."}, false},
+		{[]string{"record", "add", "www.example.com", "A"}, true},
+		{[]string{"record", "rm", "www.example.com", "A", "192.0.2.1"}, false},
+		{[]string{"record", "rm", "www.example.com", "A", "192.0.2.9"}, true},
+		{[]string{"record", "rm", "ftp.example.com", "A"}, true},
+		{[]string{"record", "rm", "mail.example.com", "MX"}, false},
+	}
+
+	for _, tc := range testCases {
+		if err := cmd.run(tc.args); (err != nil) != tc.expectedErr {
+			t.Errorf("TestRecordCommands(%v): actual %v, expected error %v", tc.args, err, tc.expectedErr)
+		}
+	}
+
+	expected := map[string]string{
+		"zones/example.com/www/A":         `[{"TTL":300,"Payload":"192.0.2.2"}]`,
+		"zones/dev.example.com/host/AAAA": `[{"TTL":60,"Payload":"2001:db8::1"}]`,
+	}
+	for key, value := range expected {
+		if pairs[key] != value {
+			t.Errorf("TestRecordCommands(%s): actual %s, expected %s", key, pairs[key], value)
+		}
+	}
+
+	if _, ok := pairs["zones/example.com/mail/MX"]; ok {
+		t.Errorf("TestRecordCommands: actual zones/example.com/mail/MX exists, expected it removed")
+	}
+
+	out.Reset()
+	if err := cmd.run([]string{"record", "ls", "example.com."}); err != nil {
+		t.Fatalf("TestRecordCommands: %v", err)
+	}
+
+	if expected := "NAME              TTL  TYPE  DATA\nexample.com.      60   NS    ns.example.com.\nwww.example.com.  300  A     192.0.2.2\n"; out.String() != expected {
+		t.Errorf("TestRecordCommands: actual %q, expected %q", out.String(), expected)
+	}
+
+	if err := cmd.run([]string{"record", "ls", "example.org"}); err == nil {
+		t.Errorf("TestRecordCommands: actual no error listing a missing zone, expected an error")
+	}
+}
+
+func TestSoaShow(t *testing.T) {
+	pairs := map[string]string{"zones/example.com/NS": `[{"Payload":"ns.example.com."}]`}
+	cmd, out := testCommand(pairs, "table")
+
+	if err := cmd.run([]string{"soa", "show", "example.com"}); err != nil {
+		t.Fatalf("TestSoaShow: %v", err)
+	}
+
+	if expected := "NAME          TTL  TYPE  DATA\nexample.com.  60   SOA   ns.example.com. hostmaster.example.com. 1 1200 180 1209600 60\n"; out.String() != expected {
+		t.Errorf("TestSoaShow: actual %q, expected %q", out.String(), expected)
+	}
+
+	if _, ok := pairs["soa/example.com"]; ok {
+		t.Errorf("TestSoaShow: actual soa/example.com exists, expected showing the SOA not to create it")
+	}
+
+	if err := cmd.run([]string{"soa", "show", "example.org"}); err == nil {
+		t.Errorf("TestSoaShow: actual no error for a missing zone, expected an error")
+	}
+}
+
+func TestHistoryCommands(t *testing.T) {
+	pairs := map[string]string{"zones/example.com/NS": `[{"Payload":"ns.example.com."}]`}
+	cmd, out := testCommand(pairs, "table")
+
+	for _, args := range [][]string{
+		{"record", "add", "www.example.com", "A", "192.0.2.1"},
+		{"record", "add", "www.example.com", "A", "192.0.2.2"},
+	} {
+		if err := cmd.run(args); err != nil {
+			t.Fatalf("TestHistoryCommands(%v): %v", args, err)
+		}
+	}
+
+	serials, err := history.New("store", cmd.schemas[0].Store()).Serials("example.com")
+
+	if expected := []uint32{1, 2, 3}; err != nil || !reflect.DeepEqual(serials, expected) {
+		t.Fatalf("TestHistoryCommands: actual serials %v %v, expected %v", serials, err, expected)
+	}
+
+	out.Reset()
+	if err := cmd.run([]string{"zone", "history", "example.com"}); err != nil || strings.Count(out.String(), "\n") != 4 {
+		t.Errorf("TestHistoryCommands: actual %q %v, expected three versions", out.String(), err)
+	}
+
+	out.Reset()
+	if err := cmd.run([]string{"zone", "diff", "example.com", "1", "3"}); err != nil {
+		t.Fatalf("TestHistoryCommands: %v", err)
+	}
+
+	if expected := "KEY                      OLD  NEW\nzones/example.com/www/A       [{\"TTL\":60,\"Payload\":\"192.0.2.1\"},{\"TTL\":60,\"Payload\":\"192.0.2.2\"}]\n"; out.String() != expected {
+		t.Errorf("TestHistoryCommands: actual %q, expected %q", out.String(), expected)
+	}
+
+	out.Reset()
+	if err := cmd.run([]string{"zone", "rollback", "example.com", "2"}); err != nil {
+		t.Fatalf("TestHistoryCommands: %v", err)
+	}
+
+	if expected := "Restored zone example.com from serial 2, serial is now 4\n"; out.String() != expected {
+		t.Errorf("TestHistoryCommands: actual %q, expected %q", out.String(), expected)
+	}
+
+	if expected := `[{"TTL":60,"Payload":"192.0.2.1"}]`; pairs["zones/example.com/www/A"] != expected {
+		t.Errorf("TestHistoryCommands: actual %s, expected %s", pairs["zones/example.com/www/A"], expected)
+	}
+
+	for _, args := range [][]string{
+		{"zone", "rollback", "example.com", "99"},
+		{"zone", "rollback", "example.com", "two"},
+		{"zone", "diff", "example.com"},
+	} {
+		if err := cmd.run(args); err == nil {
+			t.Errorf("TestHistoryCommands(%v): actual no error, expected an error", args)
+		}
+	}
+}
+
+func TestZoneRollbackToEmptyVersion(t *testing.T) {
+	pairs := map[string]string{"zones/example.com/NS": `[{"Payload":"ns.example.com."}]`}
+	cmd, out := testCommand(pairs, "json")
+	empty := &history.Version{Zone: "example.com", Serial: 1, Taken: time.Now(), Pairs: map[string]string{}}
+
+	if err := history.New("store", cmd.schemas[0].Store()).Save(empty); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cmd.run([]string{"zone", "rollback", "example.com", "1"}); err != nil {
+		t.Fatalf("TestZoneRollbackToEmptyVersion: %v", err)
+	}
+
+	if actual := zoneKeys(pairs); len(actual) != 0 || out.String() != "null\n" {
+		t.Errorf("TestZoneRollbackToEmptyVersion: actual %v %q, expected no keys and null", actual, out.String())
+	}
+}
+
+func TestZoneRollbackTooLarge(t *testing.T) {
+	pairs := map[string]string{"zones/example.com/NS": `[{"Payload":"ns.example.com."}]`}
+	cmd, _ := testCommand(pairs, "table")
+	cmd.schemas[0].Store().(*store.MockStore).MaxTxnOps = store.ConsulMaxTxnOps
+	empty := &history.Version{Zone: "example.com", Serial: 1, Taken: time.Now(), Pairs: map[string]string{}}
+
+	if err := history.New("store", cmd.schemas[0].Store()).Save(empty); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < store.ConsulMaxTxnOps; i++ {
+		pairs[fmt.Sprintf("zones/example.com/host%d/A", i)] = `[{"Payload":"192.0.2.1"}]`
+	}
+
+	err := cmd.run([]string{"zone", "rollback", "example.com", "1"})
+
+	if err == nil || !strings.Contains(err.Error(), "64") {
+		t.Errorf("TestZoneRollbackTooLarge: actual %v, expected an error naming the limit", err)
+	}
+
+	if actual := len(zoneKeys(pairs)); actual != store.ConsulMaxTxnOps+1 {
+		t.Errorf("TestZoneRollbackTooLarge: actual %d keys, expected %d", actual, store.ConsulMaxTxnOps+1)
+	}
+}
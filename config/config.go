@@ -0,0 +1,315 @@
+// Package config reads configuration files in JSON, YAML, TOML or HCL into
+// structs and overrides their fields from the environment or flags.
+//
+// Files in all formats use the field names of the JSON format, matched
+// without regard to case. Fields are overridden by their path, the names of
+// fields, slice indexes and map keys joined with underscores, i.e.
+// Schemas_0_KVAddress.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/hashicorp/hcl"
+	"gopkg.in/yaml.v3"
+)
+
+// UnknownFieldError is returned by Set for paths not naming a field
+type UnknownFieldError struct {
+	Path string
+}
+
+func (err *UnknownFieldError) Error() string {
+	return fmt.Sprintf("Unknown setting %s", err.Path)
+}
+
+// Format returns the format of the file at path by its extension, json if
+// the extension is not known
+func Format(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	case ".hcl":
+		return "hcl"
+	}
+
+	return "json"
+}
+
+// Load decodes the file at path into target, keeping the fields the file
+// does not set
+func Load(path string, target interface{}) error {
+	contents, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	return Decode(contents, Format(path), target)
+}
+
+// Decode decodes contents in format (json, yaml, toml or hcl) into target
+func Decode(contents []byte, format string, target interface{}) error {
+	var (
+		generic = make(map[string]interface{})
+		err     error
+	)
+
+	switch format {
+	case "json":
+		return json.Unmarshal(contents, target)
+	case "yaml":
+		err = yaml.Unmarshal(contents, &generic)
+	case "toml":
+		err = toml.Unmarshal(contents, &generic)
+	case "hcl":
+		err = hcl.Unmarshal(contents, &generic)
+	default:
+		return fmt.Errorf("Unsupported config format %s", format)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// the JSON decoder matches field names and converts numbers the same
+	// way for every format
+	encoded, err := json.Marshal(normalize(generic, reflect.TypeOf(target).Elem()))
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(encoded, target)
+}
+
+// normalize reshapes value to fit type t. HCL decodes every object into a
+// list of maps, which are merged for structs and maps.
+func normalize(value interface{}, t reflect.Type) interface{} {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		object, ok := asObject(value)
+
+		if !ok {
+			return value
+		}
+
+		for key, fieldValue := range object {
+			if fieldType, ok := elemType(t, key); ok {
+				object[key] = normalize(fieldValue, fieldType)
+			}
+		}
+
+		return object
+	case reflect.Slice:
+		var list []interface{}
+
+		switch typed := value.(type) {
+		case []interface{}:
+			list = typed
+		case []map[string]interface{}:
+			for _, object := range typed {
+				list = append(list, object)
+			}
+		default:
+			return value
+		}
+
+		for i := range list {
+			list[i] = normalize(list[i], t.Elem())
+		}
+
+		return list
+	}
+
+	return value
+}
+
+func asObject(value interface{}) (map[string]interface{}, bool) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		return typed, true
+	case []map[string]interface{}:
+		merged := make(map[string]interface{})
+		for _, object := range typed {
+			for key, fieldValue := range object {
+				merged[key] = fieldValue
+			}
+		}
+		return merged, true
+	case []interface{}:
+		merged := make(map[string]interface{})
+		for _, item := range typed {
+			object, ok := asObject(item)
+
+			if !ok {
+				return nil, false
+			}
+
+			for key, fieldValue := range object {
+				merged[key] = fieldValue
+			}
+		}
+		return merged, true
+	}
+
+	return nil, false
+}
+
+// elemType returns the type of field key of struct t or of the values of map t
+func elemType(t reflect.Type, key string) (reflect.Type, bool) {
+	if t.Kind() == reflect.Map {
+		return t.Elem(), true
+	}
+
+	field, ok := t.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, key) })
+	return field.Type, ok
+}
+
+// Set sets the field at path in target, a pointer to a struct. Scalars are
+// parsed, lists of strings are comma separated or a JSON array and anything
+// else is JSON. A slice grows by one if path names the index after its end.
+func Set(target interface{}, path string, value string) error {
+	return set(reflect.ValueOf(target).Elem(), strings.Split(path, "_"), path, value)
+}
+
+// Environment sets the fields named by the variables in environ starting
+// with prefix, i.e. PDNS_CONSUL_HOSTNAME for prefix PDNS_CONSUL_. set is
+// called for every variable, usually with Set.
+func Environment(environ []string, prefix string, set func(path string, value string) error) error {
+	sort.Strings(environ)
+
+	for _, variable := range environ {
+		tokens := strings.SplitN(variable, "=", 2)
+
+		if len(tokens) != 2 || !strings.HasPrefix(tokens[0], prefix) {
+			continue
+		}
+
+		if err := set(strings.TrimPrefix(tokens[0], prefix), tokens[1]); err != nil {
+			return fmt.Errorf("Invalid environment variable %s: %v", tokens[0], err)
+		}
+	}
+
+	return nil
+}
+
+// set only changes v once the whole path has been resolved, so an invalid
+// path leaves target unchanged
+func set(v reflect.Value, tokens []string, path string, value string) error {
+	if len(tokens) == 0 {
+		return parse(v, value)
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		field := v.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, tokens[0]) })
+
+		if !field.IsValid() || !field.CanSet() {
+			return &UnknownFieldError{path}
+		}
+
+		return set(field, tokens[1:], path, value)
+	case reflect.Slice:
+		index, err := strconv.Atoi(tokens[0])
+
+		if err != nil || index < 0 || index > v.Len() {
+			return &UnknownFieldError{path}
+		}
+
+		if index < v.Len() {
+			return set(v.Index(index), tokens[1:], path, value)
+		}
+
+		elem := reflect.New(v.Type().Elem()).Elem()
+
+		if err := set(elem, tokens[1:], path, value); err != nil {
+			return err
+		}
+
+		v.Set(reflect.Append(v, elem))
+		return nil
+	case reflect.Map:
+		key := reflect.ValueOf(strings.ToLower(tokens[0])).Convert(v.Type().Key())
+		elem := reflect.New(v.Type().Elem()).Elem()
+
+		if current := v.MapIndex(key); current.IsValid() {
+			elem.Set(current)
+		}
+
+		if err := set(elem, tokens[1:], path, value); err != nil {
+			return err
+		}
+
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+
+		v.SetMapIndex(key, elem)
+		return nil
+	}
+
+	return &UnknownFieldError{path}
+}
+
+func parse(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(parsed)
+	default:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			v.Set(reflect.ValueOf(list).Convert(v.Type()))
+			return nil
+		}
+
+		parsed := reflect.New(v.Type())
+
+		if err := json.Unmarshal([]byte(value), parsed.Interface()); err != nil {
+			return err
+		}
+
+		v.Set(parsed.Elem())
+	}
+
+	return nil
+}
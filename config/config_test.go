@@ -0,0 +1,206 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testStore struct {
+	KVBackend string
+	KVAddress string
+}
+
+type testSchema struct {
+	Name string
+	testStore
+	Stores []testStore
+}
+
+type testZone struct {
+	Notify []string
+}
+
+type testConfig struct {
+	Hostname   string
+	DefaultTTL uint32
+	WatchZones bool
+	SampleRate float64
+	Schemas    []testSchema
+	Zones      map[string]testZone
+	TsigKeys   map[string]string
+}
+
+func expectedConfig() testConfig {
+	return testConfig{
+		Hostname:   "ns.example.com.",
+		DefaultTTL: 300,
+		WatchZones: true,
+		Schemas: []testSchema{
+			{Name: "flat", testStore: testStore{KVBackend: "consulapi", KVAddress: "127.0.0.1:8500"}},
+			{Name: "flat", Stores: []testStore{{KVBackend: "boltdb", KVAddress: "/a.db"}, {KVBackend: "boltdb", KVAddress: "/b.db"}}},
+		},
+		Zones:    map[string]testZone{"example.com": {Notify: []string{"192.0.2.1"}}},
+		TsigKeys: map[string]string{"dhcp": "c2VjcmV0"},
+	}
+}
+
+func TestDecode(t *testing.T) {
+	testCases := []struct {
+		format   string
+		contents string
+	}{
+		{"json", `{"Hostname": "ns.example.com.", "DefaultTTL": 300, "WatchZones": true,
+  "Schemas": [
+    {"Name": "flat", "KVBackend": "consulapi", "KVAddress": "127.0.0.1:8500"},
+    {"Name": "flat", "Stores": [{"KVBackend": "boltdb", "KVAddress": "/a.db"}, {"KVBackend": "boltdb", "KVAddress": "/b.db"}]}
+  ],
+  "Zones": {"example.com": {"Notify": ["192.0.2.1"]}}, "TsigKeys": {"dhcp": "c2VjcmV0"}}`},
+		{"yaml", `
+hostname: ns.example.com.
+defaultttl: 300
+WatchZones: true
+Schemas:
+  - Name: flat
+    KVBackend: consulapi
+    KVAddress: 127.0.0.1:8500
+  - Name: flat
+    Stores:
+      - {KVBackend: boltdb, KVAddress: /a.db}
+      - {KVBackend: boltdb, KVAddress: /b.db}
+Zones:
+  example.com:
+    Notify: [192.0.2.1]
+TsigKeys:
+  dhcp: c2VjcmV0
+`},
+		{"toml", `
+Hostname = "ns.example.com."
+DefaultTTL = 300
+WatchZones = true
+
+[[Schemas]]
+Name = "flat"
+KVBackend = "consulapi"
+KVAddress = "127.0.0.1:8500"
+
+[[Schemas]]
+Name = "flat"
+Stores = [{KVBackend = "boltdb", KVAddress = "/a.db"}, {KVBackend = "boltdb", KVAddress = "/b.db"}]
+
+[Zones."example.com"]
+Notify = ["192.0.2.1"]
+
+[TsigKeys]
+dhcp = "c2VjcmV0"
+`},
+		{"hcl", `
+Hostname = "ns.example.com."
+DefaultTTL = 300
+WatchZones = true
+
+Schemas {
+  Name = "flat"
+  KVBackend = "consulapi"
+  KVAddress = "127.0.0.1:8500"
+}
+
+Schemas {
+  Name = "flat"
+  Stores = [{KVBackend = "boltdb", KVAddress = "/a.db"}, {KVBackend = "boltdb", KVAddress = "/b.db"}]
+}
+
+Zones "example.com" {
+  Notify = ["192.0.2.1"]
+}
+
+TsigKeys {
+  dhcp = "c2VjcmV0"
+}
+`},
+	}
+
+	for _, tc := range testCases {
+		var actual testConfig
+		err := Decode([]byte(tc.contents), tc.format, &actual)
+
+		if expected := expectedConfig(); err != nil || !reflect.DeepEqual(actual, expected) {
+			t.Errorf("TestDecode(%s): actual %+v %v, expected %+v", tc.format, actual, err, expected)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	testCases := map[string]string{
+		"/etc/powerdns-consul/config.json": "json",
+		"config.YAML":                      "yaml",
+		"config.yml":                       "yaml",
+		"config.toml":                      "toml",
+		"config.hcl":                       "hcl",
+		"config":                           "json",
+	}
+
+	for path, expected := range testCases {
+		if actual := Format(path); actual != expected {
+			t.Errorf("TestFormat(%s): actual %s, expected %s", path, actual, expected)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	testCases := []struct {
+		path  string
+		value string
+		valid bool
+	}{
+		{"HOSTNAME", "ns.example.com.", true},
+		{"DefaultTTL", "300", true},
+		{"WatchZones", "true", true},
+		{"Schemas_0_Name", "flat", true},
+		{"SCHEMAS_0_KVBACKEND", "consulapi", true},
+		{"Schemas_0_KVAddress", "127.0.0.1:8500", true},
+		{"Schemas_1", `{"Name": "flat"}`, true},
+		{"Schemas_1_Stores", `[{"KVBackend": "boltdb", "KVAddress": "/a.db"}]`, true},
+		{"Schemas_1_Stores_1_KVBackend", "boltdb", true},
+		{"Schemas_1_Stores_1_KVAddress", "/b.db", true},
+		{"ZONES_EXAMPLE.COM_NOTIFY", "192.0.2.1", true},
+		{"TsigKeys_DHCP", "c2VjcmV0", true},
+		{"DefaultTTL", "-1", false},
+		{"WatchZones", "maybe", false},
+		{"Schemas_5_Name", "flat", false},
+		{"Schemas_2_Bogus", "x", false},
+		{"Bogus", "x", false},
+		{"Hostname_Bogus", "x", false},
+	}
+
+	var actual testConfig
+
+	for _, tc := range testCases {
+		if err := Set(&actual, tc.path, tc.value); (err == nil) != tc.valid {
+			t.Errorf("TestSet(%s=%s): actual %v, expected valid %v", tc.path, tc.value, err, tc.valid)
+		}
+	}
+
+	if expected := expectedConfig(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TestSet: actual %+v, expected %+v", actual, expected)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	var actual testConfig
+	environ := []string{"HOME=/root", "PDNS_CONSUL_ZONES_EXAMPLE.COM_NOTIFY=192.0.2.1, 192.0.2.2", "PDNS_CONSUL_HOSTNAME=ns.example.com."}
+
+	err := Environment(environ, "PDNS_CONSUL_", func(path string, value string) error {
+		return Set(&actual, path, value)
+	})
+	expected := testConfig{Hostname: "ns.example.com.", Zones: map[string]testZone{"example.com": {Notify: []string{"192.0.2.1", "192.0.2.2"}}}}
+
+	if err != nil || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TestEnvironment: actual %+v %v, expected %+v", actual, err, expected)
+	}
+
+	if err = Environment([]string{"PDNS_CONSUL_BOGUS=1"}, "PDNS_CONSUL_", func(path string, value string) error {
+		return Set(&actual, path, value)
+	}); err == nil {
+		t.Errorf("TestEnvironment: expected an error for an unknown setting")
+	}
+}
@@ -0,0 +1,255 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+// Server is an authoritative DNS server answering from the same resolve
+// function the pipe backend uses, so PowerDNS is not required.
+type Server struct {
+	Resolve func(query *store.Query) (*schema.Result, error)
+
+	// Update applies a TSIG-signed dynamic update (RFC 2136) signed with
+	// keyName to zone and returns the response code. Updates are refused if
+	// it is nil.
+	Update      func(zone string, keyName string, prerequisites []dns.RR, updates []dns.RR) int
+	TsigSecrets map[string]string // base64 secrets by fully qualified key name
+
+	// Log is called with the answer to every query, once even if it took
+	// several lookups, if it is not nil
+	Log func(query *store.Query, result *schema.Result, err error, start time.Time)
+}
+
+// ListenAndServe serves DNS on address over UDP and TCP until one of the
+// listeners fails.
+func (s *Server) ListenAndServe(address string) error {
+	errChan := make(chan error, 2)
+
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: address, Net: network, Handler: s, TsigSecret: s.TsigSecrets, MsgAcceptFunc: acceptMsg}
+
+		go func() {
+			errChan <- server.ListenAndServe()
+		}()
+	}
+
+	return <-errChan
+}
+
+// WithDefaultPort adds the DNS port 53 to address unless it has a port
+func WithDefaultPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+
+	return net.JoinHostPort(address, "53")
+}
+
+// acceptMsg extends dns.DefaultMsgAcceptFunc by UPDATE messages, which are
+// checked by the handler
+func acceptMsg(header dns.Header) dns.MsgAcceptAction {
+	if opcode := int(header.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate {
+		return dns.MsgAccept
+	}
+
+	return dns.DefaultMsgAcceptFunc(header)
+}
+
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if req.Opcode == dns.OpcodeUpdate {
+		// the TSIG record has to stay last, so no EDNS or truncation
+		if err := w.WriteMsg(s.update(req, w.TsigStatus())); err != nil {
+			logging.Warn("Unable to write DNS response", "remote_ip", w.RemoteAddr().String(), "error", err)
+		}
+		return
+	}
+
+	var remoteIp string
+	if host, _, err := net.SplitHostPort(w.RemoteAddr().String()); err == nil {
+		remoteIp = host
+	}
+
+	resp := s.answer(req, remoteIp)
+
+	if req.IsEdns0() != nil {
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+	}
+
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	} else {
+		resp.Truncate(dns.MaxMsgSize)
+	}
+
+	if err := w.WriteMsg(resp); err != nil {
+		logging.Warn("Unable to write DNS response", "remote_ip", w.RemoteAddr().String(), "error", err)
+	}
+}
+
+func (s *Server) answer(req *dns.Msg, remoteIp string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	if req.Opcode != dns.OpcodeQuery {
+		resp.SetRcode(req, dns.RcodeNotImplemented)
+		return resp
+	}
+
+	if len(req.Question) != 1 {
+		resp.SetRcode(req, dns.RcodeFormatError)
+		return resp
+	}
+
+	question := req.Question[0]
+
+	if question.Qclass != dns.ClassINET {
+		resp.SetRcode(req, dns.RcodeRefused)
+		return resp
+	}
+
+	qname := strings.TrimSuffix(question.Name, ".")
+	qtype := dns.TypeToString[question.Qtype]
+
+	start := time.Now()
+	query := &store.Query{Name: qname, Type: qtype, RemoteIp: remoteIp, Authority: true}
+	result, err := s.Resolve(query)
+
+	if err == nil && len(result.Entries) == 0 && result.NameExists && result.Delegation == "" && qtype != "CNAME" && qtype != "ANY" {
+		var cnameResult *schema.Result
+		cnameResult, err = s.Resolve(&store.Query{Name: qname, Type: "CNAME", RemoteIp: remoteIp})
+
+		if err == nil && len(cnameResult.Entries) > 0 {
+			result = cnameResult
+		}
+	}
+
+	if s.Log != nil {
+		s.Log(query, result, err, start)
+	}
+
+	if err != nil {
+		logging.Error("Query failed", "qname", qname, "qtype", qtype, "remote_ip", remoteIp, "error", err)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		return resp
+	}
+
+	if result.Zone == "" { // not authoritative
+		resp.SetRcode(req, dns.RcodeRefused)
+		return resp
+	}
+
+	if result.Delegation != "" {
+		return referral(resp, result)
+	}
+
+	resp.Authoritative = true
+
+	for _, entry := range result.Entries {
+		if rr := toRR(question.Name, entry); rr != nil {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+
+	if len(resp.Answer) == 0 {
+		if !result.NameExists {
+			resp.Rcode = dns.RcodeNameError
+		}
+
+		for _, entry := range result.Authority {
+			rr := toRR(dns.Fqdn(result.Zone), entry)
+
+			// RFC 2308: the SOA of negative answers is cached for the minimum
+			// of its TTL and its minimum field
+			if soaRR, ok := rr.(*dns.SOA); ok && soaRR.Minttl < soaRR.Hdr.Ttl {
+				soaRR.Hdr.Ttl = soaRR.Minttl
+			}
+
+			if rr != nil {
+				resp.Ns = append(resp.Ns, rr)
+			}
+		}
+	}
+
+	return resp
+}
+
+// update handles an UPDATE message whose TSIG signature was verified with
+// the result tsigStatus
+func (s *Server) update(req *dns.Msg, tsigStatus error) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		resp.SetRcode(req, dns.RcodeFormatError)
+		return resp
+	}
+
+	tsig := req.IsTsig()
+
+	if s.Update == nil || tsig == nil {
+		resp.SetRcode(req, dns.RcodeRefused)
+		return resp
+	}
+
+	if tsigStatus != nil {
+		logging.Warn("Rejecting update", "key", tsig.Hdr.Name, "error", tsigStatus)
+		resp.SetRcode(req, dns.RcodeNotAuth)
+		return resp
+	}
+
+	zone := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	resp.SetRcode(req, s.Update(zone, tsig.Hdr.Name, req.Answer, req.Ns))
+	resp.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+
+	return resp
+}
+
+// referral points the client to the name servers of the delegated zone
+func referral(resp *dns.Msg, result *schema.Result) *dns.Msg {
+	for _, entry := range result.Authority {
+		if rr := toRR(dns.Fqdn(result.Delegation), entry); rr != nil {
+			resp.Ns = append(resp.Ns, rr)
+		}
+	}
+
+	names := make([]string, 0, len(result.Additional))
+	for name := range result.Additional {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, entry := range result.Additional[name] {
+			if rr := toRR(dns.Fqdn(name), entry); rr != nil {
+				resp.Extra = append(resp.Extra, rr)
+			}
+		}
+	}
+
+	return resp
+}
+
+func toRR(name string, entry *store.Entry) dns.RR {
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, entry.Ttl, entry.Type, entry.Payload))
+
+	if err != nil || rr == nil {
+		logging.Warn("Discarding record", "name", name, "type", entry.Type, "content", entry.Payload, "error", err)
+		return nil
+	}
+
+	return rr
+}
@@ -0,0 +1,274 @@
+package dnsserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+var testSOA = &store.Entry{Type: "SOA", Ttl: 3600, Payload: "ns.example.com. hostmaster.example.com. 2016050400 1200 180 1209600 60"}
+
+var testRecords = map[string][]*store.Entry{
+	"example.com": {
+		testSOA,
+		{Type: "A", Ttl: 60, Payload: "127.0.0.1"},
+		{Type: "MX", Ttl: 60, Payload: "10\tmx1.example.com"},
+	},
+	"www.example.com": {
+		{Type: "CNAME", Ttl: 60, Payload: "example.com."},
+	},
+	"a.ent.example.com": {
+		{Type: "A", Ttl: 60, Payload: "127.0.0.2"},
+	},
+}
+
+func testResolve(query *store.Query) (*schema.Result, error) {
+	name := strings.ToLower(query.Name)
+
+	if name != "example.com" && !strings.HasSuffix(name, ".example.com") {
+		return &schema.Result{}, nil
+	}
+
+	if name == "dev.example.com" || strings.HasSuffix(name, ".dev.example.com") {
+		return &schema.Result{
+			Zone:       "example.com",
+			NameExists: true,
+			Authority:  []*store.Entry{{Type: "NS", Ttl: 60, Payload: "ns1.dev.example.com."}},
+			Delegation: "dev.example.com",
+			Additional: map[string][]*store.Entry{"ns1.dev.example.com": {{Type: "A", Ttl: 60, Payload: "192.0.2.1"}}},
+		}, nil
+	}
+
+	result := &schema.Result{Zone: "example.com", NameExists: name == "ent.example.com" || name == "big.example.com"}
+
+	for _, entry := range testRecords[name] {
+		result.NameExists = true
+
+		if query.Type == "ANY" || query.Type == entry.Type {
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+
+	if name == "big.example.com" {
+		for i := 0; i < 100; i++ {
+			result.Entries = append(result.Entries, &store.Entry{Type: "A", Ttl: 60, Payload: fmt.Sprintf("127.0.0.%d", i)})
+		}
+	}
+
+	if len(result.Entries) == 0 && query.Authority {
+		result.Authority = []*store.Entry{testSOA}
+	}
+
+	return result, nil
+}
+
+var answerTests = []struct {
+	qname         string
+	qtype         uint16
+	expectedRcode int
+	expectedAA    bool
+	expectedAns   []string
+	expectedNs    int
+}{
+	{"example.com.", dns.TypeA, dns.RcodeSuccess, true, []string{"127.0.0.1"}, 0},
+	{"EXAMPLE.com.", dns.TypeMX, dns.RcodeSuccess, true, []string{"mx1.example.com."}, 0},
+	{"example.com.", dns.TypeAAAA, dns.RcodeSuccess, true, nil, 1},
+	{"www.example.com.", dns.TypeA, dns.RcodeSuccess, true, []string{"example.com."}, 0},
+	{"www.example.com.", dns.TypeCNAME, dns.RcodeSuccess, true, []string{"example.com."}, 0},
+	{"ent.example.com.", dns.TypeA, dns.RcodeSuccess, true, nil, 1},
+	{"a.ent.example.com.", dns.TypeAAAA, dns.RcodeSuccess, true, nil, 1},
+	{"nothing.example.com.", dns.TypeA, dns.RcodeNameError, true, nil, 1},
+	{"example.org.", dns.TypeA, dns.RcodeRefused, false, nil, 0},
+}
+
+func TestAnswer(t *testing.T) {
+	server := &Server{Resolve: testResolve}
+
+	for _, tt := range answerTests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, tt.qtype)
+
+		resp := server.answer(req, "")
+
+		if resp.Rcode != tt.expectedRcode || resp.Authoritative != tt.expectedAA {
+			t.Errorf("TestAnswer(%s): actual rcode %d, aa %v, expected %d, %v", tt.qname, resp.Rcode, resp.Authoritative, tt.expectedRcode, tt.expectedAA)
+		}
+
+		if len(resp.Answer) != len(tt.expectedAns) {
+			t.Errorf("TestAnswer(%s): actual answer %v, expected %v", tt.qname, resp.Answer, tt.expectedAns)
+			continue
+		}
+
+		for i, rr := range resp.Answer {
+			if !strings.HasSuffix(rr.String(), tt.expectedAns[i]) {
+				t.Errorf("TestAnswer(%s): actual answer %s, expected %s", tt.qname, rr, tt.expectedAns[i])
+			}
+		}
+
+		if len(resp.Ns) != tt.expectedNs {
+			t.Errorf("TestAnswer(%s): actual authority %v, expected %d records", tt.qname, resp.Ns, tt.expectedNs)
+		}
+
+		if len(resp.Ns) == 1 && resp.Ns[0].Header().Ttl != 60 {
+			t.Errorf("TestAnswer(%s): actual negative TTL %d, expected 60", tt.qname, resp.Ns[0].Header().Ttl)
+		}
+	}
+}
+
+func TestAnswerLog(t *testing.T) {
+	var logged []string
+	server := &Server{Resolve: testResolve, Log: func(query *store.Query, result *schema.Result, err error, start time.Time) {
+		logged = append(logged, fmt.Sprintf("%s %s %d", query.Name, query.Type, len(result.Entries)))
+	}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA) // answered by the CNAME fallback
+	server.answer(req, "")
+
+	if expected := []string{"www.example.com A 1"}; fmt.Sprint(logged) != fmt.Sprint(expected) {
+		t.Errorf("TestAnswerLog: actual %v, expected %v", logged, expected)
+	}
+}
+
+func TestAnswerReferral(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("host.dev.example.com.", dns.TypeA)
+
+	resp := (&Server{Resolve: testResolve}).answer(req, "")
+
+	if resp.Rcode != dns.RcodeSuccess || resp.Authoritative || len(resp.Answer) != 0 {
+		t.Errorf("TestAnswerReferral: actual rcode %d, aa %v, answer %v, expected a referral", resp.Rcode, resp.Authoritative, resp.Answer)
+	}
+
+	if len(resp.Ns) != 1 || resp.Ns[0].String() != "dev.example.com.\t60\tIN\tNS\tns1.dev.example.com." {
+		t.Errorf("TestAnswerReferral: actual authority %v, expected NS of dev.example.com.", resp.Ns)
+	}
+
+	if len(resp.Extra) != 1 || resp.Extra[0].String() != "ns1.dev.example.com.\t60\tIN\tA\t192.0.2.1" {
+		t.Errorf("TestAnswerReferral: actual additional %v, expected glue of ns1.dev.example.com.", resp.Extra)
+	}
+}
+
+func TestServeDNSTruncation(t *testing.T) {
+	conn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	listener, _ := net.Listen("tcp", conn.LocalAddr().String())
+	server := &Server{Resolve: testResolve}
+
+	udpServer := &dns.Server{PacketConn: conn, Handler: server}
+	tcpServer := &dns.Server{Listener: listener, Handler: server}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	req := new(dns.Msg)
+	req.SetQuestion("big.example.com.", dns.TypeA)
+
+	resp, _, err := (&dns.Client{Net: "udp"}).Exchange(req, conn.LocalAddr().String())
+
+	if err != nil || !resp.Truncated {
+		t.Errorf("TestServeDNSTruncation: expected truncated UDP response, actual %v %v", err, resp)
+	}
+
+	resp, _, err = (&dns.Client{Net: "tcp"}).Exchange(req, conn.LocalAddr().String())
+
+	if err != nil || resp.Truncated || len(resp.Answer) != 100 {
+		t.Errorf("TestServeDNSTruncation: expected 100 answers over TCP, actual %v %v", err, resp)
+	}
+}
+
+func TestServeDNSUpdate(t *testing.T) {
+	conn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	var updates []dns.RR
+	server := &Server{
+		Resolve: testResolve,
+		Update: func(zone string, keyName string, prerequisites []dns.RR, rrs []dns.RR) int {
+			if zone != "example.com" || keyName != "dhcp." {
+				return dns.RcodeRefused
+			}
+			updates = append(updates, rrs...)
+			return dns.RcodeSuccess
+		},
+		TsigSecrets: map[string]string{"dhcp.": "c2VjcmV0"},
+	}
+
+	udpServer := &dns.Server{PacketConn: conn, Handler: server, TsigSecret: server.TsigSecrets, MsgAcceptFunc: acceptMsg}
+	go udpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+
+	newUpdate := func() *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetUpdate("example.com.")
+		rr, _ := dns.NewRR("host.example.com. 300 IN A 192.0.2.1")
+		msg.Insert([]dns.RR{rr})
+		return msg
+	}
+
+	tests := []struct {
+		name          string
+		secret        string
+		signed        bool
+		expectedRcode int
+	}{
+		{"signed", "c2VjcmV0", true, dns.RcodeSuccess},
+		{"wrong secret", "b3RoZXI=", true, dns.RcodeNotAuth},
+		{"unsigned", "", false, dns.RcodeRefused},
+	}
+
+	for _, tt := range tests {
+		msg := newUpdate()
+		client := &dns.Client{Net: "udp"}
+
+		if tt.signed {
+			msg.SetTsig("dhcp.", dns.HmacSHA256, 300, time.Now().Unix())
+			client.TsigSecret = map[string]string{"dhcp.": tt.secret}
+		}
+
+		resp, _, err := client.Exchange(msg, conn.LocalAddr().String())
+
+		// a response to a request with a wrong secret cannot be verified
+		if resp == nil {
+			t.Errorf("TestServeDNSUpdate(%s): unexpected error %v", tt.name, err)
+			continue
+		}
+
+		if resp.Rcode != tt.expectedRcode {
+			t.Errorf("TestServeDNSUpdate(%s): actual rcode %s, expected %s", tt.name, dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.expectedRcode])
+		}
+
+		if tt.expectedRcode == dns.RcodeSuccess && (err != nil || resp.IsTsig() == nil) {
+			t.Errorf("TestServeDNSUpdate(%s): expected a signed response, actual %v", tt.name, err)
+		}
+	}
+
+	if len(updates) != 1 || updates[0].Header().Name != "host.example.com." {
+		t.Errorf("TestServeDNSUpdate: actual updates %v, expected host.example.com.", updates)
+	}
+}
+
+var withDefaultPortTests = []struct {
+	in       string
+	expected string
+}{
+	{"192.0.2.1", "192.0.2.1:53"},
+	{"192.0.2.1:5353", "192.0.2.1:5353"},
+	{"2001:db8::1", "[2001:db8::1]:53"},
+	{"[2001:db8::1]:5353", "[2001:db8::1]:5353"},
+	{"ns1.example.com", "ns1.example.com:53"},
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	for _, tt := range withDefaultPortTests {
+		actual := WithDefaultPort(tt.in)
+		if actual != tt.expected {
+			t.Errorf("TestWithDefaultPort(%s): actual %s, expected %s", tt.in, actual, tt.expected)
+		}
+	}
+}
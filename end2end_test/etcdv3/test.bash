@@ -0,0 +1,20 @@
+test_prepare() {
+  cd /kv
+  tar xzvf etcd.tar.gz
+
+  cd "etcd-v${ETCD_VERSION}-linux-amd64"
+  ./etcd &
+  cp /test/etcdv3/config.json /etc/powerdns-consul/config.json
+
+  sleep 2
+
+  etcdv3_kv_prepare
+}
+
+etcdv3_kv_prepare() {
+  export ETCDCTL_API=3
+  ./etcdctl put "zones/example.com/A" '[{"Payload": "127.0.0.1"}]'
+  ./etcdctl put "zones/example.com/MX" '[{"Payload": "10\tmx1.example.com"},{"Payload": "20\tmx2.example.com"}]'
+  ./etcdctl put "zones/example.com/mx1/A" '[{"Payload": "127.0.0.2"}]'
+  ./etcdctl put "zones/example.com/mx2/A" '[{"Payload": "127.0.0.3"}]'
+}
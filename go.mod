@@ -3,14 +3,22 @@ module github.com/Shark/powerdns-consul
 go 1.16
 
 require (
-	github.com/coreos/etcd v3.1.0-rc.0.0.20161105055942-ecd4803ccc6a+incompatible // indirect
+	github.com/BurntSushi/toml v1.2.1
+	github.com/boltdb/bolt v1.3.1 // indirect
+	github.com/coreos/etcd v3.3.25+incompatible // indirect
+	github.com/coreos/go-semver v0.3.0 // indirect
 	github.com/docker/libkv v0.2.2-0.20160826060701-3fce6a0f26e0
-	github.com/hashicorp/consul v0.6.5-0.20160420171606-963916e990bc // indirect
-	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
+	github.com/hashicorp/consul/api v1.4.0
+	github.com/hashicorp/go-cleanhttp v0.5.2
 	github.com/hashicorp/go-msgpack v1.1.5 // indirect
 	github.com/hashicorp/golang-lru v0.5.4 // indirect
-	github.com/hashicorp/hcl v1.0.0 // indirect
+	github.com/hashicorp/hcl v1.0.0
 	github.com/hashicorp/serf v0.9.5 // indirect
+	github.com/json-iterator/go v1.1.12 // indirect
+	github.com/miekg/dns v1.1.50
+	github.com/samuel/go-zookeeper v0.0.0-20180130194729-c4fab1ac1bec
 	github.com/stretchr/testify v1.7.0 // indirect
-	github.com/ugorji/go v0.0.0-20160928015244-faddd6128c66 // indirect
+	go.etcd.io/etcd/api/v3 v3.5.2
+	go.etcd.io/etcd/client/v3 v3.5.2
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,211 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+// DefaultTimeout is how long a store may take to answer a check
+const DefaultTimeout = 5 * time.Second
+
+// DefaultInterval is the time between two checks run in the background
+const DefaultInterval = 10 * time.Second
+
+var (
+	errTimeout = errors.New("Store did not answer in time")
+	errPending = errors.New("Store has not answered the previous check yet")
+)
+
+// Checker checks whether the stores of the schemas can be reached. Schemas
+// and stores are reported by their position in the configuration. Healthy
+// and ServeHTTP answer from the report of the last check, so they never wait
+// for a store.
+type Checker struct {
+	Schemas  []schema.Schema
+	Timeout  time.Duration // DefaultTimeout if zero
+	Interval time.Duration // DefaultInterval if zero
+
+	mutex   sync.Mutex
+	report  *Report
+	pending map[backend]bool // stores whose last ping has not returned yet
+}
+
+// backend identifies a store by the positions of its schema and itself
+type backend struct {
+	schema, store int
+}
+
+type Report struct {
+	Ready   bool            `json:"ready"`
+	Schemas []*SchemaReport `json:"schemas"`
+}
+
+type SchemaReport struct {
+	Schema int            `json:"schema"`
+	Zones  int            `json:"zones"`
+	Error  string         `json:"error,omitempty"` // why the zones could not be listed
+	Stores []*StoreReport `json:"stores"`
+}
+
+type StoreReport struct {
+	Store int    `json:"store"`
+	Error string `json:"error,omitempty"`
+}
+
+// Run checks the stores every Interval until stopCh is closed, and right
+// away unless they have been checked before
+func (c *Checker) Run(stopCh <-chan struct{}) {
+	interval := c.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+
+	if c.Report() == nil {
+		c.Check()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Check()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// Report returns the report of the last check, nil before the first one
+func (c *Checker) Report() *Report {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.report
+}
+
+// Check reports every store of every schema, it is ready if all stores can
+// be reached and all zones listed. The report is kept for Healthy and
+// ServeHTTP.
+func (c *Checker) Check() *Report {
+	report := &Report{Ready: len(c.Schemas) > 0, Schemas: make([]*SchemaReport, 0)}
+
+	for i, curSchema := range c.Schemas {
+		schemaReport := &SchemaReport{Schema: i, Stores: make([]*StoreReport, 0)}
+
+		for j, kv := range store.Backends(curSchema.Store()) {
+			storeReport := &StoreReport{Store: j}
+
+			if err := c.ping(backend{i, j}, kv); err != nil {
+				storeReport.Error = err.Error()
+				report.Ready = false
+			}
+
+			schemaReport.Stores = append(schemaReport.Stores, storeReport)
+		}
+
+		if zones, err := curSchema.Zones(); err != nil {
+			schemaReport.Error = err.Error()
+			report.Ready = false
+		} else {
+			schemaReport.Zones = len(zones)
+		}
+
+		report.Schemas = append(report.Schemas, schemaReport)
+	}
+
+	c.mutex.Lock()
+	c.report = report
+	c.mutex.Unlock()
+
+	return report
+}
+
+// Healthy tells if any store could be reached by the last check, so at
+// least some queries can be answered
+func (c *Checker) Healthy() bool {
+	report := c.Report()
+
+	if report == nil {
+		return false
+	}
+
+	for _, schemaReport := range report.Schemas {
+		for _, storeReport := range schemaReport.Stores {
+			if storeReport.Error == "" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ping fails right away while the previous ping of the store has not
+// returned, so a hung store does not pile up goroutines
+func (c *Checker) ping(id backend, kv store.Store) error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	c.mutex.Lock()
+	if c.pending[id] {
+		c.mutex.Unlock()
+		return errPending
+	}
+	if c.pending == nil {
+		c.pending = make(map[backend]bool)
+	}
+	c.pending[id] = true
+	c.mutex.Unlock()
+
+	result := make(chan error, 1)
+	go func() {
+		err := store.Ping(kv)
+
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return errTimeout
+	}
+}
+
+// ServeHTTP answers /healthz as long as the process runs and /readyz with
+// the report of the last check, with status 503 if not ready
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.URL.Path {
+	case "/healthz":
+		w.Write([]byte(`{"alive":true}`))
+	case "/readyz":
+		report := c.Report()
+		if report == nil {
+			report = &Report{Schemas: make([]*SchemaReport, 0)}
+		}
+
+		if !report.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		json.NewEncoder(w).Encode(report)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,186 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+func mockStore(err error) store.Store {
+	return &store.MockStore{
+		GetFunc: func(key string) (store.Pair, error) {
+			if err != nil {
+				return nil, err
+			}
+			return nil, store.ErrKeyNotFound
+		},
+		ListFunc: func(directory string) ([]store.Pair, error) {
+			if err != nil {
+				return nil, err
+			}
+			return []store.Pair{store.NewPair("zones/example.com/A", []byte(`[{"Payload":"192.0.2.1"}]`), 1)}, nil
+		},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	down := errors.New("connection refused")
+	testCases := []struct {
+		stores          [][]store.Store
+		expectedReady   bool
+		expectedHealthy bool
+	}{
+		{[][]store.Store{{mockStore(nil)}}, true, true},
+		{[][]store.Store{{mockStore(nil)}, {mockStore(down)}}, false, true},
+		{[][]store.Store{{mockStore(down), mockStore(nil)}}, false, true},
+		{[][]store.Store{{mockStore(down)}, {mockStore(down)}}, false, false},
+		{nil, false, false},
+	}
+
+	for i, tc := range testCases {
+		checker := &Checker{}
+
+		for _, stores := range tc.stores {
+			checker.Schemas = append(checker.Schemas, schema.NewFlatSchema(store.NewFailoverStore(stores, 0), 3600))
+		}
+
+		if report := checker.Check(); report.Ready != tc.expectedReady {
+			t.Errorf("TestCheck %d: actual ready %v, expected %v", i, report.Ready, tc.expectedReady)
+		}
+
+		if healthy := checker.Healthy(); healthy != tc.expectedHealthy {
+			t.Errorf("TestCheck %d: actual healthy %v, expected %v", i, healthy, tc.expectedHealthy)
+		}
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	hung := &store.MockStore{GetFunc: func(key string) (store.Pair, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil, store.ErrKeyNotFound
+	}}
+	checker := &Checker{Timeout: 10 * time.Millisecond}
+	id := backend{0, 0}
+
+	if err := checker.ping(id, hung); err != errTimeout {
+		t.Errorf("TestCheckTimeout: actual %v, expected %v", err, errTimeout)
+	}
+
+	// no further ping is started while the first one hangs
+	if err := checker.ping(id, hung); err != errPending || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("TestCheckTimeout: actual %v after %d calls, expected %v after 1", err, atomic.LoadInt32(&calls), errPending)
+	}
+
+	close(release)
+	time.Sleep(10 * time.Millisecond)
+
+	if err := checker.ping(id, hung); err != nil {
+		t.Errorf("TestCheckTimeout: actual %v, expected <nil>", err)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	var calls int32
+	kv := &store.MockStore{
+		GetFunc: func(key string) (store.Pair, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, store.ErrKeyNotFound
+		},
+		ListFunc: func(directory string) ([]store.Pair, error) {
+			return nil, store.ErrKeyNotFound
+		},
+	}
+	checker := &Checker{Schemas: []schema.Schema{schema.NewFlatSchema(kv, 3600)}}
+
+	if checker.Healthy() || atomic.LoadInt32(&calls) != 0 {
+		t.Errorf("TestHealthy: actual healthy before the first check, expected not healthy without pinging")
+	}
+
+	checker.Check()
+
+	for i := 0; i < 3; i++ {
+		if !checker.Healthy() {
+			t.Errorf("TestHealthy: actual not healthy, expected healthy")
+		}
+	}
+
+	if actual := atomic.LoadInt32(&calls); actual != 1 {
+		t.Errorf("TestHealthy: actual %d pings, expected 1", actual)
+	}
+}
+
+func TestRun(t *testing.T) {
+	var calls int32
+	kv := &store.MockStore{
+		GetFunc: func(key string) (store.Pair, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, store.ErrKeyNotFound
+		},
+		ListFunc: func(directory string) ([]store.Pair, error) {
+			return nil, store.ErrKeyNotFound
+		},
+	}
+	checker := &Checker{Schemas: []schema.Schema{schema.NewFlatSchema(kv, 3600)}, Interval: 10 * time.Millisecond}
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		checker.Run(stopCh)
+		close(done)
+	}()
+
+	time.Sleep(55 * time.Millisecond)
+	close(stopCh)
+	<-done
+
+	if actual := atomic.LoadInt32(&calls); actual < 3 || !checker.Healthy() {
+		t.Errorf("TestRun: actual %d pings, healthy %v, expected at least 3 pings and healthy", actual, checker.Healthy())
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	checker := &Checker{Schemas: []schema.Schema{
+		schema.NewFlatSchema(mockStore(nil), 3600),
+		schema.NewFlatSchema(mockStore(errors.New("connection refused")), 3600),
+	}}
+
+	recorder := httptest.NewRecorder()
+	checker.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("TestServeHTTP(/healthz): actual %d, expected %d", recorder.Code, http.StatusOK)
+	}
+
+	recorder = httptest.NewRecorder()
+	checker.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("TestServeHTTP(/readyz): actual %d before the first check, expected %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+
+	checker.Check()
+	recorder = httptest.NewRecorder()
+	checker.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var actual Report
+	json.NewDecoder(recorder.Body).Decode(&actual)
+	expected := Report{Schemas: []*SchemaReport{
+		{Schema: 0, Zones: 1, Stores: []*StoreReport{{Store: 0}}},
+		{Schema: 1, Error: "connection refused", Stores: []*StoreReport{{Store: 0, Error: "connection refused"}}},
+	}}
+
+	if recorder.Code != http.StatusServiceUnavailable || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TestServeHTTP(/readyz): actual %d %+v, expected %d %+v", recorder.Code, actual, http.StatusServiceUnavailable, expected)
+	}
+}
@@ -0,0 +1,196 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+const (
+	FormatText   = "text" // the format of the standard logger
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+	return levelNames[level]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(level), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("Unsupported log level %s, use debug, info, warn or error", name)
+}
+
+// Logger writes one record per line with a message and key-value fields
+type Logger struct {
+	mutex  *sync.Mutex
+	out    io.Writer
+	level  Level
+	format string
+	fields []interface{}
+	now    func() time.Time
+}
+
+func New(out io.Writer, level Level, format string) (*Logger, error) {
+	switch format {
+	case "":
+		format = FormatText
+	case FormatText, FormatLogfmt, FormatJSON:
+	default:
+		return nil, fmt.Errorf("Unsupported log format %s, use text, logfmt or json", format)
+	}
+
+	return &Logger{mutex: &sync.Mutex{}, out: out, level: level, format: format, now: time.Now}, nil
+}
+
+var std, _ = New(os.Stderr, LevelInfo, FormatText)
+
+// SetDefault replaces the logger used by the package functions
+func SetDefault(logger *Logger) {
+	std = logger
+}
+
+func Default() *Logger {
+	return std
+}
+
+func Debug(msg string, fields ...interface{}) { std.log(LevelDebug, msg, fields) }
+func Info(msg string, fields ...interface{})  { std.log(LevelInfo, msg, fields) }
+func Warn(msg string, fields ...interface{})  { std.log(LevelWarn, msg, fields) }
+func Error(msg string, fields ...interface{}) { std.log(LevelError, msg, fields) }
+
+// With returns a logger adding fields to every record
+func (l *Logger) With(fields ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), fields...)
+	return &child
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) { l.log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...interface{})  { l.log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...interface{})  { l.log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...interface{}) { l.log(LevelError, msg, fields) }
+
+// Write logs every line of p at info level, so the standard logger can be
+// redirected to l with log.SetOutput
+func (l *Logger) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		l.log(LevelInfo, line, nil)
+	}
+
+	return len(p), nil
+}
+
+func (l *Logger) log(level Level, msg string, fields []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields = append(append([]interface{}{}, l.fields...), fields...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	var buffer bytes.Buffer
+	now := l.now()
+
+	switch l.format {
+	case FormatJSON:
+		buffer.WriteString(`{"time":`)
+		writeJSON(&buffer, now.Format(time.RFC3339Nano))
+		buffer.WriteString(`,"level":`)
+		writeJSON(&buffer, level.String())
+		buffer.WriteString(`,"msg":`)
+		writeJSON(&buffer, msg)
+
+		for i := 0; i < len(fields); i += 2 {
+			buffer.WriteByte(',')
+			writeJSON(&buffer, fmt.Sprint(fields[i]))
+			buffer.WriteByte(':')
+			writeJSON(&buffer, jsonValue(fields[i+1]))
+		}
+
+		buffer.WriteString("}\n")
+	case FormatLogfmt:
+		fmt.Fprintf(&buffer, "time=%s level=%s msg=%s", now.Format(time.RFC3339Nano), level, logfmtValue(msg))
+		writeLogfmtFields(&buffer, fields)
+		buffer.WriteByte('\n')
+	default:
+		buffer.WriteString("powerdns-consul " + now.Format("2006/01/02 15:04:05") + " ")
+		if level != LevelInfo {
+			buffer.WriteString(strings.ToUpper(level.String()) + ": ")
+		}
+		buffer.WriteString(msg)
+		writeLogfmtFields(&buffer, fields)
+		buffer.WriteByte('\n')
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out.Write(buffer.Bytes())
+}
+
+func writeJSON(buffer *bytes.Buffer, value interface{}) {
+	encoded, err := json.Marshal(value)
+
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+
+	buffer.Write(encoded)
+}
+
+// jsonValue keeps numbers and booleans, errors and durations are logged as
+// their string
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case error:
+		return value.Error()
+	case time.Duration:
+		return value.String()
+	case fmt.Stringer:
+		return value.String()
+	}
+
+	return value
+}
+
+func writeLogfmtFields(buffer *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		fmt.Fprintf(buffer, " %s=%s", fields[i], logfmtValue(fmt.Sprint(jsonValue(fields[i+1]))))
+	}
+}
+
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
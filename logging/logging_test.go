@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestLogger(t *testing.T, level Level, format string) (*Logger, *bytes.Buffer) {
+	var buffer bytes.Buffer
+	logger, err := New(&buffer, level, format)
+
+	if err != nil {
+		t.Fatalf("newTestLogger: unexpected error %v", err)
+	}
+
+	logger.now = func() time.Time { return time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC) }
+	return logger, &buffer
+}
+
+func TestLoggerFormats(t *testing.T) {
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{FormatText, "powerdns-consul 2021/01/01 12:00:00 WARN: Query failed qname=www.example.com qtype=A latency=1.5ms error=\"store down\" answers=0\n"},
+		{FormatLogfmt, "time=2021-01-01T12:00:00Z level=warn msg=\"Query failed\" qname=www.example.com qtype=A latency=1.5ms error=\"store down\" answers=0\n"},
+		{FormatJSON, `{"time":"2021-01-01T12:00:00Z","level":"warn","msg":"Query failed","qname":"www.example.com","qtype":"A","latency":"1.5ms","error":"store down","answers":0}` + "\n"},
+	}
+
+	for _, tc := range testCases {
+		logger, buffer := newTestLogger(t, LevelInfo, tc.format)
+		logger.With("qname", "www.example.com").Warn("Query failed", "qtype", "A", "latency", 1500*time.Microsecond, "error", errors.New("store down"), "answers", 0)
+
+		if buffer.String() != tc.expected {
+			t.Errorf("TestLoggerFormats(%s): actual %s, expected %s", tc.format, buffer.String(), tc.expected)
+		}
+	}
+
+	if _, err := New(nil, LevelInfo, "xml"); err == nil {
+		t.Errorf("TestLoggerFormats: expected an error for an unsupported format")
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	logger, buffer := newTestLogger(t, LevelWarn, FormatLogfmt)
+
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+	logger.Error("error")
+	logger.Write([]byte("from the standard logger\n"))
+
+	expected := "time=2021-01-01T12:00:00Z level=warn msg=warn\ntime=2021-01-01T12:00:00Z level=error msg=error\n"
+
+	if buffer.String() != expected {
+		t.Errorf("TestLoggerLevel: actual %s, expected %s", buffer.String(), expected)
+	}
+
+	if level, err := ParseLevel("DEBUG"); level != LevelDebug || err != nil {
+		t.Errorf("TestLoggerLevel: actual %v %v, expected %v <nil>", level, err, LevelDebug)
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("TestLoggerLevel: expected an error for an unsupported level")
+	}
+}
+
+func TestLoggerWrite(t *testing.T) {
+	logger, buffer := newTestLogger(t, LevelInfo, FormatJSON)
+	logger.Write([]byte("first line\nsecond line\n"))
+
+	expected := `{"time":"2021-01-01T12:00:00Z","level":"info","msg":"first line"}
+{"time":"2021-01-01T12:00:00Z","level":"info","msg":"second line"}
+`
+
+	if buffer.String() != expected {
+		t.Errorf("TestLoggerWrite: actual %s, expected %s", buffer.String(), expected)
+	}
+}
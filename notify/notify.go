@@ -0,0 +1,112 @@
+package notify
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/Shark/powerdns-consul/dnsserver"
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+const (
+	DefaultTimeout = 2 * time.Second
+	DefaultRetries = 3
+)
+
+type Notifier struct {
+	Timeout time.Duration
+	Retries int
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{DefaultTimeout, DefaultRetries}
+}
+
+// Notify sends a DNS NOTIFY (RFC 1996) for zone to every secondary and
+// returns the first error encountered. Secondaries are addresses like
+// 192.0.2.1 or 192.0.2.1:5353.
+func (n *Notifier) Notify(zone string, secondaries []string) (err error) {
+	for _, secondary := range secondaries {
+		if notifyErr := n.notifyOne(zone, secondary); notifyErr != nil && err == nil {
+			err = notifyErr
+		}
+	}
+
+	return err
+}
+
+func (n *Notifier) notifyOne(zone string, secondary string) (err error) {
+	msg := new(dns.Msg)
+	msg.SetNotify(dns.Fqdn(zone))
+	msg.Authoritative = true
+
+	client := &dns.Client{Timeout: n.Timeout}
+	address := dnsserver.WithDefaultPort(secondary)
+
+	for try := 0; try <= n.Retries; try++ {
+		var resp *dns.Msg
+		resp, _, err = client.Exchange(msg, address)
+
+		if err != nil {
+			continue
+		}
+
+		if resp.Opcode != dns.OpcodeNotify || resp.Rcode != dns.RcodeSuccess {
+			return fmt.Errorf("%s answered NOTIFY for %s with opcode %s, rcode %s", address, zone, dns.OpcodeToString[resp.Opcode], dns.RcodeToString[resp.Rcode])
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("Unable to send NOTIFY for %s to %s: %v", zone, address, err)
+}
+
+// Queue sends NOTIFYs in the background, so a slow or unreachable secondary
+// does not hold up the caller. NOTIFYs of a zone are sent one after the
+// other; changes while one is in flight are sent once when it is done.
+type Queue struct {
+	notifier *Notifier
+	mutex    sync.Mutex
+	pending  map[string][]string // secondaries to notify next, by zone in flight
+}
+
+func NewQueue(notifier *Notifier) *Queue {
+	return &Queue{notifier: notifier, pending: make(map[string][]string)}
+}
+
+// Notify queues a NOTIFY for zone to secondaries, errors are logged
+func (q *Queue) Notify(zone string, secondaries []string) {
+	if len(secondaries) == 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.pending[zone]; ok {
+		q.pending[zone] = secondaries
+		return
+	}
+
+	q.pending[zone] = nil
+	go q.send(zone, secondaries)
+}
+
+func (q *Queue) send(zone string, secondaries []string) {
+	for secondaries != nil {
+		if err := q.notifier.Notify(zone, secondaries); err != nil {
+			logging.Error("Unable to notify secondaries", "zone", zone, "error", err)
+		}
+
+		q.mutex.Lock()
+		if secondaries = q.pending[zone]; secondaries == nil {
+			delete(q.pending, zone)
+		} else {
+			q.pending[zone] = nil
+		}
+		q.mutex.Unlock()
+	}
+}
@@ -0,0 +1,116 @@
+package notify
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func startSecondary(t *testing.T, rcode int) (address string, received chan *dns.Msg) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("startSecondary: unexpected error %v", err)
+	}
+
+	received = make(chan *dns.Msg, 10)
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		received <- req
+		resp := new(dns.Msg)
+		resp.SetRcode(req, rcode)
+		w.WriteMsg(resp)
+	})}
+
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return conn.LocalAddr().String(), received
+}
+
+func TestNotify(t *testing.T) {
+	address, received := startSecondary(t, dns.RcodeSuccess)
+
+	err := NewNotifier().Notify("example.com", []string{address})
+
+	if err != nil {
+		t.Errorf("TestNotify: unexpected error %v", err)
+	}
+
+	select {
+	case req := <-received:
+		if req.Opcode != dns.OpcodeNotify || !req.Authoritative || req.Question[0].Name != "example.com." || req.Question[0].Qtype != dns.TypeSOA {
+			t.Errorf("TestNotify: unexpected request %v", req)
+		}
+	default:
+		t.Errorf("TestNotify: secondary did not receive NOTIFY")
+	}
+}
+
+func TestNotifyRefused(t *testing.T) {
+	address, _ := startSecondary(t, dns.RcodeRefused)
+
+	if err := NewNotifier().Notify("example.com", []string{address}); err == nil {
+		t.Errorf("TestNotifyRefused: expected error")
+	}
+}
+
+func TestNotifyUnreachable(t *testing.T) {
+	conn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	notifier := &Notifier{100 * time.Millisecond, 1}
+	if err := notifier.Notify("example.com", []string{address}); err == nil {
+		t.Errorf("TestNotifyUnreachable: expected error")
+	}
+}
+
+func TestQueue(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("TestQueue: unexpected error %v", err)
+	}
+
+	release := make(chan struct{})
+	received := make(chan *dns.Msg, 10)
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		<-release
+		received <- req
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeSuccess)
+		w.WriteMsg(resp)
+	})}
+
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	queue := NewQueue(&Notifier{time.Second, 0})
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		queue.Notify("example.com", []string{conn.LocalAddr().String()})
+	}
+
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("TestQueue: actual %v for queueing, expected Notify not to wait for the secondary", elapsed)
+	}
+
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("TestQueue: actual %d NOTIFYs, expected 2", i)
+		}
+	}
+
+	select {
+	case <-received:
+		t.Errorf("TestQueue: actual 3 NOTIFYs, expected the changes in flight to be sent once")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -5,7 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+
+	"github.com/Shark/powerdns-consul/logging"
 )
 
 var (
@@ -47,7 +48,8 @@ var (
 )
 
 type Handler struct {
-	Lookup func(request *Request) (responses []*Response, err error)
+	Lookup  func(request *Request) (responses []*Response, err error)
+	Healthy func() bool // PING is answered with FAIL if it returns false, it must not block
 }
 
 func (h *Handler) parseRequest(line []byte) (request *Request, err error) {
@@ -84,7 +86,7 @@ func (h *Handler) Handle(in chan []byte, out chan []byte) {
 
 		if !handshakeReceived {
 			if !bytes.Equal(line, GREETING_ABI_V2) {
-				log.Printf("Handshake failed: %s != %s", line, GREETING_ABI_V2)
+				logging.Warn("Handshake failed", "line", string(line), "expected", string(GREETING_ABI_V2))
 				out <- []byte(FAIL_REPLY)
 			} else {
 				handshakeReceived = true
@@ -96,7 +98,7 @@ func (h *Handler) Handle(in chan []byte, out chan []byte) {
 
 		request, err := h.parseRequest(line)
 		if err != nil {
-			log.Printf("Failed parsing request: %v", err)
+			logging.Warn("Failed parsing request", "line", string(line), "error", err)
 			out <- []byte(FAIL_REPLY)
 			continue
 		}
@@ -105,7 +107,7 @@ func (h *Handler) Handle(in chan []byte, out chan []byte) {
 		case KIND_Q:
 			responses, err := h.Lookup(request)
 			if err != nil {
-				log.Printf("Query for %v failed: %v", request.Qname, err)
+				logging.Error("Query failed", "qname", request.Qname, "qtype", request.Qtype, "remote_ip", request.RemoteIp, "id", request.Id, "error", err)
 				out <- []byte(FAIL_REPLY)
 				continue
 			}
@@ -116,6 +118,12 @@ func (h *Handler) Handle(in chan []byte, out chan []byte) {
 		case KIND_AXFR:
 			// not implemented
 		case KIND_PING:
+			if h.Healthy != nil && !h.Healthy() {
+				logging.Warn("No store can be reached, failing PING")
+				out <- []byte(FAIL_REPLY)
+				continue
+			}
+
 			out <- []byte(PONG_REPLY)
 		}
 
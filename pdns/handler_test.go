@@ -24,7 +24,7 @@ var parseRequestTests = []struct {
 }
 
 func TestParseRequest(t *testing.T) {
-	handler := &Handler{nil}
+	handler := &Handler{}
 	for _, tt := range parseRequestTests {
 		actual, err := handler.parseRequest(tt.request)
 
@@ -49,7 +49,7 @@ var formatResponseTests = []struct {
 }
 
 func TestFormatResponse(t *testing.T) {
-	handler := &Handler{nil}
+	handler := &Handler{}
 	for _, tt := range formatResponseTests {
 		actual := handler.formatResponse(tt.response)
 
@@ -93,10 +93,11 @@ var handleTestsFail = []struct {
 }{
 	{[]byte("Q\tA\tB\tC\tD\tE\tF"), []byte("FAIL\n")},
 	{[]byte("Q\tA\tB\tC\tD\tE\tF"), []byte("FAIL\n")},
+	{[]byte("PING\t\t\t\t\t\t"), []byte("FAIL\n")},
 }
 
 func TestHandle(t *testing.T) {
-	handler := &Handler{handleLookupSuccess}
+	handler := &Handler{Lookup: handleLookupSuccess}
 	in, out := make(chan []byte), make(chan []byte)
 	stageDone := make(chan bool)
 	testDone := make(chan bool)
@@ -128,6 +129,7 @@ func TestHandle(t *testing.T) {
 		<-stageDone
 
 		handler.Lookup = handleLookupFail
+		handler.Healthy = func() bool { return false }
 		for _, tt := range handleTestsFail {
 			numTests++
 			if tt.sent != nil {
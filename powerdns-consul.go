@@ -2,22 +2,37 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/miekg/dns"
+
+	"github.com/Shark/powerdns-consul/alias"
+	"github.com/Shark/powerdns-consul/api"
+	"github.com/Shark/powerdns-consul/audit"
+	"github.com/Shark/powerdns-consul/backend/history"
 	"github.com/Shark/powerdns-consul/backend/schema"
 	"github.com/Shark/powerdns-consul/backend/soa"
 	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/backend/template"
+	"github.com/Shark/powerdns-consul/backend/watch"
+	"github.com/Shark/powerdns-consul/config"
+	"github.com/Shark/powerdns-consul/dnsserver"
+	"github.com/Shark/powerdns-consul/health"
+	"github.com/Shark/powerdns-consul/logging"
+	"github.com/Shark/powerdns-consul/notify"
 	"github.com/Shark/powerdns-consul/pdns"
+	"github.com/Shark/powerdns-consul/querylog"
 )
 
 type Config struct {
@@ -29,67 +44,424 @@ type Config struct {
 	SoaRetry               int32
 	SoaExpiry              int32
 	SoaNx                  int32
+	SoaSerialStrategy      string
+	SoaMode                string
+	WatchZones             bool
+	AuditLog               string            // logs record changes as JSON to this file, - for stdout or a http(s) webhook URL
+	History                string            // keeps a version of every changed zone under history/ in the store if "store", or else in this directory
+	HistoryVersions        int               // versions kept per zone, all if zero
+	ListenAddress          string            // answer DNS queries on this address instead of acting as PowerDNS pipe backend
+	AliasResolver          string            // resolves ALIAS targets outside of the local zones, i.e. 192.0.2.53 or 192.0.2.53:5353
+	TsigKeys               map[string]string // base64 TSIG secrets by key name, for dynamic updates
+	APIListenAddress       string            // serves the HTTP API on this address, i.e. 127.0.0.1:8081
+	APIKey                 string            // required in the X-API-Key header, the API is disabled if empty
+	AllowNoWorkingSchemas  bool              // starts even if no schema can be opened or reached, i.e. to wait for the store
+	HealthListenAddress    string            // serves /healthz and /readyz on this address, i.e. 127.0.0.1:8082
+	LogLevel               string            // debug, info (default), warn or error
+	LogFormat              string            // text (default), logfmt or json
+	QueryLog               string            // logs every query and its answers as JSON to this file or unix:<path> socket
+	QueryLogSampleRate     float64           // share of queries logged, i.e. 0.01, all if zero
+	QueryLogInclude        []string          // only log names in these domains if not empty
+	QueryLogExclude        []string          // never log names in these domains
+	Zones                  map[string]ZoneConfig
+}
+
+type ZoneConfig struct {
+	SoaSerialStrategy string
+	Notify            []string // secondaries to send NOTIFY to, i.e. 192.0.2.1 or 192.0.2.1:5353
+	AllowUpdate       []string // TSIG key names allowed to send dynamic updates, standalone mode only
 }
 
 type SchemaConfig struct {
-	Name      string
-	KVBackend string
-	KVAddress string
+	Name string
+	Mode string // empty or failover
+	StoreConfig
+	Stores                []StoreConfig // failover mode only, ordered by preference
+	FailoverRetryInterval uint32        // failover mode only, in seconds
+	SnapshotPath          string        // keeps the last known good data on disk if set
 }
 
-func resolveTransform(config Config, schemas []schema.Schema) func(*pdns.Request) ([]*pdns.Response, error) {
-	return func(request *pdns.Request) (responses []*pdns.Response, err error) {
-		query := &store.Query{request.Qname, request.Qtype}
-		var entries []*store.Entry
+type StoreConfig struct {
+	KVBackend     string
+	KVAddress     string
+	KVBucket      string
+	KVDatacenter  string
+	KVNamespace   string
+	KVToken       string
+	KVConsistency string
+}
 
-		for _, schema := range schemas {
-			schemaEntries, err := schema.Resolve(query)
+// String describes the schema for logs, leaving out KVToken
+func (schemaConfig SchemaConfig) String() string {
+	storeConfigs := []StoreConfig{schemaConfig.StoreConfig}
+	if schemaConfig.Mode == "failover" {
+		storeConfigs = schemaConfig.Stores
+	}
 
-			if err != nil {
-				log.Printf("Schema could not resolve %v: %v", query, err)
+	var stores []string
+	for _, storeConfig := range storeConfigs {
+		stores = append(stores, storeConfig.String())
+	}
+
+	return fmt.Sprintf("%s (%s)", schemaConfig.Name, strings.Join(stores, ", "))
+}
+
+// String describes the store for logs, leaving out KVToken
+func (storeConfig StoreConfig) String() string {
+	return storeConfig.KVBackend + " " + storeConfig.KVAddress
+}
+
+// zoneConfig returns the settings for zone, falling back to the global ones
+func (config Config) zoneConfig(zone string) ZoneConfig {
+	zoneConfig := config.Zones[strings.ToLower(strings.TrimSuffix(zone, "."))]
+
+	if zoneConfig.SoaSerialStrategy == "" {
+		zoneConfig.SoaSerialStrategy = config.SoaSerialStrategy
+	}
+
+	return zoneConfig
+}
+
+func (config Config) generatorConfig(zone string) *soa.GeneratorConfig {
+	return &soa.GeneratorConfig{
+		SoaNameServer:  config.Hostname,
+		SoaEmailAddr:   config.HostmasterEmailAddress,
+		SoaRefresh:     config.SoaRefresh,
+		SoaRetry:       config.SoaRetry,
+		SoaExpiry:      config.SoaExpiry,
+		SoaNx:          config.SoaNx,
+		DefaultTTL:     config.DefaultTTL,
+		SerialStrategy: config.zoneConfig(zone).SoaSerialStrategy,
+		Mode:           config.SoaMode,
+	}
+}
+
+// readOnlyGeneratorConfig is generatorConfig for reading a zone, which must
+// not create or bump its serial
+func (config Config) readOnlyGeneratorConfig(zone string) *soa.GeneratorConfig {
+	generatorConfig := config.generatorConfig(zone)
+	if generatorConfig.Mode != soa.ModeModifyIndex {
+		generatorConfig.Mode = soa.ModeReadOnly
+	}
+
+	return generatorConfig
+}
+
+// watchZones lists the zones of zoneSchema in index again when zones are
+// added or removed, updates the SOA serial of every zone that changes and
+// sends NOTIFY to its secondaries if WatchZones is set, and writes the
+// changed records to auditSink if it is not nil
+func watchZones(config Config, zoneSchema schema.Schema, index *schema.ZoneIndex, auditSink audit.Sink, stopCh <-chan struct{}) {
+	kv := zoneSchema.Store()
+	watcher := watch.NewZoneWatcher(kv)
+	notifier := notify.NewQueue(notify.NewNotifier())
+
+	watcher.OnChange(func(change *watch.ZoneChange) {
+		if len(change.Previous) > 0 && len(change.Current) > 0 {
+			return // neither added nor removed
+		}
+
+		if err := index.Refresh(zoneSchema); err != nil {
+			logging.Warn("Unable to list zones, keeping the last known zones", "zone", change.Zone, "error", err)
+		}
+	})
+
+	update := func(zone string) {
+		generator := soa.NewGenerator(config.generatorConfig(zone), time.Now())
+		entry, err := generator.RetrieveOrCreateSOAEntry(kv, zone)
+
+		if err != nil || entry == nil {
+			logging.Error("Unable to update SOA entry of changed zone", "zone", zone, "error", err)
+			return
+		}
+
+		logging.Debug("Zone changed", "zone", zone, "soa", entry.Payload)
+
+		if config.History != "" {
+			recordVersion(config, kv, zone, entry)
+		}
+
+		notifier.Notify(zone, config.zoneConfig(zone).Notify)
+	}
+
+	if auditSink != nil {
+		watcher.OnChange(func(change *watch.ZoneChange) {
+			if events := audit.Events(change, time.Now()); len(events) > 0 {
+				if err := auditSink.Write(events); err != nil {
+					logging.Error("Unable to write audit log", "zone", change.Zone, "error", err)
+				}
+			}
+		})
+	}
+
+	if config.WatchZones && config.History != "" {
+		// keep the versions before the first change
+		zones, err := zoneSchema.Zones()
+
+		if err != nil {
+			logging.Error("Unable to record versions of zones", "error", err)
+		}
+
+		for _, zone := range zones {
+			entry, err := soa.NewGenerator(config.generatorConfig(zone), time.Now()).RetrieveOrCreateSOAEntry(kv, zone)
+
+			if err != nil || entry == nil {
+				logging.Error("Unable to record version of zone", "zone", zone, "error", err)
 				continue
 			}
 
-			entries = append(entries, schemaEntries...)
+			recordVersion(config, kv, zone, entry)
 		}
+	}
+
+	if config.WatchZones {
+		watcher.OnChange(func(change *watch.ZoneChange) {
+			if len(change.Current) == 0 {
+				return
+			}
+
+			update(change.Zone)
+		})
+
+		go watchVars(kv, update, stopCh)
+	}
+
+	watcher.Run(stopCh)
+}
+
+// recordVersion keeps the current version of zone with the serial of entry
+func recordVersion(config Config, kv store.Store, zone string, entry *store.Entry) {
+	version, err := history.Take(kv, zone, serialOf(entry), time.Now())
+
+	if err == nil {
+		err = history.Record(history.New(config.History, kv), version, config.HistoryVersions)
+	}
+
+	if err != nil {
+		logging.Error("Unable to record version of zone", "zone", zone, "error", err)
+	}
+}
+
+// watchVars calls update for every zone using a variable that changes in kv
+func watchVars(kv store.Store, update func(zone string), stopCh <-chan struct{}) {
+	var previous map[string]uint64
+
+	for {
+		watchChan, err := kv.WatchTree(template.VarsPrefix, stopCh)
+
+		if err != nil {
+			logging.Warn("Unable to watch variables", "error", err)
+		} else {
+			for pairs := range watchChan {
+				current := make(map[string]uint64, len(pairs))
+				for _, pair := range pairs {
+					current[pair.Key()] = pair.LastIndex()
+				}
 
-		if query.Type == "ANY" || query.Type == "SOA" {
-			for _, schema := range schemas {
-				hasZone, hasZoneErr := schema.HasZone(request.Qname)
+				changed := changedKeys(previous, current)
 
-				if hasZoneErr != nil {
-					log.Printf("Schema could not tell if it has zone %s: %v", request.Qname, hasZoneErr)
+				if previous == nil || len(changed) == 0 {
+					previous = current
 					continue
 				}
 
-				if hasZone {
-					generatorCfg := &soa.GeneratorConfig{
-						SoaNameServer: config.Hostname,
-						SoaEmailAddr:  config.HostmasterEmailAddress,
-						SoaRefresh:    config.SoaRefresh,
-						SoaRetry:      config.SoaRetry,
-						SoaExpiry:     config.SoaExpiry,
-						SoaNx:         config.SoaNx,
-						DefaultTTL:    config.DefaultTTL,
-					}
-					generator := soa.NewGenerator(generatorCfg, time.Now())
-					entry, err := generator.RetrieveOrCreateSOAEntry(schema.Store(), request.Qname)
-
-					if err != nil {
-						log.Printf("Schema %v failed to generate SOA entry: %v", schema, err)
-					} else {
-						entries = append(entries, entry)
-					}
+				zones, err := zonesUsing(kv, changed)
 
-					break
+				if err != nil {
+					logging.Error("Unable to find zones using variables", "error", err)
+					continue
+				}
+
+				previous = current
+
+				for _, zone := range zones {
+					update(zone)
+				}
+			}
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(watch.DefaultRetryInterval):
+		}
+	}
+}
+
+// changedKeys returns the keys added, removed or modified between the modify
+// indexes previous and current
+func changedKeys(previous map[string]uint64, current map[string]uint64) map[string]bool {
+	changed := make(map[string]bool)
+
+	for key, index := range current {
+		if previousIndex, ok := previous[key]; !ok || previousIndex != index {
+			changed[key] = true
+		}
+	}
+
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			changed[key] = true
+		}
+	}
+
+	return changed
+}
+
+// zonesUsing returns the zones with at least one payload depending on one
+// of keys, directly or through other variables and references
+func zonesUsing(kv store.Store, keys map[string]bool) ([]string, error) {
+	pairs, err := kv.List("zones")
+
+	if err == store.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var zones []string
+	seen := make(map[string]bool)
+	expander := template.NewExpander(kv)
+
+	for _, pair := range pairs {
+		tokens := strings.Split(pair.Key(), "/")
+
+		if len(tokens) < 3 || seen[tokens[1]] {
+			continue
+		}
+
+		payloads, _ := template.Payloads(pair.Value())
+
+		for _, payload := range payloads {
+			if !template.IsTemplate(payload) {
+				continue
+			}
+
+			// keys used before a failure are enough, the failing key
+			// is among them
+			dependencies, _ := expander.Dependencies(payload)
+
+			for _, dependency := range dependencies {
+				if keys[dependency] {
+					seen[tokens[1]] = true
 				}
 			}
+
+			if seen[tokens[1]] {
+				zones = append(zones, tokens[1])
+				break
+			}
+		}
+	}
+
+	return zones, nil
+}
+
+// resolve answers query from the schema serving the most specific zone
+// enclosing the name. The SOA of the zone is added to the answer of ANY and
+// SOA queries at the apex and, if the query asks for it, to the authority
+// section of negative answers.
+func resolve(config Config, index *schema.ZoneIndex, schemas []schema.Schema) func(*store.Query) (*schema.Result, error) {
+	positions := make(map[schema.Schema]int, len(schemas))
+	for i, curSchema := range schemas {
+		positions[curSchema] = i
+	}
+
+	return func(query *store.Query) (result *schema.Result, err error) {
+		start := time.Now()
+		schemaPosition := -1
+
+		defer func() {
+			if !logging.Default().Enabled(logging.LevelDebug) || err != nil {
+				return
+			}
+
+			logging.Debug("Query", "qname", query.Name, "qtype", query.Type, "remote_ip", query.RemoteIp, "id", query.Id,
+				"schema", schemaPosition, "zone", result.Zone, "answers", len(result.Entries), "latency", time.Since(start))
+		}()
+
+		zone, zoneSchema, err := index.Lookup(query.Name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if zoneSchema == nil {
+			return &schema.Result{}, nil
+		}
+
+		schemaPosition = positions[zoneSchema]
+		result, err = zoneSchema.Resolve(zone, query)
+
+		if err != nil {
+			// logged by the frontend
+			return nil, fmt.Errorf("Schema %d could not resolve query: %v", schemaPosition, err)
+		}
+
+		if result.Zone == "" || result.Delegation != "" {
+			return result, nil
+		}
+
+		atApex := strings.ToLower(strings.TrimSuffix(query.Name, ".")) == result.Zone
+		wantsSOA := atApex && (query.Type == "ANY" || query.Type == "SOA")
+
+		if !wantsSOA && (len(result.Entries) > 0 || !query.Authority) {
+			return result, nil
 		}
 
-		responses = make([]*pdns.Response, len(entries))
+		generator := soa.NewGenerator(config.generatorConfig(result.Zone), time.Now())
+		entry, err := generator.RetrieveOrCreateSOAEntry(zoneSchema.Store(), result.Zone)
 
-		for index, entry := range entries {
-			response := &pdns.Response{request.Qname, "IN", entry.Type, strconv.Itoa(int(entry.Ttl)), "1", entry.Payload}
+		if err != nil || entry == nil {
+			logging.Error("Unable to generate SOA entry", "zone", result.Zone, "schema", schemaPosition, "error", err)
+			return result, nil
+		}
+
+		if wantsSOA {
+			result.Entries = append(result.Entries, entry)
+		} else {
+			result.Authority = []*store.Entry{entry}
+		}
+
+		return result, nil
+	}
+}
+
+// flattenAliases replaces ALIAS records in the answers of resolve with the
+// A and AAAA records of their targets
+func flattenAliases(resolver *alias.Resolver, resolve func(*store.Query) (*schema.Result, error)) func(*store.Query) (*schema.Result, error) {
+	return func(query *store.Query) (*schema.Result, error) {
+		result, err := resolve(query)
+
+		if err != nil || result.Zone == "" || result.Delegation != "" {
+			return result, err
+		}
+
+		return resolver.Flatten(query, result)
+	}
+}
+
+// resolveTransform adapts resolve to the PowerDNS pipe backend, which only
+// needs the records and tells NXDOMAIN from NODATA by itself. Every request
+// is passed to logQuery if it is not nil.
+func resolveTransform(resolve func(*store.Query) (*schema.Result, error), logQuery func(*store.Query, *schema.Result, error, time.Time)) func(*pdns.Request) ([]*pdns.Response, error) {
+	return func(request *pdns.Request) (responses []*pdns.Response, err error) {
+		start := time.Now()
+		query := &store.Query{Name: request.Qname, Type: request.Qtype, RemoteIp: request.RemoteIp, Id: request.Id}
+		result, err := resolve(query)
+
+		if logQuery != nil {
+			logQuery(query, result, err, start)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		responses = make([]*pdns.Response, len(result.Entries))
+
+		for index, entry := range result.Entries {
+			response := &pdns.Response{Qname: request.Qname, Qclass: "IN", Qtype: entry.Type, Ttl: strconv.Itoa(int(entry.Ttl)), Id: "1", Content: entry.Payload}
 			responses[index] = response
 		}
 
@@ -97,61 +469,369 @@ func resolveTransform(config Config, schemas []schema.Schema) func(*pdns.Request
 	}
 }
 
-func debug(format string, a ...interface{}) {
-	if os.Getenv("DEBUG") != "" {
-		log.Printf(format, a...)
+// update applies dynamic updates to the schema serving zone if the zone
+// allows updates signed with keyName
+func update(config Config, index *schema.ZoneIndex) func(string, string, []dns.RR, []dns.RR) int {
+	return func(zone string, keyName string, prerequisites []dns.RR, updates []dns.RR) int {
+		allowed := false
+		for _, allowedKey := range config.zoneConfig(zone).AllowUpdate {
+			allowed = allowed || dns.Fqdn(strings.ToLower(allowedKey)) == strings.ToLower(keyName)
+		}
+
+		if !allowed {
+			logging.Warn("Refusing update", "zone", zone, "key", keyName)
+			return dns.RcodeRefused
+		}
+
+		indexZone, zoneSchema, err := index.Lookup(zone)
+
+		if err != nil {
+			logging.Error("Unable to find zone for update", "zone", zone, "error", err)
+			return dns.RcodeServerFailure
+		}
+
+		if zoneSchema == nil || indexZone != zone {
+			return dns.RcodeNotAuth
+		}
+
+		updater, ok := zoneSchema.(schema.Updater)
+
+		if !ok {
+			return dns.RcodeNotImplemented
+		}
+
+		rcode := updater.Update(zone, prerequisites, updates)
+		logging.Info("Update", "zone", zone, "key", keyName, "rcode", dns.RcodeToString[rcode], "records", len(updates))
+
+		return rcode
+	}
+}
+
+func newSchemaStore(schemaConfig SchemaConfig) (store.Store, error) {
+	switch schemaConfig.Mode {
+	case "":
+		return newStore(schemaConfig.StoreConfig)
+	case "failover":
+		if len(schemaConfig.Stores) == 0 {
+			return nil, fmt.Errorf("No stores are defined for failover mode")
+		}
+
+		stores := make([]store.Store, len(schemaConfig.Stores))
+		for i, storeConfig := range schemaConfig.Stores {
+			kvStore, err := newStore(storeConfig)
+
+			if err != nil {
+				return nil, err
+			}
+
+			stores[i] = kvStore
+		}
+
+		retryInterval := time.Duration(schemaConfig.FailoverRetryInterval) * time.Second
+		return store.NewFailoverStore(stores, retryInterval), nil
+	}
+
+	return nil, fmt.Errorf("Unsupported schema mode %s", schemaConfig.Mode)
+}
+
+func newStore(storeConfig StoreConfig) (store.Store, error) {
+	kvConfig := &store.Config{
+		Bucket:      storeConfig.KVBucket,
+		Datacenter:  storeConfig.KVDatacenter,
+		Namespace:   storeConfig.KVNamespace,
+		Token:       storeConfig.KVToken,
+		Consistency: storeConfig.KVConsistency,
+	}
+
+	return store.NewStore(storeConfig.KVBackend, []string{storeConfig.KVAddress}, kvConfig)
+}
+
+// setupLogging redirects the standard logger to the configured one. DEBUG
+// in the environment still enables debug logs if LogLevel is not set.
+func setupLogging(cfg Config) error {
+	level := logging.LevelInfo
+
+	if cfg.LogLevel != "" {
+		var err error
+		if level, err = logging.ParseLevel(cfg.LogLevel); err != nil {
+			return err
+		}
+	} else if os.Getenv("DEBUG") != "" {
+		level = logging.LevelDebug
 	}
+
+	logger, err := logging.New(os.Stderr, level, cfg.LogFormat)
+
+	if err != nil {
+		return err
+	}
+
+	logging.SetDefault(logger)
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(logger)
+
+	return nil
+}
+
+// EnvPrefix starts the names of environment variables overriding settings,
+// i.e. PDNS_CONSUL_HOSTNAME or PDNS_CONSUL_SCHEMAS_0_KVADDRESS
+const EnvPrefix = "PDNS_CONSUL_"
+
+// set overrides the setting at path, see config.Set. The settings of the
+// first schema can be given without the Schemas_0_ prefix, i.e. KVAddress.
+func (cfg *Config) set(path string, value string) error {
+	err := config.Set(cfg, path, value)
+
+	if _, unknown := err.(*config.UnknownFieldError); unknown {
+		if config.Set(cfg, "Schemas_0_"+path, value) == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// settingsFlag collects the values of a repeated flag
+type settingsFlag []string
+
+func (settings *settingsFlag) String() string {
+	return strings.Join(*settings, ", ")
+}
+
+func (settings *settingsFlag) Set(value string) error {
+	*settings = append(*settings, value)
+	return nil
 }
 
 func main() {
 	log.SetOutput(os.Stderr)
 	log.SetPrefix("powerdns-consul ")
 
-	configFilePath := flag.String("config", "/etc/powerdns-consul/config.json", "path to the config file")
+	configFilePath := flag.String("config", "/etc/powerdns-consul/config.json", "path to the config file in JSON, YAML (.yaml), TOML (.toml) or HCL (.hcl)")
+	output := flag.String("output", "table", "output format of commands, table or json")
+	var settings settingsFlag
+	flag.Var(&settings, "set", "overrides a setting, i.e. -set KVAddress=127.0.0.1:8500 or -set Schemas_1_KVToken=secret, may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nWithout a command, answers queries from PowerDNS or on ListenAddress.\n\n%s\nFlags:\n", os.Args[0], commandUsage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	if _, err := os.Stat(*configFilePath); os.IsNotExist(err) {
-		log.Fatalf("Unable to read config from %s: file does not exist", *configFilePath)
+	cfg := Config{DefaultTTL: 60, SoaRefresh: 1200, SoaRetry: 180, SoaExpiry: 1209600, SoaNx: 60}
+
+	// without -config, the default file is optional so everything can be
+	// set from the environment
+	configFileSet := false
+	flag.Visit(func(f *flag.Flag) {
+		configFileSet = configFileSet || f.Name == "config"
+	})
+
+	if _, err := os.Stat(*configFilePath); configFileSet || !os.IsNotExist(err) {
+		if err := config.Load(*configFilePath, &cfg); err != nil {
+			log.Fatalf("Unable to read config file %s: %v", *configFilePath, err)
+		}
 	}
 
-	configFileContents, err := ioutil.ReadFile(*configFilePath)
-	if err != nil {
-		log.Fatalf("Unable to read config file from %s: %v", *configFilePath, err)
+	if err := config.Environment(os.Environ(), EnvPrefix, cfg.set); err != nil {
+		log.Fatal(err)
 	}
 
-	cfg := Config{DefaultTTL: 60, SoaRefresh: 1200, SoaRetry: 180, SoaExpiry: 1209600, SoaNx: 60}
-	err = json.Unmarshal(configFileContents, &cfg)
-	if err != nil {
-		log.Fatalf("Unable to read config file from: %s: %v", *configFilePath, err)
-	} else if cfg.Hostname == "" || cfg.HostmasterEmailAddress == "" {
-		log.Fatal("Required settings Hostname, HostmasterEmailAddress, KVBackend or KVAddress not set in config file")
-	} else if len(cfg.Schemas) == 0 {
-		log.Fatal("No schemas are defined in config file")
-	} else if cfg.DefaultTTL == 0 || cfg.SoaRefresh == 0 || cfg.SoaRetry == 0 || cfg.SoaExpiry == 0 || cfg.SoaNx == 0 {
-		log.Printf("At least one of DefaultTTL, SoaRefresh, SoaRetry, SoaExpiry or SoaNx is set to zero. Is this what you intended?")
+	for _, setting := range settings {
+		tokens := strings.SplitN(setting, "=", 2)
+
+		if len(tokens) != 2 {
+			log.Fatalf("Invalid -set %s, expected Setting=value", setting)
+		}
+
+		if err := cfg.set(tokens[0], tokens[1]); err != nil {
+			log.Fatalf("Invalid -set %s: %v", setting, err)
+		}
+	}
+
+	// check-config reports the problems itself
+	if flag.Arg(0) == "check-config" {
+		cmd := &command{config: cfg, output: *output, out: os.Stdout}
+
+		if err := cmd.run(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if problems := cfg.validate(); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("Invalid configuration: %v", problem)
+		}
+		log.Fatalf("Found %d problems in the configuration, run check-config for details", len(problems))
+	}
+
+	if err := setupLogging(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.DefaultTTL == 0 || cfg.SoaRefresh == 0 || cfg.SoaRetry == 0 || cfg.SoaExpiry == 0 || cfg.SoaNx == 0 {
+		logging.Warn("At least one of DefaultTTL, SoaRefresh, SoaRetry, SoaExpiry or SoaNx is set to zero. Is this what you intended?")
+	}
+
+	schemas := openSchemas(cfg)
+
+	if flag.NArg() > 0 {
+		cmd := &command{config: cfg, schemas: schemas, output: *output, out: os.Stdout}
+
+		if err := cmd.run(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	checker := &health.Checker{Schemas: schemas}
+	checker.Check()
+
+	if !cfg.AllowNoWorkingSchemas && !checker.Healthy() {
+		log.Fatal("No schema could be opened or has a store that can be reached, run check-config for details or set AllowNoWorkingSchemas to start anyway")
+	}
+
+	var (
+		auditSink audit.Sink
+		auditLog  *audit.BufferedSink
+	)
+	if cfg.AuditLog != "" {
+		sink, err := audit.NewSink(cfg.AuditLog)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		auditLog = audit.NewBufferedSink(sink, audit.BufferSize)
+		auditSink = auditLog
+	}
+
+	index := schema.NewZoneIndex(schemas)
+
+	if cfg.WatchZones || auditSink != nil {
+		for _, curSchema := range schemas {
+			go watchZones(cfg, curSchema, index, auditSink, nil)
+		}
+	}
+
+	quitChan := make(chan bool)
+
+	if cfg.APIKey != "" {
+		go serveAPI(cfg, schemas)
+	}
+
+	go checker.Run(nil)
+
+	if cfg.HealthListenAddress != "" {
+		go serveHealth(cfg.HealthListenAddress, checker)
+	}
+
+	resolver := resolve(cfg, index, schemas)
+	resolver = flattenAliases(alias.NewResolver(resolver, cfg.AliasResolver), resolver)
+
+	var logQuery func(*store.Query, *schema.Result, error, time.Time)
+
+	if cfg.QueryLog != "" {
+		queryLog, err := querylog.New(cfg.QueryLog)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		queryLog.SampleRate, queryLog.Include, queryLog.Exclude = cfg.QueryLogSampleRate, cfg.QueryLogInclude, cfg.QueryLogExclude
+		logQuery = queryLog.Log
+	}
+
+	if cfg.ListenAddress != "" {
+		server := &dnsserver.Server{Resolve: resolver, Update: update(cfg, index), TsigSecrets: make(map[string]string), Log: logQuery}
+		for name, secret := range cfg.TsigKeys {
+			server.TsigSecrets[dns.Fqdn(strings.ToLower(name))] = secret
+		}
+
+		go serveDNS(cfg.ListenAddress, server, quitChan)
+	} else {
+		go servePipe(&pdns.Handler{Lookup: resolveTransform(resolver, logQuery), Healthy: checker.Healthy}, quitChan)
 	}
 
-	var schemas []schema.Schema
+	var wg sync.WaitGroup
+	wg.Add(1)
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan)
+	go func() {
+		for {
+			exit := false
+
+			select {
+			case signal := <-signalChan:
+				if signal == syscall.SIGINT || signal == syscall.SIGTERM {
+					logging.Info("Received signal, exiting", "signal", signal)
+					exit = true
+				}
+			case quit := <-quitChan:
+				if quit {
+					logging.Info("Exit requested by application, exiting")
+					exit = true
+				}
+			}
+
+			if exit {
+				break
+			}
+		}
+
+		wg.Done()
+	}()
+
+	wg.Wait()
+
+	if auditLog != nil {
+		if err := auditLog.Close(5 * time.Second); err != nil {
+			logging.Error("Unable to write audit log", "error", err)
+		}
+	}
+
+	for _, curSchema := range schemas {
+		if snapshot, ok := curSchema.Store().(*store.SnapshotStore); ok {
+			snapshot.Flush()
+		}
+	}
+}
+
+// openSchemas creates the configured schemas, skipping those whose store
+// cannot be set up
+func openSchemas(cfg Config) (schemas []schema.Schema) {
 	for _, schemaConfig := range cfg.Schemas {
-		kvStore, err := store.NewLibKVStore(schemaConfig.KVBackend, []string{schemaConfig.KVAddress})
+		kvStore, err := newSchemaStore(schemaConfig)
 
 		if err != nil {
-			log.Printf("Unable to create kv store for schema %v: %v", schemaConfig, err)
+			logging.Error("Unable to create kv store for schema", "schema", schemaConfig, "error", err)
+			continue
+		}
+
+		kvStore, err = store.NewSnapshotStore(kvStore, schemaConfig.SnapshotPath)
+
+		if err != nil {
+			logging.Error("Unable to load snapshot for schema", "schema", schemaConfig, "error", err)
 			continue
 		}
 
 		curSchema, err := schema.NewSchema(schemaConfig.Name, kvStore, cfg.DefaultTTL)
 
 		if err != nil {
-			log.Printf("Unable to create schema for %v: %v", schemaConfig, err)
+			logging.Error("Unable to create schema", "schema", schemaConfig, "error", err)
 			continue
 		}
 
 		schemas = append(schemas, curSchema)
 	}
 
-	inChan, outChan, quitChan := make(chan []byte), make(chan []byte), make(chan bool)
-	handler := &pdns.Handler{resolveTransform(cfg, schemas)}
+	return schemas
+}
+
+// servePipe speaks the PowerDNS pipe backend protocol on stdin and stdout
+func servePipe(handler *pdns.Handler, quitChan chan bool) {
+	inChan, outChan := make(chan []byte), make(chan []byte)
 
 	go func() {
 		handler.Handle(inChan, outChan)
@@ -164,22 +844,22 @@ func main() {
 			line, isPrefix, err := bufReader.ReadLine()
 
 			if isPrefix {
-				log.Printf("Got a prefixed line, returning")
+				logging.Warn("Got a prefixed line, returning")
 				continue
 			}
 
 			if err != nil {
 				if err == io.EOF {
-					log.Printf("Received EOF on input, exiting")
+					logging.Info("Received EOF on input, exiting")
 					quitChan <- true
 					break
 				} else {
-					log.Printf("Error reading line: %v", err)
+					logging.Error("Error reading line", "error", err)
 					continue
 				}
 			}
 
-			debug("In:  %s", line)
+			logging.Debug("Pipe request", "line", string(line))
 			inChan <- line
 		}
 	}()
@@ -187,39 +867,54 @@ func main() {
 	go func() {
 		for {
 			line := <-outChan
-			debug("Out: %s", line)
+			logging.Debug("Pipe response", "line", string(line))
 			io.WriteString(os.Stdout, string(line))
 		}
 	}()
+}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan)
-	go func() {
-		for {
-			exit := false
+// serveDNS answers DNS queries on address without PowerDNS
+func serveDNS(address string, server *dnsserver.Server, quitChan chan bool) {
+	logging.Info("Serving DNS", "address", address)
 
-			select {
-			case signal := <-signalChan:
-				if signal == syscall.SIGINT || signal == syscall.SIGTERM {
-					log.Printf("Received signal: %v, exiting", signal)
-					exit = true
-				}
-			case quit := <-quitChan:
-				if quit {
-					log.Printf("Exit requested by application, exiting")
-					exit = true
-				}
-			}
+	if err := server.ListenAndServe(address); err != nil {
+		logging.Error("Unable to serve DNS", "address", address, "error", err)
+	}
 
-			if exit {
-				break
-			}
-		}
+	quitChan <- true
+}
 
-		wg.Done()
-	}()
+// serveAPI serves the HTTP API for managing zones and records
+func serveAPI(config Config, schemas []schema.Schema) {
+	address := config.APIListenAddress
+	if address == "" {
+		address = "127.0.0.1:8081"
+	}
 
-	wg.Wait()
+	server := &api.Server{
+		Schemas:    schemas,
+		APIKey:     config.APIKey,
+		DefaultTTL: config.DefaultTTL,
+		SOA: func(zone string, kv store.Store) (*store.Entry, error) {
+			return soa.NewGenerator(config.readOnlyGeneratorConfig(zone), time.Now()).RetrieveOrCreateSOAEntry(kv, zone)
+		},
+		UpdateSOA: func(zone string, kv store.Store) error {
+			_, err := soa.NewGenerator(config.generatorConfig(zone), time.Now()).RetrieveOrCreateSOAEntry(kv, zone)
+			return err
+		},
+	}
+
+	logging.Info("Serving HTTP API", "address", address)
+
+	if err := server.ListenAndServe(address); err != nil {
+		logging.Error("Unable to serve HTTP API", "address", address, "error", err)
+	}
+}
+
+func serveHealth(address string, checker *health.Checker) {
+	logging.Info("Serving health checks", "address", address)
+
+	if err := http.ListenAndServe(address, checker); err != nil {
+		logging.Error("Unable to serve health checks", "address", address, "error", err)
+	}
 }
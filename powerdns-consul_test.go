@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+func TestSchemaConfigString(t *testing.T) {
+	testCases := []struct {
+		schemaConfig SchemaConfig
+		expected     string
+	}{
+		{SchemaConfig{Name: "flat", StoreConfig: StoreConfig{KVBackend: "consulapi", KVAddress: "127.0.0.1:8500", KVToken: "secret"}}, "flat (consulapi 127.0.0.1:8500)"},
+		{SchemaConfig{Name: "flat", Mode: "failover", Stores: []StoreConfig{
+			{KVBackend: "consulapi", KVAddress: "consul-primary:8500", KVToken: "secret"},
+			{KVBackend: "consulapi", KVAddress: "consul-replica:8500", KVToken: "secret"},
+		}}, "flat (consulapi consul-primary:8500, consulapi consul-replica:8500)"},
+	}
+
+	for _, tc := range testCases {
+		actual := tc.schemaConfig.String()
+
+		if actual != tc.expected || strings.Contains(actual, "secret") {
+			t.Errorf("TestSchemaConfigString: actual %s, expected %s", actual, tc.expected)
+		}
+	}
+}
+
+func TestConfigSet(t *testing.T) {
+	testCases := []struct {
+		path        string
+		value       string
+		expectedErr bool
+	}{
+		{"Hostname", "ns.example.com.", false},
+		{"KVAddress", "127.0.0.1:8500", false},
+		{"KVTOKEN", "secret", false},
+		{"Schemas_1_KVAddress", "consul-replica:8500", false},
+		{"Zones_example.com_Notify", "192.0.2.1,192.0.2.2", false},
+		{"Bogus", "x", true},
+		{"DefaultTTL", "soon", true},
+	}
+
+	cfg := Config{Schemas: []SchemaConfig{{Name: "flat"}, {Name: "flat"}}}
+
+	for _, tc := range testCases {
+		if err := cfg.set(tc.path, tc.value); (err != nil) != tc.expectedErr {
+			t.Errorf("TestConfigSet(%s): actual %v, expected error %v", tc.path, err, tc.expectedErr)
+		}
+	}
+
+	expected := Config{
+		Hostname: "ns.example.com.",
+		Schemas: []SchemaConfig{
+			{Name: "flat", StoreConfig: StoreConfig{KVAddress: "127.0.0.1:8500", KVToken: "secret"}},
+			{Name: "flat", StoreConfig: StoreConfig{KVAddress: "consul-replica:8500"}},
+		},
+		Zones: map[string]ZoneConfig{"example.com": {Notify: []string{"192.0.2.1", "192.0.2.2"}}},
+	}
+
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("TestConfigSet: actual %+v, expected %+v", cfg, expected)
+	}
+}
+
+func TestChangedKeys(t *testing.T) {
+	previous := map[string]uint64{"vars/a": 1, "vars/b": 2, "vars/c": 3}
+	current := map[string]uint64{"vars/a": 1, "vars/b": 4, "vars/d": 5}
+	expected := map[string]bool{"vars/b": true, "vars/c": true, "vars/d": true}
+
+	if actual := changedKeys(previous, current); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("TestChangedKeys: actual %v, expected %v", actual, expected)
+	}
+}
+
+func TestZonesUsing(t *testing.T) {
+	pairs := map[string]store.Pair{
+		"vars/lb-vip":            store.NewPair("vars/lb-vip", []byte("192.0.2.10"), 1),
+		"vars/mx":                store.NewPair("vars/mx", []byte("mx.example.com."), 2),
+		"zones/a.com/A":          store.NewPair("zones/a.com/A", []byte(`[{"Payload":"{{ var \"lb-vip\" }}"}]`), 3),
+		"zones/b.com/MX":         store.NewPair("zones/b.com/MX", []byte(`[{"Payload":"10 {{ var \"mx\" }}"}]`), 4),
+		"zones/c.com/www/A":      store.NewPair("zones/c.com/www/A", []byte(`[{"Payload":"@ref zones/a.com/A"}]`), 5),
+		"zones/d.com/A":          store.NewPair("zones/d.com/A", []byte(`[{"Payload":"{{ var \"missing\" }}"}]`), 6),
+		"zones/e.com/A":          store.NewPair("zones/e.com/A", []byte(`[{"Payload":"192.0.2.1"}]`), 7),
+		"zones/f.com/broken/TXT": store.NewPair("zones/f.com/broken/TXT", []byte(`not json`), 8),
+	}
+	kv := &store.MockStore{
+		GetFunc: func(key string) (store.Pair, error) {
+			if pair, ok := pairs[key]; ok {
+				return pair, nil
+			}
+			return nil, store.ErrKeyNotFound
+		},
+		ListFunc: func(directory string) (result []store.Pair, err error) {
+			for key, pair := range pairs {
+				if strings.HasPrefix(key, directory+"/") {
+					result = append(result, pair)
+				}
+			}
+			return result, nil
+		},
+	}
+
+	testCases := []struct {
+		keys     []string
+		expected []string
+	}{
+		{[]string{"vars/lb-vip"}, []string{"a.com", "c.com"}},
+		{[]string{"vars/mx"}, []string{"b.com"}},
+		{[]string{"vars/missing"}, []string{"d.com"}},
+		{[]string{"vars/other"}, nil},
+	}
+
+	for _, tc := range testCases {
+		keys := make(map[string]bool)
+		for _, key := range tc.keys {
+			keys[key] = true
+		}
+
+		actual, err := zonesUsing(kv, keys)
+		sort.Strings(actual)
+
+		if err != nil || !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("TestZonesUsing(%v): actual %v %v, expected %v", tc.keys, actual, err, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package querylog
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+	"github.com/Shark/powerdns-consul/logging"
+)
+
+// BufferSize is the number of records waiting to be written, records are
+// dropped instead of delaying queries once it is full
+const BufferSize = 4096
+
+// ErrorLogInterval is the least time between two logged write errors, the
+// records failing in between are counted
+const ErrorLogInterval = time.Minute
+
+// MaxReconnectDelay limits the time between two attempts to connect to the
+// socket, which doubles from a second after every failed attempt
+const MaxReconnectDelay = time.Minute
+
+// Record is written as one JSON line per query
+type Record struct {
+	Time      time.Time `json:"time"`
+	Qname     string    `json:"qname"`
+	Qtype     string    `json:"qtype"`
+	RemoteIp  string    `json:"remote_ip,omitempty"`
+	Id        string    `json:"id,omitempty"`
+	Zone      string    `json:"zone,omitempty"`
+	Result    string    `json:"result"` // NOERROR, NXDOMAIN, REFERRAL, REFUSED or SERVFAIL
+	Answers   []*Answer `json:"answers"`
+	LatencyUs int64     `json:"latency_us"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type Answer struct {
+	Type    string `json:"type"`
+	TTL     uint32 `json:"ttl"`
+	Content string `json:"content"`
+}
+
+// Logger writes a record for every query passing its filters
+type Logger struct {
+	SampleRate float64  // share of queries logged, all if 0
+	Include    []string // only log names in these domains if not empty
+	Exclude    []string // never log names in these domains
+
+	records chan []byte
+	dropped uint64
+	random  func() float64
+	now     func() time.Time
+}
+
+// New returns a logger writing to target, which is the path of a file to
+// append to or unix:<path> for a unix socket
+func New(target string) (*Logger, error) {
+	var writer io.Writer
+
+	if strings.HasPrefix(target, "unix:") {
+		writer = &socketWriter{path: strings.TrimPrefix(target, "unix:"), now: time.Now}
+	} else {
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+
+		if err != nil {
+			return nil, err
+		}
+
+		writer = file
+	}
+
+	return newLogger(writer), nil
+}
+
+func newLogger(writer io.Writer) *Logger {
+	l := &Logger{records: make(chan []byte, BufferSize), random: rand.Float64, now: time.Now}
+	go l.write(writer)
+	return l
+}
+
+func (l *Logger) matches(qname string) bool {
+	qname = strings.ToLower(strings.TrimSuffix(qname, "."))
+
+	if len(l.Include) > 0 && !inDomains(qname, l.Include) {
+		return false
+	}
+
+	if inDomains(qname, l.Exclude) {
+		return false
+	}
+
+	return l.SampleRate <= 0 || l.SampleRate >= 1 || l.random() < l.SampleRate
+}
+
+func inDomains(name string, domains []string) bool {
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Log records the answer to query, which started at start, unless the
+// filters skip its name. Frontends call it once per request.
+func (l *Logger) Log(query *store.Query, result *schema.Result, err error, start time.Time) {
+	if !l.matches(query.Name) {
+		return
+	}
+
+	record := &Record{
+		Time:      start,
+		Qname:     query.Name,
+		Qtype:     query.Type,
+		RemoteIp:  query.RemoteIp,
+		Id:        query.Id,
+		Answers:   make([]*Answer, 0),
+		LatencyUs: l.now().Sub(start).Microseconds(),
+	}
+
+	switch {
+	case err != nil:
+		record.Result, record.Error = "SERVFAIL", err.Error()
+	case result.Zone == "":
+		record.Result = "REFUSED"
+	case result.Delegation != "":
+		record.Result = "REFERRAL"
+	case !result.NameExists:
+		record.Result = "NXDOMAIN"
+	default:
+		record.Result = "NOERROR"
+	}
+
+	if result != nil {
+		record.Zone = result.Zone
+
+		for _, entry := range result.Entries {
+			record.Answers = append(record.Answers, &Answer{entry.Type, entry.Ttl, entry.Payload})
+		}
+	}
+
+	encoded, encodeErr := json.Marshal(record)
+
+	if encodeErr != nil {
+		logging.Error("Unable to encode query log record", "qname", query.Name, "error", encodeErr)
+		return
+	}
+
+	select {
+	case l.records <- append(encoded, '\n'):
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+func (l *Logger) write(writer io.Writer) {
+	var (
+		failed    uint64
+		lastError time.Time
+	)
+
+	for record := range l.records {
+		if dropped := atomic.SwapUint64(&l.dropped, 0); dropped > 0 {
+			logging.Warn("Query log could not keep up, dropped records", "dropped", dropped)
+		}
+
+		if _, err := writer.Write(record); err != nil {
+			failed++
+
+			if now := l.now(); now.Sub(lastError) >= ErrorLogInterval {
+				logging.Error("Unable to write query log", "failed", failed, "error", err)
+				failed, lastError = 0, now
+			}
+		} else if !lastError.IsZero() {
+			logging.Info("Writing query log again", "failed", failed)
+			failed, lastError = 0, time.Time{}
+		}
+	}
+}
+
+// errNotConnected is returned while the socket writer waits to reconnect
+var errNotConnected = errors.New("Not connected to the query log socket, waiting to reconnect")
+
+// socketWriter writes to a unix socket and reconnects after errors, waiting
+// longer after every failed attempt
+type socketWriter struct {
+	path    string
+	conn    net.Conn
+	now     func() time.Time
+	delay   time.Duration
+	retryAt time.Time
+}
+
+func (w *socketWriter) Write(p []byte) (int, error) {
+	if w.conn == nil {
+		if w.now().Before(w.retryAt) {
+			return 0, errNotConnected
+		}
+
+		conn, err := net.Dial("unix", w.path)
+
+		if err != nil {
+			w.backOff()
+			return 0, err
+		}
+
+		w.conn, w.delay = conn, 0
+	}
+
+	n, err := w.conn.Write(p)
+
+	if err != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+
+	return n, err
+}
+
+func (w *socketWriter) backOff() {
+	if w.delay *= 2; w.delay == 0 {
+		w.delay = time.Second
+	} else if w.delay > MaxReconnectDelay {
+		w.delay = MaxReconnectDelay
+	}
+
+	w.retryAt = w.now().Add(w.delay)
+}
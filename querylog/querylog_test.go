@@ -0,0 +1,128 @@
+package querylog
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shark/powerdns-consul/backend/schema"
+	"github.com/Shark/powerdns-consul/backend/store"
+)
+
+func TestMatches(t *testing.T) {
+	l := &Logger{Include: []string{"example.com."}, Exclude: []string{"internal.example.com"}, SampleRate: 0.5}
+
+	testCases := []struct {
+		qname    string
+		random   float64
+		expected bool
+	}{
+		{"example.com.", 0.1, true},
+		{"WWW.Example.com.", 0.1, true},
+		{"www.example.com.", 0.9, false},
+		{"badexample.com.", 0.1, false},
+		{"example.org.", 0.1, false},
+		{"internal.example.com.", 0.1, false},
+		{"db.internal.example.com.", 0.1, false},
+	}
+
+	for _, tc := range testCases {
+		random := tc.random
+		l.random = func() float64 { return random }
+
+		if actual := l.matches(tc.qname); actual != tc.expected {
+			t.Errorf("TestMatches(%s, %v): actual %v, expected %v", tc.qname, tc.random, actual, tc.expected)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := 0
+	l := &Logger{records: make(chan []byte, 10), now: func() time.Time {
+		calls++
+		return start.Add(time.Duration(calls-1) * 1500 * time.Microsecond)
+	}}
+
+	results := map[string]*schema.Result{
+		"www.example.com.":  {Zone: "example.com", NameExists: true, Entries: []*store.Entry{{Type: "A", Ttl: 60, Payload: "192.0.2.1"}}},
+		"none.example.com.": {Zone: "example.com"},
+		"sub.example.com.":  {Zone: "example.com", NameExists: true, Delegation: "sub.example.com"},
+		"example.org.":      {},
+	}
+
+	resolve := func(query *store.Query) {
+		start := l.now()
+		result, ok := results[query.Name]
+		if ok {
+			l.Log(query, result, nil, start)
+		} else {
+			l.Log(query, nil, errors.New("store down"), start)
+		}
+	}
+
+	testCases := []struct {
+		query    *store.Query
+		expected string
+	}{
+		{&store.Query{Name: "www.example.com.", Type: "A", RemoteIp: "192.0.2.53", Id: "1"}, `{"time":"2021-01-01T00:00:00Z","qname":"www.example.com.","qtype":"A","remote_ip":"192.0.2.53","id":"1","zone":"example.com","result":"NOERROR","answers":[{"type":"A","ttl":60,"content":"192.0.2.1"}],"latency_us":1500}`},
+		{&store.Query{Name: "none.example.com.", Type: "A"}, `{"time":"2021-01-01T00:00:00.003Z","qname":"none.example.com.","qtype":"A","zone":"example.com","result":"NXDOMAIN","answers":[],"latency_us":1500}`},
+		{&store.Query{Name: "sub.example.com.", Type: "A"}, `{"time":"2021-01-01T00:00:00.006Z","qname":"sub.example.com.","qtype":"A","zone":"example.com","result":"REFERRAL","answers":[],"latency_us":1500}`},
+		{&store.Query{Name: "example.org.", Type: "A"}, `{"time":"2021-01-01T00:00:00.009Z","qname":"example.org.","qtype":"A","result":"REFUSED","answers":[],"latency_us":1500}`},
+		{&store.Query{Name: "broken.example.com.", Type: "A"}, `{"time":"2021-01-01T00:00:00.012Z","qname":"broken.example.com.","qtype":"A","result":"SERVFAIL","answers":[],"latency_us":1500,"error":"store down"}`},
+	}
+
+	for _, tc := range testCases {
+		resolve(tc.query)
+
+		if actual := string(<-l.records); actual != tc.expected+"\n" {
+			t.Errorf("TestLog(%s): actual %s, expected %s", tc.query.Name, actual, tc.expected)
+		}
+	}
+}
+
+func TestSocketWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "querylog.sock")
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := &socketWriter{path: path, now: func() time.Time { return now }}
+
+	if _, err := w.Write([]byte("1\n")); err == nil || err == errNotConnected {
+		t.Errorf("TestSocketWriter: actual %v, expected a dial error", err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if _, err := w.Write([]byte("2\n")); err != errNotConnected {
+		t.Errorf("TestSocketWriter: actual %v, expected %v", err, errNotConnected)
+	}
+
+	now = now.Add(time.Second)
+
+	if _, err := w.Write([]byte("3\n")); err != nil {
+		t.Errorf("TestSocketWriter: actual %v, expected <nil>", err)
+	}
+
+	for _, failures := range []int{1, 2, 3, 10} {
+		w.conn, w.delay = nil, 0
+		w.path = path + ".missing"
+		for i := 0; i < failures; i++ {
+			w.retryAt = time.Time{}
+			w.Write([]byte("4\n"))
+		}
+
+		expected := time.Second << (failures - 1)
+		if expected > MaxReconnectDelay {
+			expected = MaxReconnectDelay
+		}
+
+		if actual := w.retryAt.Sub(now); actual != expected {
+			t.Errorf("TestSocketWriter(%d failures): actual delay %v, expected %v", failures, actual, expected)
+		}
+	}
+}